@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// agentKeys returns the key lines of the identities the ssh agent holds,
+// as listed by ssh-add -L, leaving out keys not of a -key-type type. Every
+// key has to pass the key policy.
+func agentKeys() ([]string, error) {
+	out, err := exec.Command("ssh-add", "-L").Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil, fmt.Errorf("the agent has no identities")
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		return nil, fmt.Errorf("could not connect to the agent, SSH_AUTH_SOCK is %q", os.Getenv("SSH_AUTH_SOCK"))
+	} else if err != nil {
+		return nil, fmt.Errorf("listing the agent's keys: %v", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if _, key, err := parseAuthorizedKey(line); err == nil && !wantedKeyType(key) {
+			continue
+		}
+		if err := checkKeyPolicy(line); err != nil {
+			return nil, fmt.Errorf("agent key %s: %v", describeLine(line), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("the agent holds no %s keys", pCommandLineArgs.KeyTypes)
+	}
+	return lines, nil
+}
+
+// installAgentKeys installs every key of the agent on the hosts for
+// -all-agent-keys, listing the keys and the changes per host before asking
+// for confirmation.
+func installAgentKeys() error {
+	lines, err := agentKeys()
+	if err != nil {
+		return err
+	}
+	if err := discoverTargets(); err != nil {
+		return err
+	}
+	fmt.Printf("The agent holds %d keys:\n", len(lines))
+	keys := make([]*publicKey, len(lines))
+	for i, line := range lines {
+		_, keys[i], _ = parseAuthorizedKey(line)
+		fmt.Printf("\t%s\n", describeLine(line))
+	}
+	ctx := context.Background()
+	contents, failed := fetchAuthorizedKeys(ctx, pCommandLineArgs.Hosts)
+	p := &changePlan{Created: time.Now().UTC()}
+	changes := 0
+	for _, host := range pCommandLineArgs.Hosts {
+		if remote, ok := contents[host]; ok {
+			hp := diffAuthorizedKeys(host, remote, keys, nil)
+			if !hp.empty() {
+				changes++
+			}
+			p.Hosts = append(p.Hosts, hp)
+		}
+	}
+	p.print()
+	if changes > 0 && !pCommandLineArgs.DryRun {
+		if !confirm(fmt.Sprintf("Install the keys on %d hosts?", changes)) {
+			return fmt.Errorf("aborted")
+		}
+		failed += applyPlan(ctx, p)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d hosts failed", failed)
+	}
+	return nil
+}
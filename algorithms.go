@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// serverSigAlgsPattern finds the server-sig-algs extension, the public key
+// algorithms the server accepts, in the ssh -v output.
+var serverSigAlgsPattern = regexp.MustCompile(`server-sig-algs=<([^>]*)>`)
+
+// sigAlgsRunner connects with ssh -v without authenticating and returns the
+// server-sig-algs of the server as its output. The command is ignored.
+type sigAlgsRunner struct {
+	ssh *sshRunner
+}
+
+func (r *sigAlgsRunner) Run(ctx context.Context, host, command string) (Result, error) {
+	args := append(r.ssh.hostArgs(host), "-v", "-o", "BatchMode=yes", "-o", "PreferredAuthentications=none", "--", host, "true")
+	result, err := runHostProcess(ctx, host, "ssh", args, nil, nil, nil)
+	if m := serverSigAlgsPattern.FindSubmatch(result.Stderr); m != nil {
+		return Result{Stdout: m[1]}, nil
+	}
+	if bytes.Contains(result.Stderr, []byte("Authentications that can continue")) || bytes.Contains(result.Stderr, []byte("Permission denied")) {
+		return Result{ExitCode: 1}, fmt.Errorf("the server does not tell the algorithms it accepts, it sent no server-sig-algs")
+	}
+	return result, err
+}
+
+// keyAlgorithms returns the signature algorithms a key of type keyType logs
+// in with; certificates are judged by their key.
+func keyAlgorithms(keyType string) []string {
+	base := strings.TrimSuffix(keyType, "-cert-v01@openssh.com")
+	if base == "ssh-rsa" {
+		return []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"}
+	}
+	return []string{base}
+}
+
+func runAlgorithms(args []string) error {
+	fs := flag.NewFlagSet("algorithms", flag.ExitOnError)
+	addConnectionFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: algorithms [-i identity] [user@]hostname...")
+	}
+	if pCommandLineArgs.Transport != "ssh" {
+		return fmt.Errorf("algorithms needs the ssh transport")
+	}
+	var key *publicKey
+	if pCommandLineArgs.IdentityFile != "" {
+		if err := resolveSSHFile(); err != nil {
+			return err
+		}
+		var err error
+		if _, key, err = parseAuthorizedKey(pCommandLineArgs.KeyData); err != nil {
+			return err
+		}
+	}
+	hosts, err := expandHosts(fs.Args())
+	if err != nil {
+		return err
+	}
+	f := &fleet{Runner: &sigAlgsRunner{ssh: newSSHRunner()}, Parallel: pCommandLineArgs.Parallel}
+	failed := 0
+	for _, r := range f.Run(context.Background(), hosts, "") {
+		if r.Status != statusInstalled {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %s\n", r.Host, r.Error)
+			continue
+		}
+		accepted := strings.Split(string(r.Output), ",")
+		fmt.Printf("%s: %s\n", r.Host, strings.Join(accepted, " "))
+		if key == nil {
+			continue
+		}
+		usable := ""
+		for _, algorithm := range keyAlgorithms(key.Type) {
+			for _, a := range accepted {
+				if a == algorithm && usable == "" {
+					usable = algorithm
+				}
+			}
+		}
+		if usable == "" {
+			fmt.Printf("%s: the %s key %s is not accepted\n", r.Host, keyTypeName(key.Type), key.Fingerprint())
+		} else {
+			fmt.Printf("%s: the %s key %s is accepted with %s\n", r.Host, keyTypeName(key.Type), key.Fingerprint(), usable)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d hosts failed", failed)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["algorithms"] = subcommand{"Report the public key algorithms the hosts accept", runAlgorithms}
+}
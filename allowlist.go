@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// allowlist holds the fingerprints of the keys allowed on the hosts.
+type allowlist map[string]bool
+
+func loadAllowlist(fileName string) (allowlist, error) {
+	fingerprints, err := readFingerprintList(fileName)
+	if err != nil {
+		return nil, err
+	}
+	a := allowlist{}
+	for _, fingerprint := range fingerprints {
+		a[fingerprint] = true
+	}
+	return a, nil
+}
+
+// Allows reports whether key is on the allowlist.
+func (a allowlist) Allows(key *publicKey) bool {
+	return a[key.Fingerprint()] || a[key.FingerprintMD5()]
+}
+
+// unknownKeys returns the inventory entries whose key is not allowed.
+func (a allowlist) unknownKeys(entries []inventoryEntry) []inventoryEntry {
+	var unknown []inventoryEntry
+	for _, e := range entries {
+		if !a.Allows(e.key) {
+			unknown = append(unknown, e)
+		}
+	}
+	return unknown
+}
+
+// runAudit reports the keys on the hosts that are not on the allowlist,
+// without changing anything.
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	addConnectionFlags(fs)
+	allowlistFile := fs.String("allowlist", "", "Keys allowed on the hosts: public key lines or SHA256/MD5 fingerprints")
+	allUsers := fs.Bool("all-users", false, "Audit the authorized_keys of every user the login user may read")
+	format := fs.String("format", "text", "Output format: text, json or csv")
+	fs.Parse(args)
+	if fs.NArg() < 1 || *allowlistFile == "" {
+		return fmt.Errorf("usage: audit -allowlist keys.txt [-all-users] [-format text|json|csv] [user@]hostname...")
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	allowed, err := loadAllowlist(*allowlistFile)
+	if err != nil {
+		return err
+	}
+	hosts, err := expandHosts(fs.Args())
+	if err != nil {
+		return err
+	}
+	entries, _, failed := collectInventory(context.Background(), hosts, *allUsers)
+	unknown := allowed.unknownKeys(entries)
+	if *format == "text" {
+		for _, e := range unknown {
+			fmt.Printf("%s: unknown key %s %s %s for %s in %s:%d\n", e.Host, e.Type, e.Fingerprint, e.Comment, e.User, e.File, e.Line)
+		}
+	} else if err := writeInventory(os.Stdout, *format, unknown); err != nil {
+		return err
+	}
+	if len(unknown) > 0 || failed > 0 {
+		return fmt.Errorf("%d unknown keys found, %d hosts failed", len(unknown), failed)
+	}
+	if *format == "text" {
+		fmt.Printf("All %d keys on %d hosts are on the allowlist\n", len(entries), len(hosts))
+	}
+	return nil
+}
+
+// pruneCommand removes the keys of entries, all from host, from their
+// authorized_keys files, going on with the next file when one fails.
+func pruneCommand(entries []inventoryEntry) string {
+	var files []string
+	keys := map[string][]*publicKey{}
+	for _, e := range entries {
+		if keys[e.File] == nil {
+			files = append(files, e.File)
+		}
+		keys[e.File] = append(keys[e.File], e.key)
+	}
+	var b strings.Builder
+	b.WriteString("failed=0\n")
+	for _, file := range files {
+		fmt.Fprintf(&b, "(%s)\nrc=$?; [ $rc -eq 0 ] || [ $rc -eq %d ] || failed=1\n", removeKeysFromFile(file, keys[file]), exitKeyNotFound)
+	}
+	b.WriteString("exit $failed")
+	return b.String()
+}
+
+// pruneDiff returns the unified diff of removing the entries from the
+// authorized_keys files in the inventory output of host, whose file markers
+// are marker.
+func pruneDiff(host string, output []byte, marker string, entries []inventoryEntry, color bool) string {
+	drop := map[string]map[int]bool{}
+	for _, e := range entries {
+		if drop[e.File] == nil {
+			drop[e.File] = map[int]bool{}
+		}
+		drop[e.File][e.Line] = true
+	}
+	files, lines := inventoryFiles(output, marker)
+	var b strings.Builder
+	for _, file := range files {
+		if drop[file] == nil {
+			continue
+		}
+		var after []string
+		for i, line := range lines[file] {
+			if !drop[file][i+1] {
+				after = append(after, line)
+			}
+		}
+		b.WriteString(unifiedDiff(host+":"+file, lines[file], after, color))
+	}
+	return b.String()
+}
+
+// runEnforce shows the keys on the hosts that are not on the allowlist and
+// with -prune, after confirmation, removes them.
+func runEnforce(args []string) error {
+	fs := flag.NewFlagSet("enforce", flag.ExitOnError)
+	addConnectionFlags(fs)
+	addAuditFlags(fs)
+	allowlistFile := fs.String("allowlist", "", "Keys allowed on the hosts: public key lines or SHA256/MD5 fingerprints")
+	allUsers := fs.Bool("all-users", false, "Enforce the allowlist on the authorized_keys of every user the login user may write")
+	prune := fs.Bool("prune", false, "Remove the keys not on the allowlist, otherwise they are only shown")
+	dryRun := fs.Bool("dry-run", false, "Print a unified diff of the authorized_keys changes without making them")
+	colorMode := fs.String("color", "auto", "Color the diff: auto, always or never")
+	fs.BoolVar(&pCommandLineArgs.AssumeYes, "y", false, "Answer yes to all confirmation prompts")
+	fs.Parse(args)
+	if fs.NArg() < 1 || *allowlistFile == "" {
+		return fmt.Errorf("usage: enforce -allowlist keys.txt [-all-users] [-prune|-dry-run] [-y] [user@]hostname...")
+	}
+	color, err := useColor(*colorMode)
+	if err != nil {
+		return err
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	allowed, err := loadAllowlist(*allowlistFile)
+	if err != nil {
+		return err
+	}
+	hosts, err := expandHosts(fs.Args())
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	entries, outputs, failed := collectInventory(ctx, hosts, *allUsers)
+	kept := map[string]int{}
+	for _, e := range entries {
+		if allowed.Allows(e.key) {
+			kept[e.Host+" "+e.File]++
+		}
+	}
+	byHost := map[string][]inventoryEntry{}
+	for _, e := range allowed.unknownKeys(entries) {
+		byHost[e.Host] = append(byHost[e.Host], e)
+	}
+	if len(byHost) == 0 {
+		if failed > 0 {
+			return fmt.Errorf("%d hosts failed", failed)
+		}
+		fmt.Printf("All %d keys on %d hosts are on the allowlist\n", len(entries), len(hosts))
+		return nil
+	}
+	if *dryRun {
+		for _, host := range hosts {
+			if byHost[host] != nil {
+				fmt.Print(pruneDiff(host, outputs[host], listMarker(*allUsers), byHost[host], color))
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d hosts failed", failed)
+		}
+		return nil
+	}
+	unknown := 0
+	for _, host := range hosts {
+		warned := map[string]bool{}
+		for _, e := range byHost[host] {
+			unknown++
+			fmt.Printf("%s: - %s %s %s for %s in %s:%d\n", host, e.Type, e.Fingerprint, e.Comment, e.User, e.File, e.Line)
+			if kept[host+" "+e.File] == 0 && !warned[e.File] {
+				warned[e.File] = true
+				fmt.Fprintf(os.Stderr, "%s: warning: no allowed key is left in %s\n", host, e.File)
+			}
+		}
+	}
+	if !*prune {
+		return fmt.Errorf("%d keys not on the allowlist on %d hosts, run with -prune to remove them", unknown, len(byHost))
+	}
+	if !confirm(fmt.Sprintf("Remove these %d keys from %d hosts?", unknown, len(byHost))) {
+		return fmt.Errorf("aborted")
+	}
+	f := &fleet{
+		Runner:   newRunner(os.Stdout, os.Stderr),
+		Parallel: pCommandLineArgs.Parallel,
+		Skip:     func(host string) bool { return byHost[host] == nil },
+	}
+	results := f.RunEach(ctx, hosts, func(host string) string { return pruneCommand(byHost[host]) })
+	for _, r := range results {
+		if r.Status != statusSkipped {
+			var fingerprints []string
+			for _, e := range byHost[r.Host] {
+				fingerprints = append(fingerprints, e.Fingerprint)
+			}
+			recordChange("remove", fingerprints, []hostResult{r})
+		}
+		switch r.Status {
+		case statusSkipped:
+		case statusInstalled:
+			fmt.Printf("%s: removed %d keys\n", r.Host, len(byHost[r.Host]))
+		default:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: Error removing keys.Reason: %v\n", r.Host, r.Error)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d hosts failed", failed)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["audit"] = subcommand{"Report the keys on the hosts that are not on an allowlist", runAudit}
+	subcommands["enforce"] = subcommand{"Remove the keys on the hosts that are not on an allowlist", runEnforce}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// auditEntry is one line of the audit log. Prev holds the SHA-256 of the
+	// previous line, so removed or reordered entries are detected.
+	auditEntry struct {
+		Time        time.Time `json:"time"`
+		Actor       string    `json:"actor"`
+		Action      string    `json:"action"`
+		Host        string    `json:"host"`
+		User        string    `json:"user,omitempty"`
+		Fingerprint string    `json:"fingerprint"`
+		Result      string    `json:"result"`
+		Prev        string    `json:"prev"`
+		Algorithm   string    `json:"alg,omitempty"`
+		Signature   string    `json:"signature,omitempty"`
+	}
+
+	auditLog struct {
+		mu   sync.Mutex
+		path string
+		key  *rsa.PrivateKey
+		prev string
+	}
+)
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// openAuditLog prepares appending to path. When keyFile is set every entry
+// is signed with that RSA private key.
+func openAuditLog(path, keyFile string) (*auditLog, error) {
+	l := &auditLog{path: path}
+	if keyFile != "" {
+		key, err := readRSAPrivateKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		l.key = key
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n")); len(buf) > 0 {
+		l.prev = lineHash(lines[len(lines)-1])
+	}
+	return l, nil
+}
+
+func currentActor() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// splitUserHost splits a [user@]hostname target.
+func splitUserHost(target string) (string, string) {
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return "", target
+}
+
+func (l *auditLog) sign(entry *auditEntry) error {
+	if l.key == nil {
+		return nil
+	}
+	entry.Algorithm = "sha256"
+	message, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(message)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, l.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	entry.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// Record appends one entry per host, changed user and fingerprint.
+func (l *auditLog) Record(actor, action string, fingerprints []string, results []hostResult) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, r := range results {
+		_, host := splitUserHost(r.Host)
+		for _, remoteUser := range changedUsers(r) {
+			for _, fingerprint := range fingerprints {
+				entry := auditEntry{
+					Time:        time.Now().UTC(),
+					Actor:       actor,
+					Action:      action,
+					Host:        host,
+					User:        remoteUser,
+					Fingerprint: fingerprint,
+					Result:      r.Status,
+					Prev:        l.prev,
+				}
+				if err := l.sign(&entry); err != nil {
+					return err
+				}
+				line, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
+				if _, err := file.Write(append(line, '\n')); err != nil {
+					return err
+				}
+				l.prev = lineHash(line)
+			}
+		}
+	}
+	return nil
+}
+
+// changedUsers returns the remote users whose authorized_keys a result is
+// about: with -users those its output reports installed or removed, all of
+// them when none was, and the login user otherwise.
+func changedUsers(r hostResult) []string {
+	loginUser, _ := splitUserHost(r.Host)
+	if pCommandLineArgs.Users == "" {
+		return []string{loginUser}
+	}
+	var users []string
+	for _, line := range strings.Split(string(r.Output), "\n") {
+		for _, status := range []string{": installed", ": removed"} {
+			if user, ok := strings.CutSuffix(line, status); ok {
+				users = append(users, user)
+			}
+		}
+	}
+	if users == nil {
+		return pCommandLineArgs.users()
+	}
+	return users
+}
+
+// addAuditFlags adds the audit log flags to the flags of a command changing
+// authorized_keys.
+func addAuditFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pCommandLineArgs.AuditLog, "audit-log", "", "Append a record of every operation to this log file")
+	fs.StringVar(&pCommandLineArgs.AuditKey, "audit-key", "", "PEM RSA private key used to sign audit log entries")
+}
+
+var (
+	changeAudit     *auditLog
+	changeAuditErr  error
+	changeAuditOnce sync.Once
+)
+
+// openChangeAudit opens the -audit-log of this run once, returning nil
+// without one.
+func openChangeAudit() (*auditLog, error) {
+	changeAuditOnce.Do(func() {
+		if pCommandLineArgs.AuditLog != "" {
+			changeAudit, changeAuditErr = openAuditLog(pCommandLineArgs.AuditLog, pCommandLineArgs.AuditKey)
+		}
+	})
+	return changeAudit, changeAuditErr
+}
+
+// recordChange appends the entries for a change of authorized_keys to the
+// -audit-log. It is called where the keys are changed, so every command
+// changing them is audited. A removal that succeeded is recorded as removed,
+// and the removed keys are dropped from the host cache.
+func recordChange(action string, fingerprints []string, results []hostResult) {
+	if action == "remove" {
+		forgetRemovedKeys(fingerprints, results)
+	}
+	audit, err := openChangeAudit()
+	if audit == nil && err == nil {
+		return
+	}
+	if action == "remove" {
+		results = append([]hostResult{}, results...)
+		for i := range results {
+			if results[i].Status == statusInstalled {
+				results[i].Status = statusRemoved
+			}
+		}
+	}
+	if err == nil {
+		err = audit.Record(currentActor(), action, fingerprints, results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+	}
+}
+
+// lineFingerprints returns the fingerprints of the keys of authorized_keys
+// lines, skipping lines that are not keys.
+func lineFingerprints(lines []string) []string {
+	var fingerprints []string
+	for _, line := range lines {
+		if _, key, err := parseAuthorizedKey(line); err == nil {
+			fingerprints = append(fingerprints, key.Fingerprint())
+		}
+	}
+	return fingerprints
+}
+
+// verifyAuditLog checks the hash chain of the log and, with a public key,
+// the signature of every entry.
+func verifyAuditLog(path, pubKey string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	prev := ""
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		count++
+		line := scanner.Bytes()
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return count, fmt.Errorf("entry %d: %v", count, err)
+		}
+		if entry.Prev != prev {
+			return count, fmt.Errorf("entry %d: hash chain broken, entries were removed or modified", count)
+		}
+		if pubKey != "" {
+			signature := entry.Signature
+			if signature == "" {
+				return count, fmt.Errorf("entry %d is not signed", count)
+			}
+			entry.Signature = ""
+			message, err := json.Marshal(entry)
+			if err != nil {
+				return count, err
+			}
+			if entry.Algorithm == "" {
+				return count, fmt.Errorf("entry %d has no signature algorithm", count)
+			}
+			if err := CheckPEM(pubKey, signature, string(message), SignatureAlgorithm(entry.Algorithm)); err != nil {
+				return count, fmt.Errorf("entry %d: invalid signature: %v", count, err)
+			}
+		}
+		prev = lineHash(line)
+	}
+	return count, scanner.Err()
+}
+
+func runAuditLog(args []string) error {
+	fs := flag.NewFlagSet("audit-log", flag.ExitOnError)
+	pubKeyFile := fs.String("pubkey", "", "PEM public key to verify entry signatures with")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: audit-log [-pubkey key.pem] logfile")
+	}
+	pubKey := ""
+	if *pubKeyFile != "" {
+		buf, err := os.ReadFile(*pubKeyFile)
+		if err != nil {
+			return err
+		}
+		pubKey = string(buf)
+	}
+	count, err := verifyAuditLog(fs.Arg(0), pubKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d entries verified\n", fs.Arg(0), count)
+	return nil
+}
+
+func init() {
+	subcommands["audit-log"] = subcommand{"Verify the integrity and signatures of an audit log", runAuditLog}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// azureVMs parses -azure-vm, a comma separated list of resource-group/name.
+func azureVMs() ([][2]string, error) {
+	var vms [][2]string
+	for _, vm := range strings.Split(pCommandLineArgs.AzureVM, ",") {
+		group, name, ok := strings.Cut(strings.TrimSpace(vm), "/")
+		if !ok || group == "" || name == "" {
+			return nil, fmt.Errorf("invalid Azure VM %q, use resource-group/name", vm)
+		}
+		vms = append(vms, [2]string{group, name})
+	}
+	return vms, nil
+}
+
+// azureVMAccess installs the key for -azure-user through the VMAccess
+// extension, for VMs only reachable through the Azure management plane.
+func azureVMAccess(key *publicKey, name string) (string, error) {
+	vms, err := azureVMs()
+	if err != nil {
+		return "", err
+	}
+	var done []string
+	for _, vm := range vms {
+		if _, err := runCLI("az", "vm", "user", "update", "--resource-group", vm[0], "--name", vm[1],
+			"--username", pCommandLineArgs.AzureUser, "--ssh-key-value", key.String(), "--output", "none"); err != nil {
+			return "", fmt.Errorf("%s/%s: %v", vm[0], vm[1], err)
+		}
+		done = append(done, vm[0]+"/"+vm[1])
+	}
+	return fmt.Sprintf("installed for %s on %s", pCommandLineArgs.AzureUser, strings.Join(done, ", ")), nil
+}
+
+func init() {
+	keyBackends["azure"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.AzureVM != "" },
+		Upload:  azureVMAccess,
+	}
+}
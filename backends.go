@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiError is a non 2xx response of a provider API.
+type apiError struct {
+	Status int
+	Body   string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API returned %d %s: %s", e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// keyBackend registers the public key with a provider account, instead of
+// or in addition to installing it on hosts. Upload returns a description
+// of the registered key, e.g. its ID at the provider.
+type keyBackend struct {
+	Enabled func() bool
+	Upload  func(key *publicKey, name string) (string, error)
+}
+
+// keyBackends are registered by the files implementing them.
+var keyBackends = map[string]keyBackend{}
+
+func enabledBackends() []string {
+	var names []string
+	for name, backend := range keyBackends {
+		if backend.Enabled() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keyName is the name the key is registered under: -key-name, the key
+// comment or a name derived from the local host name.
+func keyName(key *publicKey) string {
+	if pCommandLineArgs.KeyName != "" {
+		return pCommandLineArgs.KeyName
+	}
+	if key.Comment != "" {
+		return key.Comment
+	}
+	hostName, _ := os.Hostname()
+	return "ssh-copy-id@" + hostName
+}
+
+// uploadToBackends registers the key with every backend and returns the
+// number of backends that failed.
+func uploadToBackends(names []string) int {
+	options, key, err := parseAuthorizedKey(pCommandLineArgs.KeyData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing public key: %v\n", err)
+		return len(names)
+	}
+	if options != "" {
+		fmt.Fprintf(os.Stderr, "warning: key backends take bare keys, the options %s are not uploaded\n", options)
+	}
+	failed := 0
+	for _, name := range names {
+		info, err := keyBackends[name].Upload(key, keyName(key))
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: Error uploading key.Reason: %v\n", name, err)
+			continue
+		}
+		if !pCommandLineArgs.Quiet {
+			fmt.Printf("%s: %s %s\n", name, key.Fingerprint(), info)
+		}
+	}
+	return failed
+}
+
+// writeTempKeyFile writes the key to a temporary file for command line
+// clients that only read keys from files. cleanup removes it again.
+func writeTempKeyFile(key *publicKey) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "ssh-copy-id")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	keyFile := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(keyFile, []byte(key.String()+"\n"), 0600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return keyFile, cleanup, nil
+}
+
+// runCLI runs a provider command line client and returns its trimmed output.
+func runCLI(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v %s", name, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// callJSONAPI sends in as JSON body, when set, and decodes the response into
+// out, when set.
+func callJSONAPI(method, url string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{Status: resp.StatusCode, Body: strings.TrimSpace(string(buf))}
+	}
+	if out == nil || len(buf) == 0 {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// envToken returns the first of the environment variables that is set.
+func envToken(names ...string) (string, error) {
+	for _, name := range names {
+		if token := os.Getenv(name); token != "" {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("no API token, set %s", names[0])
+}
+
+func bearerHeader(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
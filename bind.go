@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// sourceIP returns the local address connections to target are bound to,
+// nil for any: -bind-address or an address of -bind-interface, otherwise
+// BindAddress or BindInterface of the ssh configuration. An interface
+// address of the family of remote is preferred, IPv4 for host names.
+func sourceIP(target, remote string) (net.IP, error) {
+	config := resolveSSHConfig(target)
+	address, iface := pCommandLineArgs.BindAddress, pCommandLineArgs.BindInterface
+	if address == "" && iface == "" {
+		address, iface = config.Get("BindAddress"), config.Get("BindInterface")
+	}
+	if address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address %q", address)
+		}
+		return ip, nil
+	}
+	if iface == "" {
+		return nil, nil
+	}
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("bind interface %s: %v", iface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("bind interface %s: %v", iface, err)
+	}
+	remoteAddress, _, _ := strings.Cut(remote, "%")
+	wantIPv4 := true
+	if ip := net.ParseIP(remoteAddress); ip != nil {
+		wantIPv4 = ip.To4() != nil
+	}
+	var fallback net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) == wantIPv4 {
+			return ipNet.IP, nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("bind interface %s has no address", iface)
+	}
+	return fallback, nil
+}
+
+// bindDialer returns a dialer for network, tcp or udp, binding the
+// connections to target at remote like ssh would.
+func bindDialer(network, target, remote string) (*net.Dialer, error) {
+	ip, err := sourceIP(target, remote)
+	if err != nil || ip == nil {
+		return &net.Dialer{}, err
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.Dialer{LocalAddr: &net.UDPAddr{IP: ip}}, nil
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}, nil
+}
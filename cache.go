@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// hostCache remembers the keys known to be installed on each host, so
+	// repeated runs can skip compliant hosts without connecting. An entry is
+	// trusted for TTL and as long as the host key in known_hosts, its
+	// validator, is unchanged: a reinstalled host gets a new host key and
+	// likely lost its authorized_keys.
+	hostCache struct {
+		mu    sync.Mutex
+		path  string
+		TTL   time.Duration         `json:"-"`
+		Hosts map[string]cacheEntry `json:"hosts"`
+	}
+
+	cacheEntry struct {
+		Fingerprints []string  `json:"fingerprints"`
+		HostKeyTag   string    `json:"host_key_tag"`
+		Checked      time.Time `json:"checked"`
+	}
+)
+
+func defaultCachePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ssh-copy-id", "hosts.json")
+}
+
+func loadHostCache(path string, ttl time.Duration) (*hostCache, error) {
+	c := &hostCache{path: path, TTL: ttl, Hosts: map[string]cacheEntry{}}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, c); err != nil {
+		return nil, fmt.Errorf("invalid cache file %s: %v", path, err)
+	}
+	if c.Hosts == nil {
+		c.Hosts = map[string]cacheEntry{}
+	}
+	return c, nil
+}
+
+// hostKeyTag identifies the known_hosts keys of a target, empty when none
+// are known.
+func hostKeyTag(target string) string {
+	keys := knownHostKeys(defaultKnownHostsFile(), knownHostName(target))
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	sum := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintln(sum, key)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// cacheKey is the [user@]hostname of target, with the port when it is not
+// 22 as in known_hosts, followed by the -users or key file of this run
+// when they are not the login user's ~/.ssh/authorized_keys.
+func cacheKey(target string) string {
+	key := cacheHost(target)
+	switch t := runTarget(target); {
+	case t.Users != nil:
+		key += " users=" + strings.Join(t.Users, ",")
+	case t.File != "":
+		key += " " + t.File
+	}
+	return key
+}
+
+// cacheHost is the [user@]hostname part of the cacheKey of target.
+func cacheHost(target string) string {
+	if user, _ := splitUserHost(target); user != "" {
+		return user + "@" + knownHostName(target)
+	}
+	return knownHostName(target)
+}
+
+// Compliant reports whether target is known to have all fingerprints
+// installed.
+func (c *hostCache) Compliant(target string, fingerprints []string) bool {
+	c.mu.Lock()
+	entry, ok := c.Hosts[cacheKey(target)]
+	c.mu.Unlock()
+	if !ok || time.Since(entry.Checked) > c.TTL || entry.HostKeyTag == "" || entry.HostKeyTag != hostKeyTag(target) {
+		return false
+	}
+	installed := map[string]bool{}
+	for _, fingerprint := range entry.Fingerprints {
+		installed[fingerprint] = true
+	}
+	for _, fingerprint := range fingerprints {
+		if !installed[fingerprint] {
+			return false
+		}
+	}
+	return true
+}
+
+// Record adds the fingerprints to the entries of the hosts where they were
+// installed or found.
+func (c *hostCache) Record(fingerprints []string, results []hostResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range results {
+		if r.Status != statusInstalled && r.Status != statusExists {
+			continue
+		}
+		key, tag := cacheKey(r.Host), hostKeyTag(r.Host)
+		entry := c.Hosts[key]
+		if entry.HostKeyTag != tag {
+			entry.Fingerprints = nil
+		}
+		seen := map[string]bool{}
+		for _, fingerprint := range entry.Fingerprints {
+			seen[fingerprint] = true
+		}
+		for _, fingerprint := range fingerprints {
+			if !seen[fingerprint] {
+				entry.Fingerprints = append(entry.Fingerprints, fingerprint)
+			}
+		}
+		entry.HostKeyTag, entry.Checked = tag, time.Now().UTC()
+		c.Hosts[key] = entry
+	}
+	return c.save()
+}
+
+func (c *hostCache) save() error {
+	buf, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, buf, 0600)
+}
+
+// Forget drops the fingerprints from the entries of the hosts they were
+// removed from or found missing on, whichever files the entries are for.
+func (c *hostCache) Forget(fingerprints []string, results []hostResult) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := map[string]bool{}
+	for _, r := range results {
+		if r.Status == statusInstalled || r.Status == statusRemoved || r.Status == statusNotFound {
+			removed[cacheHost(r.Host)] = true
+		}
+	}
+	drop := map[string]bool{}
+	for _, fingerprint := range fingerprints {
+		drop[fingerprint] = true
+	}
+	changed := false
+	for key, entry := range c.Hosts {
+		host, _, _ := strings.Cut(key, " ")
+		if !removed[host] {
+			continue
+		}
+		var kept []string
+		for _, fingerprint := range entry.Fingerprints {
+			if !drop[fingerprint] {
+				kept = append(kept, fingerprint)
+			}
+		}
+		if len(kept) != len(entry.Fingerprints) {
+			entry.Fingerprints, changed = kept, true
+			c.Hosts[key] = entry
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return c.save()
+}
+
+// forgetMu serializes the updates of forgetRemovedKeys, which the hosts of
+// a rotation make concurrently.
+var forgetMu sync.Mutex
+
+// forgetRemovedKeys drops removed keys from the -cache file, or the default
+// one, so a later -cache run does not skip the hosts as compliant.
+func forgetRemovedKeys(fingerprints []string, results []hostResult) {
+	forgetMu.Lock()
+	defer forgetMu.Unlock()
+	path := pCommandLineArgs.Cache.Value
+	if path == "" {
+		path = defaultCachePath()
+	}
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	cache, err := loadHostCache(path, pCommandLineArgs.CacheTTL)
+	if err == nil {
+		err = cache.Forget(fingerprints, results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating cache: %v\n", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSweepHosts bounds the size of a CIDR sweep.
+const maxSweepHosts = 65536
+
+// hostsInCIDR lists the addresses of a network, without the network and
+// broadcast addresses of IPv4 networks larger than /31.
+func hostsInCIDR(cidr string) ([]string, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("%s has more than %d addresses", cidr, maxSweepHosts)
+	}
+	var hosts []string
+	for addr := ip.Mask(network.Mask); network.Contains(addr); addr = nextIP(addr) {
+		hosts = append(hosts, addr.String())
+	}
+	if ip.To4() != nil && bits-ones > 1 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// probeSSH returns the hosts accepting TCP connections on port.
+func probeSSH(hosts []string, port int, timeout time.Duration) []string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var found []string
+	sem := make(chan struct{}, 64)
+	for _, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			dialer, err := bindDialer("tcp", host, host)
+			if err != nil {
+				return
+			}
+			dialer.Timeout = timeout
+			conn, err := dialer.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				return
+			}
+			conn.Close()
+			mu.Lock()
+			found = append(found, host)
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	sort.Slice(found, func(i, j int) bool {
+		return string(net.ParseIP(found[i]).To16()) < string(net.ParseIP(found[j]).To16())
+	})
+	return found
+}
+
+// hostKeyFingerprints asks the host for its host keys using ssh-keyscan.
+func hostKeyFingerprints(host string, port int) []string {
+	out, err := exec.Command("ssh-keyscan", "-T", "5", "-p", strconv.Itoa(port), host).Output()
+	if err != nil {
+		return nil
+	}
+	var fingerprints []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if key, err := parsePublicKey(strings.Join(fields[1:], " ")); err == nil {
+			fingerprints = append(fingerprints, key.Type+" "+key.Fingerprint())
+		}
+	}
+	return fingerprints
+}
+
+// sweepCIDR discovers the SSH servers of a network and asks for
+// confirmation before they are used as targets.
+func sweepCIDR(cidr string, port int) ([]string, error) {
+	candidates, err := hostsInCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Probing %d addresses of %s on port %d\n", len(candidates), cidr, port)
+	found := probeSSH(candidates, port, 2*time.Second)
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no SSH servers found in %s", cidr)
+	}
+	for _, host := range found {
+		fmt.Fprintf(os.Stderr, "  %s\n", host)
+		for _, fingerprint := range hostKeyFingerprints(host, port) {
+			fmt.Fprintf(os.Stderr, "\t%s\n", fingerprint)
+		}
+	}
+	if !confirm(fmt.Sprintf("Install the key on these %d hosts?", len(found))) {
+		return nil, fmt.Errorf("aborted")
+	}
+	return found, nil
+}
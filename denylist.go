@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// debianBlacklistGlobs are where the openssh-blacklist packages install the
+// fingerprints of the keys generated by the broken Debian OpenSSL of
+// 2006-2008 (CVE-2008-0166).
+var debianBlacklistGlobs = []string{"/usr/share/ssh/blacklist.*", "/etc/ssh/blacklist.*"}
+
+// denylist holds fingerprints of keys that must not be installed.
+type denylist struct {
+	fingerprints map[string]string
+	// debian holds the last 20 hex digits of the MD5 fingerprints of the
+	// Debian blacklist files.
+	debian map[string]string
+}
+
+// debianWeakKeyTypes are the key types CVE-2008-0166 produced weak keys of.
+var debianWeakKeyTypes = map[string]bool{"ssh-rsa": true, "ssh-dss": true}
+
+// readFingerprintList reads a list of keys: SHA256: or MD5 fingerprints or
+// public key lines, one per line. MD5 fingerprints are returned without
+// their MD5: prefix.
+func readFingerprintList(fileName string) ([]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var fingerprints []string
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "SHA256:"), strings.HasPrefix(line, "MD5:"):
+			fingerprints = append(fingerprints, strings.TrimPrefix(strings.Fields(line)[0], "MD5:"))
+		case strings.Count(line, ":") == 15 && len(line) == 47:
+			fingerprints = append(fingerprints, line)
+		default:
+			_, key, err := parseAuthorizedKey(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fileName, lineNo, err)
+			}
+			fingerprints = append(fingerprints, key.Fingerprint())
+		}
+	}
+	return fingerprints, scanner.Err()
+}
+
+// readDenylistFile adds the entries of a user denylist.
+func (d *denylist) readDenylistFile(fileName string) error {
+	fingerprints, err := readFingerprintList(fileName)
+	if err != nil {
+		return err
+	}
+	for _, fingerprint := range fingerprints {
+		d.fingerprints[fingerprint] = fileName
+	}
+	return nil
+}
+
+func (d *denylist) readDebianBlacklist(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) == 20 {
+			d.debian[line] = fileName
+		}
+	}
+	return scanner.Err()
+}
+
+// loadDenylist reads the installed Debian blacklists and the user denylist
+// files.
+func loadDenylist(files []string) (*denylist, error) {
+	d := &denylist{fingerprints: map[string]string{}, debian: map[string]string{}}
+	for _, glob := range debianBlacklistGlobs {
+		matches, _ := filepath.Glob(glob)
+		for _, match := range matches {
+			if err := d.readDebianBlacklist(match); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, file := range files {
+		if err := d.readDenylistFile(file); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Check returns an error naming the list that contains key. Current
+// distributions no longer ship the Debian blacklists, so an RSA or DSA key
+// that could not be checked against one gets a warning.
+func (d *denylist) Check(key *publicKey) error {
+	md5 := key.FingerprintMD5()
+	for _, fingerprint := range []string{key.Fingerprint(), md5} {
+		if source, ok := d.fingerprints[fingerprint]; ok {
+			return fmt.Errorf("key %s is listed as compromised in %s", key.Fingerprint(), source)
+		}
+	}
+	if source, ok := d.debian[strings.ReplaceAll(md5, ":", "")[12:]]; ok {
+		return fmt.Errorf("key %s is a Debian weak key (CVE-2008-0166), listed in %s", key.Fingerprint(), source)
+	}
+	if len(d.debian) == 0 && debianWeakKeyTypes[key.Type] && !pCommandLineArgs.Quiet {
+		fmt.Fprintf(os.Stderr, "warning: no Debian weak key blacklist found in %s, key %s is not checked for CVE-2008-0166\n",
+			strings.Join(debianBlacklistGlobs, " or "), key.Fingerprint())
+	}
+	return nil
+}
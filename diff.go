@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const diffContext = 3
+
+// useColor resolves a -color value of auto, always or never. Auto colors
+// when stdout is a terminal and NO_COLOR is not set.
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "", nil
+	}
+	return false, fmt.Errorf("invalid -color %q, use auto, always or never", mode)
+}
+
+// contentLines splits file content into lines without the final newline.
+func contentLines(content []byte) []string {
+	s := strings.TrimSuffix(string(content), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// unifiedDiff returns the changes from a to b in unified diff format with
+// name in both headers, or "" when they are equal.
+func unifiedDiff(name string, a, b []string, color bool) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	type op struct {
+		kind byte
+		line string
+		ai   int
+		bi   int
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, op{' ', a[i], i, j})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	paint := func(code, s string) string {
+		if !color {
+			return s
+		}
+		return "\033[" + code + "m" + s + "\033[0m"
+	}
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk while the next change is within twice the
+		// context of the previous one.
+		from := start - diffContext
+		if from < 0 {
+			from = 0
+		}
+		end := start
+		for k := start; k < len(ops) && k-end <= 2*diffContext+1; k++ {
+			if ops[k].kind != ' ' {
+				end = k
+			}
+		}
+		to := end + diffContext + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if out.Len() == 0 {
+			out.WriteString(paint("1", "--- "+name) + "\n" + paint("1", "+++ "+name) + "\n")
+		}
+		aLen, bLen := 0, 0
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				aLen++
+			}
+			if o.kind != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := ops[from].ai+1, ops[from].bi+1
+		if aLen == 0 {
+			aStart--
+		}
+		if bLen == 0 {
+			bStart--
+		}
+		out.WriteString(paint("36", fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen)) + "\n")
+		for _, o := range ops[from:to] {
+			switch o.kind {
+			case '-':
+				out.WriteString(paint("31", "-"+o.line) + "\n")
+			case '+':
+				out.WriteString(paint("32", "+"+o.line) + "\n")
+			default:
+				out.WriteString(" " + o.line + "\n")
+			}
+		}
+		start = to
+	}
+	return out.String()
+}
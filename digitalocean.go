@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var digitalOceanAPI = "https://api.digitalocean.com/v2"
+
+type digitalOceanKey struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"public_key"`
+}
+
+// digitalOceanUpload registers the key with the DigitalOcean account. A key
+// that is already registered is looked up by its fingerprint.
+func digitalOceanUpload(key *publicKey, name string) (string, error) {
+	token, err := envToken("DIGITALOCEAN_TOKEN", "DIGITALOCEAN_ACCESS_TOKEN")
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		SSHKey digitalOceanKey `json:"ssh_key"`
+	}
+	req := digitalOceanKey{Name: name, PublicKey: key.String()}
+	err = callJSONAPI(http.MethodPost, digitalOceanAPI+"/account/keys", bearerHeader(token), req, &resp)
+	if apiErr, ok := err.(*apiError); ok && apiErr.Status == http.StatusUnprocessableEntity {
+		if err := callJSONAPI(http.MethodGet, digitalOceanAPI+"/account/keys/"+key.FingerprintMD5(), bearerHeader(token), nil, &resp); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("already registered as %q (ID %d, fingerprint %s)", resp.SSHKey.Name, resp.SSHKey.ID, resp.SSHKey.Fingerprint), nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("registered as %q (ID %d, fingerprint %s)", resp.SSHKey.Name, resp.SSHKey.ID, resp.SSHKey.Fingerprint), nil
+}
+
+func init() {
+	keyBackends["digitalocean"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.DigitalOcean },
+		Upload:  digitalOceanUpload,
+	}
+}
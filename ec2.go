@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// awsCLI runs the aws command line client and returns its trimmed output.
+func awsCLI(args ...string) (string, error) {
+	if pCommandLineArgs.Region != "" {
+		args = append(args, "--region", pCommandLineArgs.Region)
+	}
+	return runCLI("aws", args...)
+}
+
+// ec2InstanceAddress returns the public DNS name of an instance, or its
+// private address when it has none.
+func ec2InstanceAddress(instanceID string) (string, error) {
+	for _, query := range []string{"PublicDnsName", "PrivateIpAddress"} {
+		address, err := awsCLI("ec2", "describe-instances", "--instance-ids", instanceID,
+			"--query", "Reservations[0].Instances[0]."+query, "--output", "text")
+		if err != nil {
+			return "", err
+		}
+		if address != "" && address != "None" {
+			return address, nil
+		}
+	}
+	return "", fmt.Errorf("instance %s has no address", instanceID)
+}
+
+// ec2InstanceConnect pushes the key with EC2 Instance Connect, which
+// accepts it for 60 seconds. With -ec2-permanent the instance is returned
+// as target, so the normal copy makes the key permanent while the pushed
+// key can still be used to log in.
+func ec2InstanceConnect() ([]string, error) {
+	instanceID, osUser := pCommandLineArgs.EC2InstanceConnect, pCommandLineArgs.EC2User
+	// Instance Connect rejects authorized_keys options.
+	_, key, err := parseAuthorizedKey(pCommandLineArgs.KeyData)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := awsCLI("ec2-instance-connect", "send-ssh-public-key", "--instance-id", instanceID,
+		"--instance-os-user", osUser, "--ssh-public-key", key.String()); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Pushed key to %s for user %s, valid for 60 seconds\n", instanceID, osUser)
+	if !pCommandLineArgs.EC2Permanent {
+		return nil, nil
+	}
+	hosts := pCommandLineArgs.Hosts
+	if len(hosts) == 0 {
+		address, err := ec2InstanceAddress(instanceID)
+		if err != nil {
+			return nil, err
+		}
+		hosts = []string{osUser + "@" + address}
+	}
+	for _, host := range hosts {
+		config := pCommandLineArgs.Targets[host]
+		config.IdentityFile = pCommandLineArgs.IdentityFile
+		pCommandLineArgs.Targets[host] = config
+	}
+	return hosts, nil
+}
+
+// ec2ImportKeyPair registers the key as EC2 key pair, so new instances can
+// be launched with it.
+func ec2ImportKeyPair(key *publicKey, name string) (string, error) {
+	keyFile, cleanup, err := writeTempKeyFile(key)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	id, err := awsCLI("ec2", "import-key-pair", "--key-name", name, "--public-key-material", "fileb://"+keyFile,
+		"--query", "KeyPairId", "--output", "text")
+	if err != nil {
+		if strings.Contains(err.Error(), "InvalidKeyPair.Duplicate") {
+			return "", fmt.Errorf("a key pair named %s already exists", name)
+		}
+		return "", err
+	}
+	return fmt.Sprintf("imported as key pair %s (%s)", name, id), nil
+}
+
+func init() {
+	keyBackends["ec2"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.EC2ImportKeyPair },
+		Upload:  ec2ImportKeyPair,
+	}
+}
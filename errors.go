@@ -0,0 +1,51 @@
+package main
+
+import "errors"
+
+// Sentinel errors a host result's Err wraps when the cause of a failure is
+// known, to be matched with errors.Is instead of the message.
+var (
+	ErrKeyExists         = errors.New("key already present")
+	ErrAuthFailed        = errors.New("authentication failed")
+	ErrHostUnreachable   = errors.New("host unreachable")
+	ErrRemoteWriteDenied = errors.New("authorized_keys not writable")
+)
+
+// errorReasons names the sentinel errors in the reason of host results.
+var errorReasons = map[error]string{
+	ErrKeyExists:         "key-exists",
+	ErrAuthFailed:        "auth-failed",
+	ErrHostUnreachable:   "host-unreachable",
+	ErrRemoteWriteDenied: "remote-write-denied",
+}
+
+// kindError is an error with its own message that is one of the sentinel
+// errors.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// withKind returns an error with the message of err that matches kind.
+func withKind(kind error, err error) error {
+	return &kindError{kind: kind, msg: err.Error()}
+}
+
+// errorReason returns the reason name of the sentinel error err matches,
+// or "".
+func errorReason(err error) string {
+	for sentinel, reason := range errorReasons {
+		if errors.Is(err, sentinel) {
+			return reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// event is one line of the -events stream.
+	event struct {
+		Time     time.Time      `json:"time"`
+		Event    string         `json:"event"`
+		Host     string         `json:"host,omitempty"`
+		Status   string         `json:"status,omitempty"`
+		OK       *bool          `json:"ok,omitempty"`
+		ExitCode int            `json:"exit_code,omitempty"`
+		Error    string         `json:"error,omitempty"`
+		Reason   string         `json:"reason,omitempty"`
+		Counts   map[string]int `json:"counts,omitempty"`
+	}
+
+	// eventStream writes newline-delimited JSON events as they happen. A nil
+	// eventStream discards them.
+	eventStream struct {
+		mu  sync.Mutex
+		enc *json.Encoder
+	}
+)
+
+// events is the -events stream of the run.
+var events *eventStream
+
+func openEventStream(fileName string) (*eventStream, error) {
+	var w io.Writer = os.Stdout
+	if fileName != "-" {
+		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	return &eventStream{enc: json.NewEncoder(w)}, nil
+}
+
+func (s *eventStream) emit(e event) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.Time = time.Now().UTC()
+	s.enc.Encode(e)
+}
+
+// Connect records that host is being contacted.
+func (s *eventStream) Connect(host string) {
+	s.emit(event{Event: "connect", Host: host})
+}
+
+// Install records the outcome of a host, preceded by whether the ssh login
+// succeeded. ssh exits with 255 on connection errors, which fail before
+// authentication.
+func (s *eventStream) Install(r hostResult) {
+	if pCommandLineArgs.Transport == "ssh" && (r.ExitCode != 255 || r.AuthFailure) {
+		ok := !r.AuthFailure
+		s.emit(event{Event: "auth", Host: r.Host, OK: &ok})
+	}
+	s.emit(event{Event: "install", Host: r.Host, Status: r.Status, ExitCode: r.ExitCode, Error: r.Error, Reason: r.Reason})
+}
+
+// Verify records whether a login with the installed key worked.
+func (s *eventStream) Verify(host string, err error) {
+	e := event{Event: "verify", Host: host}
+	ok := err == nil
+	e.OK = &ok
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.emit(e)
+}
+
+// Done records the end of the run with the number of hosts per status.
+func (s *eventStream) Done(results []hostResult) {
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	s.emit(event{Event: "done", Counts: counts})
+}
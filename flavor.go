@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// serverFlavors maps a -server-flavor name to the function building the
+// remote command that installs keyData for user on that kind of server.
+var serverFlavors = map[string]func(user, keyData string, force bool) string{
+	"openssh": func(user, keyData string, force bool) string {
+		return installCommand(keyData, force)
+	},
+	// auto runs the openssh command adapted to the login shell of each host
+	// by a shellRunner.
+	"auto": func(user, keyData string, force bool) string {
+		return installCommand(keyData, force)
+	},
+	"windows": windowsInstallCommand,
+	// ESXi keeps the keys outside of the home directories and its shell
+	// lacks most of what a POSIX sh offers, so only plain tests, the printf
+	// builtin and redirections are used.
+	"esxi": func(user, keyData string, force bool) string {
+		file := flavorKeyFile("esxi", user)
+		dir := shellQuote(path.Dir(file))
+		file = shellQuote(file)
+		append := fmt.Sprintf("%s; chmod 600 %s", appendLineCommand(keyData, file), file)
+		if force {
+			return fmt.Sprintf("[ -d %s ] || mkdir %s; %s", dir, dir, append)
+		}
+		return fmt.Sprintf("[ -d %s ] || mkdir %s; if %s 2>/dev/null; then exit 201; fi; %s", dir, dir, keyPresentCommand(keyData, file), append)
+	},
+	"synology": func(user, keyData string, force bool) string {
+		return nasInstallCommand(nasHomes["synology"], user, keyData, force)
+	},
+	"qnap": func(user, keyData string, force bool) string {
+		return nasInstallCommand(nasHomes["qnap"], user, keyData, force)
+	},
+	// RouterOS has no authorized_keys, keys are imported from an uploaded
+	// file, which the import removes again. Importing a key twice is
+	// harmless, so there is no existence check.
+	"routeros": func(user, keyData string, force bool) string {
+		return fmt.Sprintf("/user ssh-keys import public-key-file=%s user=%s", keyUploadFlavors["routeros"], user)
+	},
+	// Junos takes the key as configuration of the login user. The
+	// statements are sent to the CLI one per line; setting a key that is
+	// already configured leaves nothing to commit.
+	"junos": func(user, keyData string, force bool) string {
+		_, key, err := parseAuthorizedKey(keyData)
+		if err != nil {
+			return flavorKeyError(err)
+		}
+		return strings.Join([]string{
+			"configure private",
+			fmt.Sprintf("set system login user %s authentication %s %s", user, junosKeyType(key.Type), junosString(key.String())),
+			"commit and-quit",
+		}, "\n")
+	},
+	// IOS-XE reads the base64 key data after key-string in lines of limited
+	// length, terminated by exit.
+	"ios-xe": func(user, keyData string, force bool) string {
+		_, key, err := parseAuthorizedKey(keyData)
+		if err != nil {
+			return flavorKeyError(err)
+		}
+		lines := []string{"configure terminal", "ip ssh pubkey-chain", "username " + user, "key-string"}
+		lines = append(lines, chunkString(base64.StdEncoding.EncodeToString(key.Blob), 80)...)
+		return strings.Join(append(lines, "exit", "exit", "exit", "end", "write memory"), "\n")
+	},
+	"busybox": busyBoxInstallCommand,
+}
+
+// busyBoxInstallCommand installs the key using only shell builtins, printf
+// among them, mkdir and chmod, which every BusyBox build has, instead of grep
+// and touch. The missing applets are reported before anything is changed.
+func busyBoxInstallCommand(user, keyData string, force bool) string {
+	check := "for c in mkdir chmod; do command -v $c >/dev/null 2>&1 || { echo \"missing command $c\" >&2; exit 1; }; done; "
+	prepare := "[ -d ~/.ssh ] || mkdir ~/.ssh; chmod 700 ~/.ssh; f=~/.ssh/authorized_keys; "
+	exists := ""
+	if !force {
+		exists = fmt.Sprintf("if [ -f $f ]; then while IFS= read -r l || [ -n \"$l\" ]; do [ \"$l\" = %s ] && exit 201; done < $f; fi; ", shellQuote(keyData))
+		if _, key, err := parseAuthorizedKey(keyData); err == nil {
+			// Compare the blob with every field like keyPresentCommand,
+			// with globbing off for the options.
+			exists = fmt.Sprintf("if [ -f $f ]; then set -f; while IFS= read -r l || [ -n \"$l\" ]; do for w in $l; do [ \"$w\" = %s ] && exit 201; done; done < $f; set +f; fi; ", base64.StdEncoding.EncodeToString(key.Blob))
+		}
+	}
+	return check + prepare + exists + appendLineCommand(keyData, "$f") + "; chmod 600 $f"
+}
+
+// chunkString splits s into pieces of at most n bytes.
+func chunkString(s string, n int) []string {
+	var chunks []string
+	for len(s) > n {
+		chunks = append(chunks, s[:n])
+		s = s[n:]
+	}
+	return append(chunks, s)
+}
+
+// junosKeyType returns the Junos authentication statement for the key type.
+func junosKeyType(keyType string) string {
+	if strings.HasPrefix(keyType, "ecdsa-sha2-") {
+		return "ssh-ecdsa"
+	}
+	return keyType
+}
+
+// junosString quotes s as a Junos configuration string, on one line.
+func junosString(s string) string {
+	s = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+	return "\"" + s + "\""
+}
+
+// checkFlavorKey checks that keyData can be installed by flavor: the flavors
+// validateHardened refuses options for take no options of the key either.
+func checkFlavorKey(flavor, keyData string) error {
+	if !nonShellFlavors[flavor] || flavor == "windows" {
+		return nil
+	}
+	options, _, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return err
+	}
+	if options != "" {
+		return fmt.Errorf("server flavor %s does not support authorized_keys options, the key has %s", flavor, options)
+	}
+	return nil
+}
+
+// flavorKeyError returns a command failing with err, for a key the flavor
+// cannot install.
+func flavorKeyError(err error) string {
+	return fmt.Sprintf("echo %s >&2; exit 1", shellQuote(err.Error()))
+}
+
+// keyUploadFlavors maps the flavors that import the key from a file to the
+// remote name the key is uploaded to with sftp before the install command.
+var keyUploadFlavors = map[string]string{
+	"routeros": "ssh-copy-id.pub",
+}
+
+// uploadRunner uploads the key file to every host before running the
+// command there.
+type uploadRunner struct {
+	*sshRunner
+	Local  string
+	Remote string
+}
+
+func (r *uploadRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	if result, err := r.Upload(ctx, host, r.Local, r.Remote); err != nil {
+		return result, fmt.Errorf("uploading the key failed: %v", err)
+	}
+	return r.sshRunner.Run(ctx, host, command)
+}
+
+// newFlavorRunner wraps runner for the flavors that probe the host or upload
+// the key first.
+// The returned cleanup function removes the local key file.
+func newFlavorRunner(runner Runner, keyData string) (Runner, func(), error) {
+	if pCommandLineArgs.ServerFlavor == "auto" && pCommandLineArgs.Transport == "ssh" {
+		return &shellRunner{Runner: runner, KeyData: keyData, Force: pCommandLineArgs.ForceMode}, func() {}, nil
+	}
+	remote, ok := keyUploadFlavors[pCommandLineArgs.ServerFlavor]
+	if !ok {
+		return runner, func() {}, nil
+	}
+	_, key, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return nil, nil, err
+	}
+	local, cleanup, err := writeTempKeyFile(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &uploadRunner{sshRunner: runner.(*sshRunner), Local: local, Remote: remote}, cleanup, nil
+}
+
+// nasHomes are the directories holding the homes of the NAS flavors.
+var nasHomes = map[string]string{
+	"synology": "/var/services/homes",
+	"qnap":     "/share/homes",
+}
+
+// flavorKeyFile returns the authorized_keys file flavor installs the keys of
+// user in, "" for ~/.ssh/authorized_keys of the login user.
+func flavorKeyFile(flavor, user string) string {
+	if flavor == "esxi" {
+		return "/etc/ssh/keys-" + user + "/authorized_keys"
+	}
+	if homes, ok := nasHomes[flavor]; ok {
+		return homes + "/" + user + "/.ssh/authorized_keys"
+	}
+	return ""
+}
+
+// nasInstallCommand installs the key in the home of user below homes. The
+// NAS sshd ignores keys when the home or ~/.ssh is writable by others, which
+// the default ACLs of these systems often allow, and the homes only exist
+// once the user home service is enabled.
+func nasInstallCommand(homes, user, keyData string, force bool) string {
+	home := homes + "/" + user
+	file := home + "/.ssh/authorized_keys"
+	check := fmt.Sprintf("if [ ! -d %s ]; then echo 'user home service is not enabled, no %s' >&2; exit 1; fi; mkdir -p %s/.ssh; chmod go-w %s; chmod 700 %s/.ssh; ", home, home, home, home, home)
+	append := fmt.Sprintf("%s; chmod 600 %s; chown -R %s %s/.ssh", appendLineCommand(keyData, file), file, user, home)
+	if force {
+		return check + append
+	}
+	return check + fmt.Sprintf("if %s 2>/dev/null; then exit 201; fi; %s", keyPresentCommand(keyData, file), append)
+}
+
+func flavorNames() string {
+	names := make([]string, 0, len(serverFlavors))
+	for name := range serverFlavors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func validateFlavor(name string) error {
+	if _, ok := serverFlavors[name]; !ok {
+		return fmt.Errorf("unknown server flavor %q, use one of %s", name, flavorNames())
+	}
+	if _, ok := keyUploadFlavors[name]; ok && pCommandLineArgs.Transport != "ssh" {
+		return fmt.Errorf("server flavor %s requires the ssh transport", name)
+	}
+	return nil
+}
+
+// flavorInstallCommand returns the install command of the selected flavor for
+// a [user@]hostname target, defaulting to the local user like ssh does.
+func flavorInstallCommand(target, keyData string, force bool) string {
+	user, _ := splitUserHost(target)
+	if user == "" {
+		user = currentActor()
+	}
+	if pCommandLineArgs.remoteTemplate != nil {
+		command, err := templateInstallCommand(pCommandLineArgs.remoteTemplate, target, keyData, force)
+		if err != nil {
+			return fmt.Sprintf("echo %s >&2; exit 1", shellQuote(err.Error()))
+		}
+		return command
+	}
+	if pCommandLineArgs.Users != "" {
+		return usersInstallCommand(keyData, force)
+	}
+	return serverFlavors[pCommandLineArgs.ServerFlavor](user, keyData, force)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statusInstalled = "installed"
+	statusExists    = "exists"
+	statusFailed    = "failed"
+	statusSkipped   = "skipped"
+	statusRemoved   = "removed"
+	statusNotFound  = "not-found"
+	statusAborted   = "aborted"
+
+	// exitKeyExists is returned by the remote install command when the key
+	// is already present in authorized_keys.
+	exitKeyExists = 201
+	// exitKeyNotFound is returned by the remote remove command when the
+	// key is not present in authorized_keys.
+	exitKeyNotFound = 202
+	// exitNoSpace is returned by the remote install command when the file
+	// system of the home directory is full or the user is over quota.
+	exitNoSpace = 203
+)
+
+type (
+	hostResult struct {
+		Host        string `json:"host"`
+		Status      string `json:"status"`
+		ExitCode    int    `json:"exit_code"`
+		Error       string `json:"error,omitempty"`
+		Output      []byte `json:"-"`
+		AuthFailure bool   `json:"auth_failure,omitempty"`
+		// Reason names the sentinel error of err, e.g. auth-failed.
+		Reason  string  `json:"reason,omitempty"`
+		Seconds float64 `json:"seconds"`
+		err     error
+	}
+
+	// fleet runs the same remote command on many hosts, at most Parallel
+	// at a time. Hosts for which Skip returns true are not contacted.
+	// OnStart and OnResult, when set, are called when a host is started and
+	// as soon as it is done, OnPass for the hosts that are skipped or aborted
+	// instead. Results are counted in Metrics when set.
+	//
+	// Once MaxFailures hosts, or more than MaxFailurePct percent of all
+	// hosts, have failed no further hosts are started; hosts already running
+	// are completed. Zero disables the respective limit.
+	//
+	// Interval is the minimum time between starting two hosts.
+	//
+	// Input, when set, returns the input fed to the command of a host, nil
+	// for none, which needs a Runner that is an inputRunner.
+	fleet struct {
+		Runner        Runner
+		Parallel      int
+		Metrics       *fleetMetrics
+		Skip          func(host string) bool
+		OnResult      func(r hostResult)
+		OnStart       func(host string)
+		OnPass        func(r hostResult)
+		MaxFailures   int
+		MaxFailurePct float64
+		Interval      time.Duration
+		Input         func(host string) []byte
+	}
+)
+
+func (f *fleet) run(ctx context.Context, host string, command string) (Result, error) {
+	if f.Input != nil {
+		if input := f.Input(host); input != nil {
+			if r, ok := f.Runner.(inputRunner); ok {
+				return r.RunInput(ctx, host, command, input)
+			}
+			return Result{ExitCode: 1}, fmt.Errorf("the transport cannot pass input to the remote command")
+		}
+	}
+	return f.Runner.Run(ctx, host, command)
+}
+
+func (f *fleet) runHost(ctx context.Context, host string, command string) hostResult {
+	start := time.Now()
+	result, err := f.run(ctx, host, command)
+	hr := hostResult{Host: host, Status: statusInstalled, ExitCode: result.ExitCode, Output: result.Stdout}
+	switch {
+	case result.ExitCode == exitKeyExists:
+		hr.Status = statusExists
+		hr.err = ErrKeyExists
+	case result.ExitCode == exitKeyNotFound:
+		hr.Status = statusNotFound
+	case err != nil:
+		hr.Status = statusFailed
+		hr.Error = err.Error()
+		hr.AuthFailure = isAuthFailure(result.Stderr)
+		var kind error
+		switch result.ExitCode {
+		case exitNoSpace:
+			hr.Error = "no space left on the file system of ~/.ssh or over quota"
+		case exitPreCmdFailed:
+			hr.Error = "the pre-cmd hook failed, the key was not installed"
+		case exitPostCmdFailed:
+			hr.Error = "the key was installed but the post-cmd hook failed"
+		case 255:
+			var explanation string
+			if explanation, kind = explainSSHFailure(result.Stderr); explanation != "" {
+				hr.Error = explanation
+			}
+			if kind == nil && hr.AuthFailure {
+				kind = ErrAuthFailed
+			}
+		default:
+			if isWriteDenied(result.Stderr) {
+				kind = ErrRemoteWriteDenied
+			}
+		}
+		hr.err = err
+		if kind != nil {
+			hr.err = withKind(kind, errors.New(hr.Error))
+		} else if hr.Error != err.Error() {
+			hr.err = errors.New(hr.Error)
+		}
+		if hr.ExitCode == 0 {
+			hr.ExitCode = 1
+		}
+	}
+	hr.Reason = errorReason(hr.err)
+	hr.Seconds = time.Since(start).Seconds()
+	if f.Metrics != nil {
+		f.Metrics.Observe(hr)
+	}
+	return hr
+}
+
+// Err returns the error of the host, nil when it succeeded. It matches one
+// of the sentinel errors when the cause is known; a key that was already
+// present is ErrKeyExists.
+func (r hostResult) Err() error {
+	return r.err
+}
+
+func isAuthFailure(stderr []byte) bool {
+	return bytes.Contains(stderr, []byte("Permission denied")) || bytes.Contains(stderr, []byte("Too many authentication failures"))
+}
+
+// Run executes command on every host and returns the results in the order
+// of hosts.
+func (f *fleet) Run(ctx context.Context, hosts []string, command string) []hostResult {
+	return f.RunEach(ctx, hosts, func(string) string { return command })
+}
+
+// RunEach is like Run but executes the command returned by commandFor.
+func (f *fleet) RunEach(ctx context.Context, hosts []string, commandFor func(host string) string) []hostResult {
+	parallel := f.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	results := make([]hostResult, len(hosts))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failures := 0
+	aborted := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return (f.MaxFailures > 0 && failures >= f.MaxFailures) ||
+			(f.MaxFailurePct > 0 && float64(failures)*100 > f.MaxFailurePct*float64(len(hosts)))
+	}
+	var next time.Time
+	for i, host := range hosts {
+		if f.Skip != nil && f.Skip(host) {
+			results[i] = hostResult{Host: host, Status: statusSkipped}
+			if f.OnPass != nil {
+				f.OnPass(results[i])
+			}
+			continue
+		}
+		sem <- struct{}{}
+		if f.Interval > 0 {
+			time.Sleep(time.Until(next))
+			next = time.Now().Add(f.Interval)
+		}
+		if aborted() {
+			<-sem
+			results[i] = hostResult{Host: host, Status: statusAborted}
+			if f.OnPass != nil {
+				f.OnPass(results[i])
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			if f.OnStart != nil {
+				f.OnStart(host)
+			}
+			results[i] = f.runHost(ctx, host, commandFor(host))
+			if results[i].Status == statusFailed {
+				mu.Lock()
+				failures++
+				mu.Unlock()
+			}
+			if f.OnResult != nil {
+				f.OnResult(results[i])
+			}
+			<-sem
+		}(i, host)
+	}
+	wg.Wait()
+	return results
+}
+
+// parseRate converts a rate like "5/s", "30/m" or "100/h" into the interval
+// between two connections. A plain number is a rate per second.
+func parseRate(rate string) (time.Duration, error) {
+	count, unit := rate, "s"
+	if i := strings.Index(rate, "/"); i >= 0 {
+		count, unit = rate[:i], rate[i+1:]
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, fmt.Errorf("invalid rate unit %q, use s, m or h", unit)
+	}
+	return time.Duration(float64(per) / n), nil
+}
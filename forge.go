@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var gitHubAPI = "https://api.github.com"
+
+type forgeKey struct {
+	ID    int    `json:"id,omitempty"`
+	Title string `json:"title"`
+	Key   string `json:"key"`
+}
+
+// findForgeKey looks for key in the paginated key list at url.
+func findForgeKey(url string, header http.Header, key *publicKey) (*forgeKey, error) {
+	for page := 1; ; page++ {
+		var keys []forgeKey
+		if err := callJSONAPI(http.MethodGet, fmt.Sprintf("%s?per_page=100&page=%d", url, page), header, nil, &keys); err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		for i := range keys {
+			if existing, err := parsePublicKey(keys[i].Key); err == nil && sameKey(existing, key) {
+				return &keys[i], nil
+			}
+		}
+	}
+}
+
+// uploadForgeKey adds the key to the key list at url unless a key with the
+// same blob is already present.
+func uploadForgeKey(url string, header http.Header, key *publicKey, title string) (string, error) {
+	existing, err := findForgeKey(url, header, key)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return fmt.Sprintf("already registered as %q (ID %d)", existing.Title, existing.ID), nil
+	}
+	var created forgeKey
+	if err := callJSONAPI(http.MethodPost, url, header, forgeKey{Title: title, Key: key.String()}, &created); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("registered as %q (ID %d)", created.Title, created.ID), nil
+}
+
+// gitHubUpload adds the key to the account of $GITHUB_TOKEN, which needs the
+// write:public_key scope.
+func gitHubUpload(key *publicKey, name string) (string, error) {
+	token, err := envToken("GITHUB_TOKEN", "GH_TOKEN")
+	if err != nil {
+		return "", err
+	}
+	header := bearerHeader(token)
+	header.Set("X-GitHub-Api-Version", "2022-11-28")
+	return uploadForgeKey(gitHubAPI+"/user/keys", header, key, name)
+}
+
+// instanceToken returns the token for the forge at baseURL from
+// $<PREFIX>_TOKEN_<HOST>, e.g. GITEA_TOKEN_GIT_EXAMPLE_COM, falling back to
+// $<PREFIX>_TOKEN.
+func instanceToken(prefix, baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid forge URL %q", baseURL)
+	}
+	host := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, u.Host)
+	return envToken(prefix+"_TOKEN_"+host, prefix+"_TOKEN")
+}
+
+// gitLabUpload adds the key to the account of the GitLab token, which needs
+// the api scope.
+func gitLabUpload(key *publicKey, name string) (string, error) {
+	base := pCommandLineArgs.GitLabUpload.Value
+	if base == "" {
+		base = "https://gitlab.com"
+	}
+	token, err := instanceToken("GITLAB", base)
+	if err != nil {
+		return "", err
+	}
+	return uploadForgeKey(strings.TrimRight(base, "/")+"/api/v4/user/keys", bearerHeader(token), key, name)
+}
+
+// giteaUpload adds the key to the account of the Gitea or Forgejo token,
+// which needs the write:user scope.
+func giteaUpload(key *publicKey, name string) (string, error) {
+	base := pCommandLineArgs.GiteaUpload
+	token, err := instanceToken("GITEA", base)
+	if err != nil {
+		return "", err
+	}
+	return uploadForgeKey(strings.TrimRight(base, "/")+"/api/v1/user/keys", http.Header{"Authorization": {"token " + token}}, key, name)
+}
+
+func init() {
+	keyBackends["github"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.GitHubUpload },
+		Upload:  gitHubUpload,
+	}
+	keyBackends["gitlab"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.GitLabUpload.Enabled },
+		Upload:  gitLabUpload,
+	}
+	keyBackends["gitea"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.GiteaUpload != "" },
+		Upload:  giteaUpload,
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostPort returns the hostname and port ssh connects to for a target,
+// taking HostName and Port from the ssh configuration. A Port there only
+// applies while -p is left at 22.
+func hostPort(target string) (string, int) {
+	_, host := splitUserHost(target)
+	config := resolveSSHConfig(target)
+	if hostname := config.Get("HostName"); hostname != "" {
+		host = strings.ReplaceAll(hostname, "%h", host)
+	}
+	port := pCommandLineArgs.Port
+	if t, ok := pCommandLineArgs.Targets[target]; ok && t.Port != 0 {
+		port = t.Port
+	} else if p, err := strconv.Atoi(config.Get("Port")); err == nil && port == 22 {
+		port = p
+	}
+	return strings.Trim(host, "[]"), port
+}
+
+// localSourceAddresses returns the local addresses the connections to the
+// hosts originate from. Behind NAT or a jump host the servers see another
+// address, in which case -from-cidr must be used instead.
+func localSourceAddresses(hosts []string) ([]string, error) {
+	var addresses []string
+	seen := map[string]bool{}
+	for _, target := range hosts {
+		host, port := hostPort(target)
+		dialer, err := bindDialer("udp", target, host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, fmt.Errorf("finding the source address for %s: %v", target, err)
+		}
+		ip := conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+		if !seen[ip] {
+			seen[ip] = true
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses, nil
+}
+
+// parseFromCIDR checks a comma separated list of networks, addresses or
+// sshd host patterns for a from= option.
+func parseFromCIDR(list string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(list, ",") {
+		source = strings.TrimSpace(source)
+		pattern := strings.TrimPrefix(source, "!")
+		switch {
+		case pattern == "":
+			continue
+		case strings.Contains(pattern, "/"):
+			if _, _, err := net.ParseCIDR(pattern); err != nil {
+				return nil, fmt.Errorf("invalid network %q", source)
+			}
+		case strings.ContainsAny(pattern, "\" "):
+			return nil, fmt.Errorf("invalid source %q", source)
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source networks given")
+	}
+	return sources, nil
+}
+
+// fromOption returns the from= option of -from-self and -from-cidr, empty
+// when neither is given.
+func fromOption(hosts []string) (string, error) {
+	var sources []string
+	if pCommandLineArgs.FromCIDR != "" {
+		networks, err := parseFromCIDR(pCommandLineArgs.FromCIDR)
+		if err != nil {
+			return "", err
+		}
+		sources = append(sources, networks...)
+	}
+	if pCommandLineArgs.FromSelf {
+		addresses, err := localSourceAddresses(hosts)
+		if err != nil {
+			return "", err
+		}
+		sources = append(sources, addresses...)
+	}
+	if len(sources) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("from=\"%s\"", strings.Join(sources, ",")), nil
+}
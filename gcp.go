@@ -0,0 +1,33 @@
+package main
+
+import "fmt"
+
+// gcpOSLogin adds the key to the OS Login profile of the account gcloud is
+// logged in with.
+func gcpOSLogin(key *publicKey, name string) (string, error) {
+	keyFile, cleanup, err := writeTempKeyFile(key)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	args := []string{"compute", "os-login", "ssh-keys", "add", "--key-file=" + keyFile, "--format=value(loginProfile.name)"}
+	if pCommandLineArgs.TTL != "" {
+		args = append(args, "--ttl="+pCommandLineArgs.TTL)
+	}
+	account, err := runCLI("gcloud", args...)
+	if err != nil {
+		return "", err
+	}
+	info := "added to the OS Login profile " + account
+	if pCommandLineArgs.TTL != "" {
+		info += fmt.Sprintf(", expires in %s", pCommandLineArgs.TTL)
+	}
+	return info, nil
+}
+
+func init() {
+	keyBackends["gcp-oslogin"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.GCPOSLogin },
+		Upload:  gcpOSLogin,
+	}
+}
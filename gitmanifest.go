@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// parseGitManifest splits a git+URL@ref:path manifest source.
+func parseGitManifest(source string) (url, ref, path string, err error) {
+	rest := strings.TrimPrefix(source, "git+")
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return "", "", "", fmt.Errorf("invalid git manifest %q, use git+URL@ref:path", source)
+	}
+	url = rest[:at]
+	ref, path, ok := strings.Cut(rest[at+1:], ":")
+	if !ok || url == "" || ref == "" || path == "" {
+		return "", "", "", fmt.Errorf("invalid git manifest %q, use git+URL@ref:path", source)
+	}
+	return url, ref, path, nil
+}
+
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// commitSignature splits a raw commit object into the signed payload and
+// its gpgsig header.
+func commitSignature(commit []byte) (payload, signature []byte) {
+	var p, sig bytes.Buffer
+	lines := strings.SplitAfter(string(commit), "\n")
+	inHeaders, inSig := true, false
+	for _, line := range lines {
+		switch {
+		case inHeaders && strings.HasPrefix(line, "gpgsig "):
+			inSig = true
+			sig.WriteString(strings.TrimPrefix(line, "gpgsig "))
+		case inSig && strings.HasPrefix(line, " "):
+			sig.WriteString(line[1:])
+		default:
+			inSig = false
+			if line == "\n" {
+				inHeaders = false
+			}
+			p.WriteString(line)
+		}
+	}
+	return p.Bytes(), sig.Bytes()
+}
+
+// verifyCommitSignature checks the SSH signature of commit against the
+// allowed_signers or public key file, as git verify-commit does with
+// gpg.format=ssh.
+func verifyCommitSignature(dir, commit, trustedFile string) error {
+	raw, err := git(dir, "cat-file", "commit", commit)
+	if err != nil {
+		return err
+	}
+	payload, signature := commitSignature(raw)
+	if len(signature) == 0 {
+		return fmt.Errorf("commit %s is not signed", commit)
+	}
+	signers, err := readAllowedSigners(trustedFile)
+	if err != nil {
+		return err
+	}
+	if err := verifyAllowedSignature(signers, "", "git", payload, signature, time.Now()); err != nil {
+		return fmt.Errorf("commit %s: %v", commit, err)
+	}
+	return nil
+}
+
+// readGitManifest fetches ref of the repository and reads the manifest from
+// it. With a trusted key the manifest's .sig in the repository must verify
+// or, without one, the SSH signature of the commit, which then also covers
+// the key files.
+func readGitManifest(source, trustedFile string) (map[string][]string, error) {
+	url, ref, path, err := parseGitManifest(source)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp("", "ssh-copy-id-manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := git(dir, "init", "-q"); err != nil {
+		return nil, err
+	}
+	if _, err := git(dir, "fetch", "-q", "--depth", "1", url, ref); err != nil {
+		return nil, err
+	}
+	if _, err := git(dir, "checkout", "-q", "FETCH_HEAD"); err != nil {
+		return nil, err
+	}
+	out, err := git(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	commit := strings.TrimSpace(string(out))
+	fmt.Fprintf(os.Stderr, "Manifest %s at %s of %s\n", path, commit, url)
+	fileName := filepath.Join(dir, filepath.FromSlash(path))
+	if trustedFile == "" {
+		return readManifest(fileName, "", "")
+	}
+	if _, err := os.Stat(fileName + ".sig"); err == nil {
+		return readManifest(fileName, "", trustedFile)
+	}
+	if err := verifyCommitSignature(dir, commit, trustedFile); err != nil {
+		return nil, err
+	}
+	return readManifest(fileName, "", "")
+}
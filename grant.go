@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseGrantDuration parses a -grant-for duration, which may also be given
+// in days, e.g. 2d.
+func parseGrantDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// expiryOption returns the expiry-time option ending the key's validity at
+// expires, in UTC.
+func expiryOption(expires time.Time) string {
+	return fmt.Sprintf("expiry-time=\"%sZ\"", expires.UTC().Format("200601021504"))
+}
+
+// scheduleRevocation writes the revocation script of the hosts the key was
+// granted on and, when at(1) is available, schedules it for the expiry
+// time, so the expired line does not stay behind. Without at it is left as a
+// reminder.
+func scheduleRevocation(expires time.Time, keyData string, results []hostResult) error {
+	content, err := revocationScript(keyData, results, "access granted until "+expires.Format(time.RFC3339))
+	if err != nil || content == "" {
+		return err
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, "ssh-copy-id", "revoke")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	script := filepath.Join(dir, expires.UTC().Format("20060102T150405Z")+".sh")
+	if err := os.WriteFile(script, []byte(content), 0700); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Access expires at %s, remove the key then with:\n\t%s\n", expires.Format(time.RFC3339), shellWord(script))
+	if _, err := exec.LookPath("at"); err != nil {
+		fmt.Fprintf(os.Stderr, "at is not installed, run %s after the expiry\n", script)
+		return nil
+	}
+	at := exec.Command("at", "-t", expires.Local().Format("200601021504"), "-f", script)
+	if out, err := at.CombinedOutput(); err != nil {
+		return fmt.Errorf("scheduling %s with at failed: %v: %s", script, err, strings.TrimSpace(string(out)))
+	}
+	fmt.Fprintf(os.Stderr, "Scheduled %s with at\n", script)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// disablePasswordAuthCommand turns off password authentication in
+// sshd_config. The setting is inserted as the first line, so it takes
+// precedence over later lines and included files, and the original file is
+// kept as sshd_config.ssh-copy-id.bak; an existing backup is never
+// overwritten, so it stays the configuration before the first run. sshd is
+// only reloaded when the new configuration passes sshd -t, otherwise the
+// inserted line is removed again.
+const disablePasswordAuthCommand = `SUDO=; [ "$(id -u)" = 0 ] || SUDO="sudo -n"
+f=/etc/ssh/sshd_config
+$SUDO test -e "$f.ssh-copy-id.bak" || $SUDO cp -p "$f" "$f.ssh-copy-id.bak" || exit 1
+$SUDO sed -i '1i PasswordAuthentication no' "$f" || exit 1
+if ! $SUDO "$(command -v sshd || echo /usr/sbin/sshd)" -t; then
+	$SUDO sed -i '1d' "$f"
+	echo "sshd -t rejected the new configuration, removed the inserted line again" >&2
+	exit 1
+fi
+$SUDO systemctl reload sshd 2>/dev/null || $SUDO systemctl reload ssh 2>/dev/null || $SUDO service ssh reload 2>/dev/null || $SUDO kill -HUP "$(cat /var/run/sshd.pid)"`
+
+// disablePasswordAuth disables password authentication on the hosts where
+// the key was installed, after checking that it actually logs in. The check
+// offers only the private key of the copied key and ignores the agent, so
+// no other key can make it pass. It returns the number of hosts where this
+// failed.
+func disablePasswordAuth(ctx context.Context, results []hostResult) int {
+	identity := strings.TrimSuffix(pCommandLineArgs.PublicKeyFile, ".pub")
+	_, identityErr := os.Stat(identity)
+	verifier := identityRunner(identity)
+	verifier.Args = append(verifier.Args, "-o", "IdentityAgent=none")
+	var hosts []string
+	failed := 0
+	for _, r := range results {
+		if r.Status != statusInstalled && r.Status != statusExists {
+			continue
+		}
+		if identityErr != nil || identity == pCommandLineArgs.PublicKeyFile {
+			fmt.Fprintf(os.Stderr, "%s: not disabling password authentication, there is no private key of %s to verify the login with\n", r.Host, pCommandLineArgs.PublicKeyFile)
+			failed++
+			continue
+		}
+		_, err := verifier.Run(ctx, r.Host, "true")
+		events.Verify(r.Host, err)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: not disabling password authentication, login with %s failed: %v\n", r.Host, identity, err)
+			failed++
+			continue
+		}
+		hosts = append(hosts, r.Host)
+	}
+	if len(hosts) == 0 {
+		return failed
+	}
+	if !confirm(fmt.Sprintf("Set PasswordAuthentication no in the sshd_config of %s and reload sshd?", strings.Join(hosts, ", "))) {
+		return failed
+	}
+	f := &fleet{Runner: verifier, Parallel: pCommandLineArgs.Parallel}
+	for _, r := range f.Run(ctx, hosts, disablePasswordAuthCommand) {
+		if r.Status == statusFailed {
+			fmt.Fprintf(os.Stderr, "%s: disabling password authentication failed: %v\n", r.Host, r.Error)
+			failed++
+		} else if !pCommandLineArgs.Quiet {
+			fmt.Fprintf(os.Stderr, "%s: password authentication disabled\n", r.Host)
+		}
+	}
+	return failed
+}
+
+// defaultHardenedOptions are the authorized_keys options of -hardened.
+const defaultHardenedOptions = "restrict,no-agent-forwarding,no-X11-forwarding"
+
+func validateHardened() error {
+	if nonShellFlavors[pCommandLineArgs.ServerFlavor] && pCommandLineArgs.ServerFlavor != "windows" {
+		return fmt.Errorf("server flavor %s does not support authorized_keys options", pCommandLineArgs.ServerFlavor)
+	}
+	if err := validateOptions(pCommandLineArgs.HardenedOptions); err != nil {
+		return fmt.Errorf("invalid -hardened-options: %v", err)
+	}
+	return nil
+}
+
+// withKeyOptions prepends options to an authorized_keys line, in front of
+// the options the line already has.
+func withKeyOptions(options, line string) string {
+	existing, key := splitOptions(line)
+	if existing != "" {
+		options += "," + existing
+	}
+	return options + " " + key
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var hetznerCloudAPI = "https://api.hetzner.cloud/v1"
+
+type hetznerKey struct {
+	ID          int    `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	PublicKey   string `json:"public_key"`
+}
+
+// hetznerUpload registers the key with the Hetzner Cloud project of the
+// token, like digitalOceanUpload. The API reports a conflict for both
+// duplicate keys and names, so the key is looked up to tell them apart.
+func hetznerUpload(key *publicKey, name string) (string, error) {
+	token, err := envToken("HCLOUD_TOKEN")
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		SSHKey hetznerKey `json:"ssh_key"`
+	}
+	req := hetznerKey{Name: name, PublicKey: key.String()}
+	err = callJSONAPI(http.MethodPost, hetznerCloudAPI+"/ssh_keys", bearerHeader(token), req, &resp)
+	if apiErr, ok := err.(*apiError); ok && apiErr.Status == http.StatusConflict {
+		var list struct {
+			SSHKeys []hetznerKey `json:"ssh_keys"`
+		}
+		query := hetznerCloudAPI + "/ssh_keys?fingerprint=" + url.QueryEscape(key.FingerprintMD5())
+		if err := callJSONAPI(http.MethodGet, query, bearerHeader(token), nil, &list); err != nil {
+			return "", err
+		}
+		if len(list.SSHKeys) == 0 {
+			return "", fmt.Errorf("a different key named %q already exists", name)
+		}
+		existing := list.SSHKeys[0]
+		return fmt.Sprintf("already registered as %q (ID %d, fingerprint %s)", existing.Name, existing.ID, existing.Fingerprint), nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("registered as %q (ID %d, fingerprint %s)", resp.SSHKey.Name, resp.SSHKey.ID, resp.SSHKey.Fingerprint), nil
+}
+
+func init() {
+	keyBackends["hcloud"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.HetznerCloud },
+		Upload:  hetznerUpload,
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+const (
+	// exitPreCmdFailed is returned by the install command when the -pre-cmd
+	// hook failed; the key was not installed.
+	exitPreCmdFailed = 204
+	// exitPostCmdFailed is returned by the install command when the key was
+	// installed but the -post-cmd hook failed.
+	exitPostCmdFailed = 205
+)
+
+// nonShellFlavors are the server flavors whose remote side is not a POSIX
+// shell, so hooks cannot be wrapped around their install command.
+var nonShellFlavors = map[string]bool{
+	"windows":  true,
+	"routeros": true,
+	"junos":    true,
+	"ios-xe":   true,
+}
+
+func validateHooks() error {
+	if pCommandLineArgs.PreCmd == "" && pCommandLineArgs.PostCmd == "" {
+		return nil
+	}
+	if nonShellFlavors[pCommandLineArgs.ServerFlavor] {
+		return fmt.Errorf("-pre-cmd and -post-cmd need a POSIX shell, not server flavor %s", pCommandLineArgs.ServerFlavor)
+	}
+	return nil
+}
+
+// withHooks runs the -pre-cmd and -post-cmd hooks around an install command
+// in the same session. The post hook runs when the key was installed or
+// already present. The output of the hooks goes to stdout, where it is
+// captured per host.
+func withHooks(command string) string {
+	pre, post := pCommandLineArgs.PreCmd, pCommandLineArgs.PostCmd
+	if pre == "" && post == "" {
+		return command
+	}
+	script := ""
+	if pre != "" {
+		script += fmt.Sprintf("(%s\n) 2>&1 || exit %d\n", pre, exitPreCmdFailed)
+	}
+	script += fmt.Sprintf("(%s\n)\nrc=$?\n", command)
+	if post != "" {
+		script += fmt.Sprintf("if [ $rc -eq 0 ] || [ $rc -eq %d ]; then (%s\n) 2>&1 || exit %d; fi\n", exitKeyExists, post, exitPostCmdFailed)
+	}
+	return script + "exit $rc"
+}
+
+// printHookOutput prints the captured hook output of every host.
+func printHookOutput(results []hostResult) {
+	for _, r := range results {
+		if len(r.Output) == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s:\n", r.Host)
+		for _, line := range bytes.SplitAfter(bytes.TrimRight(r.Output, "\n"), []byte("\n")) {
+			fmt.Fprintf(os.Stdout, "\t%s", line)
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+}
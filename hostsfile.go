@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// hostsFileTargets reads a hosts file, registering the per-host settings in
+// targets. Every line holds a [user@]hostname, which may be a range like
+// web[01-20], followed by optional key=value settings:
+//
+//	db1.example.com user=postgres port=2222 identity=~/.ssh/db jump=bastion tags=prod,db
+//
+// Blank lines and lines starting with # are ignored.
+func hostsFileTargets(fileName string, targets map[string]targetConfig) ([]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var hosts []string
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		user, config := "", targetConfig{}
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("%s:%d: expected key=value, got %q", fileName, lineNo, field)
+			}
+			switch name {
+			case "user":
+				user = value
+			case "port":
+				if config.Port, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid port %q", fileName, lineNo, value)
+				}
+			case "identity":
+				config.IdentityFile = expandHome(value)
+			case "jump":
+				config.Options = append(config.Options, "ProxyJump="+value)
+			case "tags":
+				config.Tags = append(config.Tags, splitTags(value)...)
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown setting %q, use user, port, identity, jump or tags", fileName, lineNo, name)
+			}
+		}
+		ports := map[string]targetConfig{}
+		expanded, err := expandTargets([]string{fields[0]}, ports)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, lineNo, err)
+		}
+		for _, host := range expanded {
+			port := ports[host].Port
+			if user != "" {
+				_, hostname := splitUserHost(host)
+				host = user + "@" + hostname
+			}
+			// Merge with what is known of the host, the port of an
+			// [addr]:port entry giving way to a port= setting.
+			t := targets[host]
+			if port != 0 {
+				t.Port = port
+			}
+			if config.Port != 0 {
+				t.Port = config.Port
+			}
+			if config.IdentityFile != "" {
+				t.IdentityFile = config.IdentityFile
+			}
+			t.Options = append(t.Options, config.Options...)
+			t.Tags = append(t.Tags, config.Tags...)
+			if t.Port != 0 || t.IdentityFile != "" || len(t.Options) > 0 || len(t.Tags) > 0 {
+				targets[host] = t
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%s contains no hosts", fileName)
+	}
+	return hosts, nil
+}
+
+// expandHome replaces a leading ~/ by the home directory.
+func expandHome(fileName string) string {
+	if !strings.HasPrefix(fileName, "~/") {
+		return fileName
+	}
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return fileName
+	}
+	return filepath.Join(dirname, fileName[2:])
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	inventoryGroup struct {
+		Hosts    []string
+		Children []string
+		Vars     map[string]string
+	}
+
+	// inventory is the subset of an Ansible inventory needed to connect to
+	// its hosts.
+	inventory struct {
+		Groups   map[string]*inventoryGroup
+		HostVars map[string]map[string]string
+	}
+
+	yamlInventoryGroup struct {
+		Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+		Children map[string]*yamlInventoryGroup    `yaml:"children"`
+		Vars     map[string]interface{}            `yaml:"vars"`
+	}
+)
+
+func newInventory() *inventory {
+	return &inventory{Groups: map[string]*inventoryGroup{}, HostVars: map[string]map[string]string{}}
+}
+
+func (inv *inventory) group(name string) *inventoryGroup {
+	g, ok := inv.Groups[name]
+	if !ok {
+		g = &inventoryGroup{Vars: map[string]string{}}
+		inv.Groups[name] = g
+	}
+	return g
+}
+
+func (inv *inventory) addHost(group, host string, vars map[string]string) {
+	g := inv.group(group)
+	g.Hosts = append(g.Hosts, host)
+	if inv.HostVars[host] == nil {
+		inv.HostVars[host] = map[string]string{}
+	}
+	for k, v := range vars {
+		inv.HostVars[host][k] = v
+	}
+}
+
+var ansibleRange = regexp.MustCompile(`\[(\d+):(\d+)\]`)
+
+// expandAnsibleHost expands the Ansible range syntax www[01:50] using the
+// host range expansion of the command line.
+func expandAnsibleHost(pattern string) ([]string, error) {
+	return expandPattern(ansibleRange.ReplaceAllString(pattern, "[$1-$2]"))
+}
+
+// parseINIVars parses key=value pairs, allowing double or single quotes.
+func parseINIVars(fields []string) map[string]string {
+	vars := map[string]string{}
+	for _, field := range fields {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			vars[k] = strings.Trim(v, `"'`)
+		}
+	}
+	return vars
+}
+
+func parseINIInventory(fileName string) (*inventory, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	inv := newInventory()
+	group, section := "ungrouped", ""
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			group, section, _ = strings.Cut(line[1:len(line)-1], ":")
+			inv.group(group)
+			continue
+		}
+		fields := strings.Fields(line)
+		switch section {
+		case "vars":
+			for k, v := range parseINIVars(fields) {
+				inv.group(group).Vars[k] = v
+			}
+		case "children":
+			inv.group(group).Children = append(inv.group(group).Children, fields[0])
+			inv.group(fields[0])
+		case "":
+			hosts, err := expandAnsibleHost(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fileName, lineNo, err)
+			}
+			for _, host := range hosts {
+				inv.addHost(group, host, parseINIVars(fields[1:]))
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown section type %q", fileName, lineNo, section)
+		}
+	}
+	return inv, scanner.Err()
+}
+
+func stringVars(vars map[string]interface{}) map[string]string {
+	result := map[string]string{}
+	for k, v := range vars {
+		if v != nil {
+			result[k] = fmt.Sprint(v)
+		}
+	}
+	return result
+}
+
+func (inv *inventory) addYAMLGroup(name string, g *yamlInventoryGroup) error {
+	if g == nil {
+		inv.group(name)
+		return nil
+	}
+	group := inv.group(name)
+	for k, v := range stringVars(g.Vars) {
+		group.Vars[k] = v
+	}
+	for pattern, vars := range g.Hosts {
+		hosts, err := expandAnsibleHost(pattern)
+		if err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			inv.addHost(name, host, stringVars(vars))
+		}
+	}
+	for child, cg := range g.Children {
+		group.Children = append(group.Children, child)
+		if err := inv.addYAMLGroup(child, cg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseYAMLInventory(fileName string) (*inventory, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var groups map[string]*yamlInventoryGroup
+	if err := yaml.Unmarshal(buf, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	inv := newInventory()
+	for name, g := range groups {
+		if err := inv.addYAMLGroup(name, g); err != nil {
+			return nil, fmt.Errorf("%s: %v", fileName, err)
+		}
+	}
+	return inv, nil
+}
+
+func readInventory(fileName string) (*inventory, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yml", ".yaml":
+		return parseYAMLInventory(fileName)
+	}
+	return parseINIInventory(fileName)
+}
+
+// groupHosts returns the hosts of a group including its children.
+func (inv *inventory) groupHosts(name string, seen map[string]bool) []string {
+	g, ok := inv.Groups[name]
+	if !ok || seen[name] {
+		return nil
+	}
+	seen[name] = true
+	hosts := append([]string{}, g.Hosts...)
+	for _, child := range g.Children {
+		hosts = append(hosts, inv.groupHosts(child, seen)...)
+	}
+	return hosts
+}
+
+// allHosts returns every host of the inventory in sorted order.
+func (inv *inventory) allHosts() []string {
+	hosts := make([]string, 0, len(inv.HostVars))
+	for host := range inv.HostVars {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// parents maps each group to the groups listing it as a child.
+func (inv *inventory) parents() map[string][]string {
+	parents := map[string][]string{}
+	for name, g := range inv.Groups {
+		for _, child := range g.Children {
+			parents[child] = append(parents[child], name)
+		}
+	}
+	return parents
+}
+
+// groupDepth is the distance of a group from the top of the hierarchy, so
+// vars of child groups can override the vars of their parents.
+func groupDepth(name string, parents map[string][]string, seen map[string]bool) int {
+	if seen[name] {
+		return 0
+	}
+	seen[name] = true
+	depth := 0
+	for _, parent := range parents[name] {
+		if d := groupDepth(parent, parents, seen) + 1; d > depth {
+			depth = d
+		}
+	}
+	return depth
+}
+
+// hostVars resolves the variables of a host: the vars of group all, of its
+// groups from the most general to the most specific and its host vars.
+func (inv *inventory) hostVars(host string) map[string]string {
+	parents := inv.parents()
+	var groups []string
+	for name := range inv.Groups {
+		for _, h := range inv.groupHosts(name, map[string]bool{}) {
+			if h == host {
+				groups = append(groups, name)
+				break
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		di, dj := groupDepth(groups[i], parents, map[string]bool{}), groupDepth(groups[j], parents, map[string]bool{})
+		if di != dj {
+			return di < dj
+		}
+		return groups[i] < groups[j]
+	})
+	vars := map[string]string{}
+	if all, ok := inv.Groups["all"]; ok {
+		for k, v := range all.Vars {
+			vars[k] = v
+		}
+	}
+	for _, name := range groups {
+		for k, v := range inv.Groups[name].Vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range inv.HostVars[host] {
+		vars[k] = v
+	}
+	return vars
+}
+
+// limitHosts selects the hosts matching an Ansible style limit: group or
+// host names separated by commas or colons, with ! excluding a name.
+func (inv *inventory) limitHosts(limit string) []string {
+	if limit == "" || limit == "all" {
+		return inv.allHosts()
+	}
+	matches := func(name string) []string {
+		if _, ok := inv.Groups[name]; ok {
+			return inv.groupHosts(name, map[string]bool{})
+		}
+		if _, ok := inv.HostVars[name]; ok {
+			return []string{name}
+		}
+		return nil
+	}
+	selected, excluded := map[string]bool{}, map[string]bool{}
+	for _, pattern := range strings.FieldsFunc(limit, func(r rune) bool { return r == ',' || r == ':' }) {
+		if strings.HasPrefix(pattern, "!") {
+			for _, host := range matches(pattern[1:]) {
+				excluded[host] = true
+			}
+			continue
+		}
+		for _, host := range matches(pattern) {
+			selected[host] = true
+		}
+	}
+	var hosts []string
+	for _, host := range inv.allHosts() {
+		if selected[host] && !excluded[host] {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// inventoryTargets returns the targets of the selected inventory hosts,
+// registering their ports in targets.
+func inventoryTargets(fileName, limit string, targets map[string]targetConfig) ([]string, error) {
+	inv, err := readInventory(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, host := range inv.limitHosts(limit) {
+		vars := inv.hostVars(host)
+		target := host
+		if address := vars["ansible_host"]; address != "" {
+			target = address
+		}
+		if user := vars["ansible_user"]; user != "" {
+			target = user + "@" + target
+		}
+		var config targetConfig
+		if port := vars["ansible_port"]; port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ansible_port %q of %s", port, host)
+			}
+			config.Port = p
+		}
+		if identity := vars["ansible_ssh_private_key_file"]; identity != "" {
+			config.IdentityFile = expandHome(identity)
+		}
+		if config.Port != 0 || config.IdentityFile != "" {
+			targets[target] = config
+		}
+		hosts = append(hosts, target)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts of %s match %q", fileName, limit)
+	}
+	return hosts, nil
+}
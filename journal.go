@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// journalEntry records the lines added to host and the files they were
+	// added to.
+	journalEntry struct {
+		Host string `json:"host"`
+		keyTarget
+		Lines []string `json:"lines"`
+	}
+
+	// journal records the key lines the last run added to each host.
+	journal struct {
+		Time    time.Time      `json:"time"`
+		Entries []journalEntry `json:"entries"`
+	}
+)
+
+func defaultJournalPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ssh-copy-id", "journal.json")
+}
+
+func readJournal(path string) (*journal, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no previous run recorded in %s", path)
+		}
+		return nil, err
+	}
+	j := new(journal)
+	if err := json.Unmarshal(buf, j); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %v", path, err)
+	}
+	return j, nil
+}
+
+func (j *journal) write(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf, 0600)
+}
+
+// recordJournal replaces the journal with the hosts the key was added to.
+// Runs that added nothing leave the previous journal in place.
+func recordJournal(path, line string, results []hostResult) error {
+	j := &journal{Time: time.Now().UTC()}
+	for _, r := range results {
+		if r.Status == statusInstalled {
+			j.Entries = append(j.Entries, journalEntry{Host: r.Host, keyTarget: installedTarget(r), Lines: []string{line}})
+		}
+	}
+	if len(j.Entries) == 0 {
+		return nil
+	}
+	return j.write(path)
+}
+
+func runUndo(args []string) error {
+	flag.CommandLine.Parse(args)
+	if pCommandLineArgs.Tag != "" || pCommandLineArgs.ExcludeTag != "" {
+		return fmt.Errorf("undo removes the keys of the last run from all its hosts and does not take -tag or -exclude-tag")
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	path := pCommandLineArgs.Journal
+	j, err := readJournal(path)
+	if err != nil {
+		return err
+	}
+	if len(j.Entries) == 0 {
+		return fmt.Errorf("nothing to undo")
+	}
+
+	// hosts that got the same lines are removed in one fleet run
+	byLines := map[string][]journalEntry{}
+	var order []string
+	for _, entry := range j.Entries {
+		key := strings.Join(entry.Lines, "\n")
+		if _, ok := byLines[key]; !ok {
+			order = append(order, key)
+		}
+		byLines[key] = append(byLines[key], entry)
+	}
+
+	f := &fleet{Runner: newRunner(os.Stdout, os.Stderr), Parallel: pCommandLineArgs.Parallel}
+	var remaining []journalEntry
+	failed := 0
+	for _, key := range order {
+		lines := strings.Split(key, "\n")
+		var keys []*publicKey
+		for _, line := range lines {
+			if _, k, err := parseAuthorizedKey(line); err == nil {
+				keys = append(keys, k)
+			}
+		}
+		entries := map[string]journalEntry{}
+		var hosts []string
+		for _, entry := range byLines[key] {
+			entries[entry.Host] = entry
+			hosts = append(hosts, entry.Host)
+		}
+		results := f.RunEach(context.Background(), hosts, func(host string) string {
+			return entries[host].removeCommand(keys)
+		})
+		for i, r := range results {
+			switch r.Status {
+			case statusInstalled:
+				results[i].Status = statusRemoved
+				fmt.Printf("%s: removed %d key(s)\n", r.Host, len(lines))
+			case statusNotFound:
+				fmt.Printf("%s: key no longer present\n", r.Host)
+			default:
+				failed++
+				fmt.Fprintf(os.Stderr, "%s: Error removing key.Reason: %v\n", r.Host, r.Error)
+				remaining = append(remaining, entries[r.Host])
+			}
+		}
+		recordChange("remove", lineFingerprints(lines), results)
+	}
+	j.Entries = remaining
+	if err := j.write(path); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("undo failed on %d hosts, run undo again to retry", failed)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["undo"] = subcommand{"Remove the keys added by the previous run", runUndo}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	rfc4716Begin = "---- BEGIN SSH2 PUBLIC KEY ----"
+	rfc4716End   = "---- END SSH2 PUBLIC KEY ----"
+)
+
+// parseRFC4716 decodes a public key in the SSH2 format of RFC 4716, which
+// commercial SSH clients export. The Comment header becomes the comment.
+func parseRFC4716(data string) (*publicKey, error) {
+	lines := strings.Split(strings.ReplaceAll(data, "\r", ""), "\n")
+	i := 0
+	for i < len(lines) && strings.TrimSpace(lines[i]) != rfc4716Begin {
+		i++
+	}
+	if i == len(lines) {
+		return nil, fmt.Errorf("missing %s", rfc4716Begin)
+	}
+	comment := ""
+	var body strings.Builder
+	for i++; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == rfc4716End {
+			blob, err := base64.StdEncoding.DecodeString(body.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 key data: %v", err)
+			}
+			keyType := (&wireReader{buf: blob}).string()
+			if !isKeyType(keyType) {
+				return nil, fmt.Errorf("invalid key data")
+			}
+			return &publicKey{Type: keyType, Blob: blob, Comment: comment}, nil
+		}
+		if tag, value, ok := strings.Cut(line, ":"); ok && body.Len() == 0 {
+			// Headers continue on the next line after a trailing backslash.
+			for strings.HasSuffix(value, "\\") && i+1 < len(lines) {
+				i++
+				value = strings.TrimSuffix(value, "\\") + strings.TrimSpace(lines[i])
+			}
+			if strings.EqualFold(tag, "Comment") {
+				comment = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+			continue
+		}
+		body.WriteString(line)
+	}
+	return nil, fmt.Errorf("missing %s", rfc4716End)
+}
+
+// parsePPK extracts the public key of a PuTTY private key file of format
+// version 2 or 3. The public part is never encrypted.
+func parsePPK(data string) (*publicKey, error) {
+	lines := strings.Split(strings.ReplaceAll(data, "\r", ""), "\n")
+	comment := ""
+	for i := 0; i < len(lines); i++ {
+		tag, value, _ := strings.Cut(lines[i], ": ")
+		switch {
+		case tag == "PuTTY-User-Key-File-1":
+			return nil, fmt.Errorf("PuTTY key file version 1 is not supported")
+		case tag == "Comment":
+			comment = value
+		case tag == "Public-Lines":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || i+n >= len(lines) {
+				return nil, fmt.Errorf("invalid Public-Lines %q", value)
+			}
+			blob, err := base64.StdEncoding.DecodeString(strings.Join(lines[i+1:i+1+n], ""))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 key data: %v", err)
+			}
+			keyType := (&wireReader{buf: blob}).string()
+			if !isKeyType(keyType) {
+				return nil, fmt.Errorf("invalid key data")
+			}
+			return &publicKey{Type: keyType, Blob: blob, Comment: comment}, nil
+		}
+	}
+	return nil, fmt.Errorf("missing Public-Lines")
+}
+
+// normalizeKeyText decodes a key file saved by a Windows editor: it removes
+// a UTF-8 byte order mark, decodes UTF-16 and turns CRLF or CR line endings
+// into LF. It returns what it fixed.
+func normalizeKeyText(buf []byte) (string, []string) {
+	var fixes []string
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xef, 0xbb, 0xbf}):
+		buf = buf[3:]
+		fixes = append(fixes, "removed the UTF-8 byte order mark")
+	case len(buf)%2 == 0 && (bytes.HasPrefix(buf, []byte{0xff, 0xfe}) || bytes.HasPrefix(buf, []byte{0xfe, 0xff})):
+		units := make([]uint16, len(buf)/2-1)
+		for i := range units {
+			lo, hi := buf[2+2*i], buf[3+2*i]
+			if buf[0] == 0xfe {
+				lo, hi = hi, lo
+			}
+			units[i] = uint16(hi)<<8 | uint16(lo)
+		}
+		buf = []byte(string(utf16.Decode(units)))
+		fixes = append(fixes, "decoded UTF-16")
+	}
+	text := string(buf)
+	if strings.Contains(text, "\r\n") {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+		fixes = append(fixes, "converted CRLF line endings")
+	}
+	if strings.Contains(text, "\r") {
+		text = strings.ReplaceAll(text, "\r", "\n")
+		fixes = append(fixes, "converted CR line endings")
+	}
+	return text, fixes
+}
+
+// readKeyText reads a key file with normalizeKeyText, warning about what was
+// fixed.
+func readKeyText(fileName string) (string, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	text, fixes := normalizeKeyText(buf)
+	if len(fixes) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", fileName, strings.Join(fixes, ", "))
+	}
+	return text, nil
+}
+
+// normalizePublicKey converts the content of a public key file in one of the
+// supported formats into an OpenSSH authorized_keys line.
+func normalizePublicKey(data string) (string, error) {
+	if strings.HasPrefix(data, "PuTTY-User-Key-File-") {
+		key, err := parsePPK(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid PuTTY key file: %v", err)
+		}
+		return key.String(), nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(data), "-----BEGIN ") {
+		key, name, err := parsePEMPublicKey(data)
+		if err != nil {
+			return "", err
+		}
+		blob, err := sshPublicKeyBlob(key)
+		if err != nil {
+			return "", err
+		}
+		return (&publicKey{Type: (&wireReader{buf: blob}).string(), Blob: blob, Comment: name}).String(), nil
+	}
+	if strings.Contains(data, rfc4716Begin) {
+		key, err := parseRFC4716(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid RFC 4716 public key: %v", err)
+		}
+		return key.String(), nil
+	}
+	return keyLine(data), nil
+}
+
+// keyLine returns the key line of an OpenSSH .pub file, leaving options
+// before the key as they are. Blank and comment lines are dropped, and a
+// key whose base64 an editor wrapped over several lines is joined again.
+func keyLine(data string) string {
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
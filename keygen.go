@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// generatedKeyType returns the key type -generate creates.
+func generatedKeyType() string {
+	if pCommandLineArgs.KeyType != "" {
+		return pCommandLineArgs.KeyType
+	}
+	if pCommandLineArgs.Generate.Value != "" {
+		return pCommandLineArgs.Generate.Value
+	}
+	if types := pCommandLineArgs.keyTypes(); len(types) > 0 {
+		return types[0]
+	}
+	return "ed25519"
+}
+
+// defaultIdentity returns the first existing default identity of ssh in dir,
+// or the file of the -generate key type when there is none.
+func defaultIdentity(dir string) string {
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return filepath.Join(dir, "id_"+generatedKeyType())
+}
+
+// typedIdentity returns the first existing default identity in dir of the
+// -key-type types, or the file of the first type when there is none.
+func typedIdentity(dir string, types []string) string {
+	for _, name := range types {
+		if _, err := os.Stat(filepath.Join(dir, keyTypeFiles[name])); err == nil {
+			return filepath.Join(dir, keyTypeFiles[name])
+		}
+	}
+	return filepath.Join(dir, keyTypeFiles[types[0]])
+}
+
+// generateKey creates a key pair at path with ssh-keygen, which asks for the
+// passphrase. Without ssh-keygen the key is generated natively and not
+// encrypted.
+func generateKey(path, keyType string, bits int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Generating a new %s key %s\n", keyType, path)
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		fmt.Fprintf(os.Stderr, "ssh-keygen not found, the key is generated without a passphrase\n")
+		return generateKeyNative(path, keyType, bits)
+	}
+	args := []string{"-t", keyType, "-f", path}
+	if bits != 0 {
+		args = append(args, "-b", strconv.Itoa(bits))
+	}
+	cmd := exec.Command("ssh-keygen", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ssh-keygen failed: %v", err)
+	}
+	return nil
+}
+
+// generateKeyNative writes an unencrypted private key in the OpenSSH format
+// to path and its public key to path.pub. The defaults are those of
+// ssh-keygen: 3072 bit RSA and P-256 ECDSA keys.
+func generateKeyNative(path, keyType string, bits int) error {
+	var public, private []byte
+	switch keyType {
+	case "ed25519":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		public, _ = sshPublicKeyBlob(pub)
+		private = append(wireString([]byte("ssh-ed25519")), wireString(pub)...)
+		private = append(private, wireString(priv)...)
+	case "rsa":
+		if bits == 0 {
+			bits = 3072
+		}
+		if bits < 1024 {
+			return fmt.Errorf("RSA keys need at least 1024 bits")
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return err
+		}
+		public, _ = sshPublicKeyBlob(&key.PublicKey)
+		private = wireString([]byte("ssh-rsa"))
+		for _, n := range []*big.Int{key.N, big.NewInt(int64(key.E)), key.D, key.Precomputed.Qinv, key.Primes[0], key.Primes[1]} {
+			private = append(private, wireMPInt(n)...)
+		}
+	case "ecdsa":
+		curves := map[int]elliptic.Curve{0: elliptic.P256(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[bits]
+		if !ok {
+			return fmt.Errorf("ECDSA keys have 256, 384 or 521 bits")
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return err
+		}
+		public, _ = sshPublicKeyBlob(&key.PublicKey)
+		private = append(public[:len(public):len(public)], wireMPInt(key.D)...)
+	default:
+		return fmt.Errorf("unsupported key type %q, use ed25519, ecdsa or rsa", keyType)
+	}
+
+	comment := currentActor()
+	if host, err := os.Hostname(); err == nil {
+		comment += "@" + host
+	}
+	check := make([]byte, 8)
+	if _, err := rand.Read(check[:4]); err != nil {
+		return err
+	}
+	copy(check[4:], check[:4])
+	section := append(check, private...)
+	section = append(section, wireString([]byte(comment))...)
+	for i := byte(1); len(section)%8 != 0; i++ {
+		section = append(section, i)
+	}
+	data := []byte("openssh-key-v1\x00")
+	for _, field := range []string{"none", "none", ""} {
+		data = append(data, wireString([]byte(field))...)
+	}
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = append(data, wireString(public)...)
+	data = append(data, wireString(section)...)
+
+	if err := writeNewFile(path, pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}), 0600); err != nil {
+		return err
+	}
+	key := &publicKey{Type: (&wireReader{buf: public}).string(), Blob: public, Comment: comment}
+	return writeNewFile(path+".pub", []byte(key.String()+"\n"), 0644)
+}
+
+// writeNewFile writes a file that must not exist yet.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// wireMPInt encodes n as an SSH mpint.
+func wireMPInt(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return wireString(b)
+}
+
+// sshPublicKeyBlob encodes a crypto public key in the SSH wire format.
+func sshPublicKeyBlob(key interface{}) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		blob := wireString([]byte("ssh-rsa"))
+		blob = append(blob, wireMPInt(big.NewInt(int64(key.E)))...)
+		return append(blob, wireMPInt(key.N)...), nil
+	case *ecdsa.PublicKey:
+		curve := map[int]string{256: "nistp256", 384: "nistp384", 521: "nistp521"}[key.Curve.Params().BitSize]
+		if curve == "" {
+			return nil, fmt.Errorf("unsupported ecdsa curve %s", key.Curve.Params().Name)
+		}
+		blob := wireString([]byte("ecdsa-sha2-" + curve))
+		blob = append(blob, wireString([]byte(curve))...)
+		return append(blob, wireString(elliptic.Marshal(key.Curve, key.X, key.Y))...), nil
+	case ed25519.PublicKey:
+		return append(wireString([]byte("ssh-ed25519")), wireString(key)...), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// privateKeyPublicBlob returns the SSH public key blob of a private key
+// file. OpenSSH keys store it unencrypted; unencrypted PEM keys are
+// decoded. ok is false when the file does not reveal its public key, such
+// as an encrypted PEM key.
+func privateKeyPublicBlob(fileName string) (blob []byte, ok bool, err error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, false, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, false, nil
+	}
+	switch block.Type {
+	case "OPENSSH PRIVATE KEY":
+		magic := []byte("openssh-key-v1\x00")
+		if !bytes.HasPrefix(block.Bytes, magic) {
+			return nil, false, fmt.Errorf("%s: invalid OpenSSH private key", fileName)
+		}
+		r := &wireReader{buf: block.Bytes[len(magic):]}
+		r.bytes() // cipher
+		r.bytes() // kdf
+		r.bytes() // kdf options
+		if n := r.uint32(); r.err == nil && n != 1 {
+			return nil, false, nil
+		}
+		blob := r.bytes()
+		if r.err != nil {
+			return nil, false, fmt.Errorf("%s: invalid OpenSSH private key: %v", fileName, r.err)
+		}
+		return blob, true, nil
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+		if _, encrypted := block.Headers["DEK-Info"]; encrypted {
+			return nil, false, nil
+		}
+		var key interface{}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", fileName, err)
+		}
+		signer, isSigner := key.(crypto.Signer)
+		if !isSigner {
+			return nil, false, nil
+		}
+		blob, err := sshPublicKeyBlob(signer.Public())
+		return blob, err == nil, err
+	}
+	return nil, false, nil
+}
+
+// checkKeyPair fails when the private key file does not belong to the public
+// key being copied. Private keys that do not reveal their public key are not
+// checked.
+func checkKeyPair(privateFile, keyData string) error {
+	blob, ok, err := privateKeyPublicBlob(privateFile)
+	if err != nil || !ok {
+		return err
+	}
+	_, key, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(blob, key.Blob) {
+		private := &publicKey{Type: (&wireReader{buf: blob}).string(), Blob: blob}
+		return fmt.Errorf("%s is the private key of %s, not of the public key %s being copied", privateFile, private.Fingerprint(), key.Fingerprint())
+	}
+	return nil
+}
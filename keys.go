@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// publicKey is a single OpenSSH public key line.
+type publicKey struct {
+	Type    string
+	Blob    []byte
+	Comment string
+}
+
+func parsePublicKey(line string) (*publicKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid public key line")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 key data: %v", err)
+	}
+	return &publicKey{Type: fields[0], Blob: blob, Comment: strings.Join(fields[2:], " ")}, nil
+}
+
+// Fingerprint returns the key fingerprint in the format of ssh-keygen -l.
+func (k *publicKey) Fingerprint() string {
+	sum := sha256.Sum256(k.Blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// FingerprintMD5 returns the legacy colon separated MD5 fingerprint many
+// provider APIs still use.
+func (k *publicKey) FingerprintMD5() string {
+	sum := md5.Sum(k.Blob)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func (k *publicKey) String() string {
+	line := k.Type + " " + base64.StdEncoding.EncodeToString(k.Blob)
+	if k.Comment != "" {
+		line += " " + k.Comment
+	}
+	return line
+}
+
+// isKeyType reports whether s names an OpenSSH public key or certificate
+// algorithm.
+func isKeyType(s string) bool {
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-sha2-") || strings.HasPrefix(s, "sk-")
+}
+
+// splitOptions separates the leading options of an authorized_keys line from
+// the key. Options end at the first whitespace outside double quotes.
+func splitOptions(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if fields := strings.Fields(line); len(fields) == 0 || isKeyType(fields[0]) {
+		return "", line
+	}
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+	return line, ""
+}
+
+// parseAuthorizedKey parses an authorized_keys line and returns its options
+// and key.
+func parseAuthorizedKey(line string) (string, *publicKey, error) {
+	options, rest := splitOptions(line)
+	key, err := parsePublicKey(rest)
+	return options, key, err
+}
+
+// sameKey reports whether two keys have the same algorithm and key material,
+// ignoring comments.
+func sameKey(a, b *publicKey) bool {
+	return a.Type == b.Type && string(a.Blob) == string(b.Blob)
+}
+
+// readPublicKeys reads every key from a file in authorized_keys format,
+// skipping blank lines and comments.
+func readPublicKeys(fileName string) ([]*publicKey, error) {
+	text, err := readKeyText(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*publicKey
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parsePublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, lineNo, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// authorizedKeysOptions are the options sshd(8) accepts in authorized_keys,
+// mapped to whether they take a quoted value.
+var authorizedKeysOptions = map[string]bool{
+	"agent-forwarding": false, "cert-authority": false, "command": true, "environment": true,
+	"expiry-time": true, "from": true, "no-agent-forwarding": false, "no-port-forwarding": false,
+	"no-pty": false, "no-user-rc": false, "no-x11-forwarding": false, "permitlisten": true,
+	"permitopen": true, "port-forwarding": false, "principals": true, "pty": false,
+	"no-touch-required": false, "verify-required": false, "restrict": false, "tunnel": true,
+	"user-rc": false, "x11-forwarding": false,
+}
+
+// validateOptions checks the syntax of the options of an authorized_keys
+// line, reporting 1-based columns.
+func validateOptions(options string) error {
+	start := 0
+	for start < len(options) {
+		i := start
+		for i < len(options) && options[i] != '=' && options[i] != ',' {
+			i++
+		}
+		name := strings.ToLower(options[start:i])
+		quoted, known := authorizedKeysOptions[name]
+		if !known {
+			return fmt.Errorf("unknown option %q at column %d", options[start:i], start+1)
+		}
+		if i < len(options) && options[i] == '=' {
+			if !quoted {
+				return fmt.Errorf("option %s takes no value, at column %d", name, i+1)
+			}
+			i++
+			if i >= len(options) || options[i] != '"' {
+				return fmt.Errorf("value of option %s must be quoted, at column %d", name, i+1)
+			}
+			for i++; i < len(options) && (options[i] != '"' || options[i-1] == '\\'); i++ {
+			}
+			if i >= len(options) {
+				return fmt.Errorf("unterminated quote in option %s at column %d", name, len(options)+1)
+			}
+			i++
+		} else if quoted {
+			return fmt.Errorf("option %s requires a value, at column %d", name, i+1)
+		}
+		if i < len(options) && options[i] != ',' {
+			return fmt.Errorf("expected , after option %s at column %d", name, i+1)
+		}
+		start = i + 1
+	}
+	return nil
+}
+
+// validateKeyLine checks an authorized_keys line the way sshd parses it and
+// describes the first problem with its 1-based column.
+func validateKeyLine(line string) error {
+	line = strings.TrimRight(line, " \t")
+	trimmed := strings.TrimLeft(line, " \t")
+	offset := len(line) - len(trimmed)
+	options, rest := splitOptions(trimmed)
+	if options != "" {
+		if err := validateOptions(options); err != nil {
+			return err
+		}
+	}
+	offset += strings.Index(trimmed[len(options):], rest) + len(options)
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return fmt.Errorf("missing key after options")
+	}
+	if !isKeyType(fields[0]) {
+		return fmt.Errorf("unknown key type %q at column %d", fields[0], offset+1)
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("missing base64 key data after %s at column %d", fields[0], offset+len(fields[0])+1)
+	}
+	column := offset + strings.Index(rest, fields[1]) + 1
+	data := fields[1]
+	for i, c := range data {
+		isBase64 := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '+' || c == '/'
+		if c == '=' && i >= len(data)-2 {
+			continue
+		}
+		if !isBase64 {
+			return fmt.Errorf("invalid base64 character %q at column %d", c, column+i)
+		}
+	}
+	if len(data)%4 != 0 {
+		return fmt.Errorf("truncated base64 at column %d", column+len(data))
+	}
+	key, err := parsePublicKey(rest)
+	if err != nil {
+		return err
+	}
+	if blobType := (&wireReader{buf: key.Blob}).string(); blobType != key.Type {
+		return fmt.Errorf("key type %s does not match the key data, which is %q", key.Type, blobType)
+	}
+	if !strings.Contains(key.Type, "-cert-") && !strings.HasPrefix(key.Type, "sk-") {
+		if _, err := key.cryptoKey(); err != nil && key.Type != "ssh-dss" {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func defaultKnownHostsFile() string {
+	dirname, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dirname, ".ssh", "known_hosts")
+}
+
+// matchHashedHost checks a |1|salt|hash entry against a host name.
+func matchHashedHost(entry, host string) bool {
+	parts := strings.Split(entry, "|")
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+	salt, err1 := base64.StdEncoding.DecodeString(parts[2])
+	hash, err2 := base64.StdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// splitKnownHost splits a known_hosts name, which may be in [host]:port
+// form.
+func splitKnownHost(name string) (string, int) {
+	if strings.HasPrefix(name, "[") {
+		if host, port, err := net.SplitHostPort(name); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				return host, p
+			}
+		}
+	}
+	return name, 0
+}
+
+// knownHostsTargets returns the hosts of a known_hosts file matching
+// pattern. Hashed entries can only be matched against a literal pattern.
+func knownHostsTargets(fileName, pattern string, targets map[string]targetConfig) ([]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	literal := pattern != "" && !strings.ContainsAny(pattern, "*?")
+	var hosts []string
+	hashed := 0
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+			continue
+		}
+		for _, name := range strings.Split(fields[0], ",") {
+			if strings.HasPrefix(name, "|") {
+				if literal && matchHashedHost(name, pattern) && !seen[pattern] {
+					seen[pattern] = true
+					hosts = append(hosts, pattern)
+				} else if !literal {
+					hashed++
+				}
+				continue
+			}
+			if strings.HasPrefix(name, "!") || strings.ContainsAny(name, "*?") {
+				continue
+			}
+			host, port := splitKnownHost(name)
+			if pattern != "" {
+				if ok, _ := path.Match(pattern, host); !ok {
+					continue
+				}
+			}
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+			if port != 0 && port != 22 {
+				targets[host] = targetConfig{Port: port}
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if hashed > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d hashed entries of %s, give an exact host name to match them\n", hashed, fileName)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts of %s match %q", fileName, pattern)
+	}
+	return hosts, nil
+}
+
+// knownHostName returns the known_hosts name of a [user@]hostname target,
+// its HostKeyAlias if the ssh configuration sets one.
+func knownHostName(target string) string {
+	host, port := hostPort(target)
+	if alias := resolveSSHConfig(target).Get("HostKeyAlias"); alias != "" {
+		host = alias
+	}
+	if port != 22 {
+		return fmt.Sprintf("[%s]:%d", host, port)
+	}
+	return host
+}
+
+// matchKnownHostLine reports whether a known_hosts line names name, in
+// plain or hashed form, and returns its key type and base64 key. Lines with
+// a marker such as @revoked or @cert-authority never match: they are not
+// host keys, and like ssh-keygen -R removal keeps them.
+func matchKnownHostLine(line, name string) ([]string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+		return nil, false
+	}
+	for _, n := range strings.Split(fields[0], ",") {
+		if strings.EqualFold(n, name) || matchHashedHost(n, name) {
+			return fields[1:3], true
+		}
+	}
+	return nil, false
+}
+
+// knownHostKeys returns the "type base64" host keys known_hosts lists for
+// name.
+func knownHostKeys(fileName, name string) []string {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+	var keys []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if key, ok := matchKnownHostLine(line, name); ok {
+			keys = append(keys, strings.Join(key, " "))
+		}
+	}
+	return keys
+}
+
+// removeKnownHost removes the lines naming name, in plain or hashed form,
+// from a known_hosts file like ssh-keygen -R and keeps the previous file as
+// .old. It returns the number of removed lines.
+func removeKnownHost(fileName, name string) (int, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	var kept bytes.Buffer
+	removed := 0
+	for _, line := range strings.SplitAfter(string(buf), "\n") {
+		if _, ok := matchKnownHostLine(line, name); ok {
+			removed++
+			continue
+		}
+		kept.WriteString(line)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := os.WriteFile(fileName+".old", buf, 0600); err != nil {
+		return 0, err
+	}
+	return removed, os.WriteFile(fileName, kept.Bytes(), 0600)
+}
+
+// hostKeyRefreshRunner handles changed host keys, as after a reinstall: it
+// shows the new host keys, offers to remove the stale known_hosts entries
+// and then retries, letting ssh ask to accept the new key.
+type hostKeyRefreshRunner struct {
+	Runner
+	KnownHosts string
+	mu         sync.Mutex
+}
+
+func (r *hostKeyRefreshRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	result, err := r.Runner.Run(ctx, host, command)
+	if err == nil || !bytes.Contains(result.Stderr, []byte("REMOTE HOST IDENTIFICATION HAS CHANGED")) {
+		return result, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := knownHostName(host)
+	_, hostname := splitUserHost(host)
+	port := 22
+	if _, p := splitKnownHost(name); p != 0 {
+		port = p
+	}
+	fmt.Fprintf(os.Stderr, "The host key of %s changed, it now offers:\n", name)
+	for _, fingerprint := range hostKeyFingerprints(hostname, port) {
+		fmt.Fprintf(os.Stderr, "\t%s\n", fingerprint)
+	}
+	if !confirm(fmt.Sprintf("Remove the stale entries of %s from %s and retry?", name, r.KnownHosts)) {
+		return result, err
+	}
+	if _, rerr := removeKnownHost(r.KnownHosts, name); rerr != nil {
+		return result, fmt.Errorf("%v, removing the stale host key failed: %v", err, rerr)
+	}
+	return r.Runner.Run(ctx, host, command)
+}
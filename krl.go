@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Section types of the OpenSSH key revocation list format, see PROTOCOL.krl.
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+var krlMagic = []byte("SSHKRL\n\x00")
+
+type (
+	// krl is a key revocation list as written by ssh-keygen -k.
+	krl struct {
+		keys   map[string]bool
+		sha1   map[string]bool
+		sha256 map[string]bool
+		certs  []*krlCertificates
+	}
+
+	// krlCertificates revokes certificates of one CA, or of any CA when CA
+	// is empty.
+	krlCertificates struct {
+		CA      []byte
+		Ranges  [][2]uint64
+		Bitmaps []krlBitmap
+		KeyIDs  map[string]bool
+	}
+
+	krlBitmap struct {
+		Offset uint64
+		Bits   *big.Int
+	}
+
+	// sshCertificate holds the parts of an OpenSSH certificate KRLs refer to.
+	sshCertificate struct {
+		Key      *publicKey
+		Serial   uint64
+		KeyID    string
+		SignedBy []byte
+	}
+)
+
+// certKeyFields is the number of key fields following the nonce in the
+// certificates of each key type.
+var certKeyFields = map[string]int{
+	"ssh-rsa":                            2,
+	"ssh-dss":                            4,
+	"ecdsa-sha2-nistp256":                2,
+	"ecdsa-sha2-nistp384":                2,
+	"ecdsa-sha2-nistp521":                2,
+	"ssh-ed25519":                        1,
+	"sk-ecdsa-sha2-nistp256@openssh.com": 3,
+	"sk-ssh-ed25519@openssh.com":         2,
+}
+
+// parseSSHCertificate decodes a certificate key blob.
+func parseSSHCertificate(blob []byte) (*sshCertificate, error) {
+	r := &wireReader{buf: blob}
+	certType := r.string()
+	keyType := strings.Replace(certType, "-cert-v01@openssh.com", "", 1)
+	if strings.HasPrefix(keyType, "sk-") {
+		keyType += "@openssh.com"
+	}
+	fields, ok := certKeyFields[keyType]
+	if !ok || keyType == certType {
+		return nil, fmt.Errorf("unsupported certificate type %s", certType)
+	}
+	r.bytes() // nonce
+	start := r.buf
+	for i := 0; i < fields; i++ {
+		r.bytes()
+	}
+	keyBlob := append(wireString([]byte(keyType)), start[:len(start)-len(r.buf)]...)
+	cert := &sshCertificate{Key: &publicKey{Type: keyType, Blob: keyBlob}, Serial: r.uint64()}
+	r.uint32() // type
+	cert.KeyID = r.string()
+	r.bytes() // principals
+	r.uint64()
+	r.uint64()
+	r.bytes() // critical options
+	r.bytes() // extensions
+	r.bytes() // reserved
+	cert.SignedBy = r.bytes()
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid %s certificate: %v", certType, r.err)
+	}
+	return cert, nil
+}
+
+// readKRL reads a binary KRL. Its signature sections, if any, are not
+// verified.
+func readKRL(fileName string) (*krl, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(buf, krlMagic) {
+		return nil, fmt.Errorf("%s is not a binary KRL", fileName)
+	}
+	r := &wireReader{buf: buf[len(krlMagic):]}
+	if version := r.uint32(); r.err == nil && version != 1 {
+		return nil, fmt.Errorf("%s: unsupported KRL format version %d", fileName, version)
+	}
+	r.uint64() // krl version
+	r.uint64() // generated date
+	r.uint64() // flags
+	r.bytes()  // reserved
+	r.bytes()  // comment
+	l := &krl{keys: map[string]bool{}, sha1: map[string]bool{}, sha256: map[string]bool{}}
+	for r.err == nil && len(r.buf) > 0 {
+		sectionType := r.fixed(1)
+		section := &wireReader{buf: r.bytes()}
+		if r.err != nil {
+			break
+		}
+		switch sectionType[0] {
+		case krlSectionCertificates:
+			certs, err := parseKRLCertificates(section)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+			l.certs = append(l.certs, certs)
+		case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+			set := map[byte]map[string]bool{krlSectionExplicitKey: l.keys, krlSectionFingerprintSHA1: l.sha1, krlSectionFingerprintSHA256: l.sha256}[sectionType[0]]
+			for len(section.buf) > 0 && section.err == nil {
+				set[string(section.bytes())] = true
+			}
+			r.err = section.err
+		case krlSectionSignature:
+			return l, nil
+		default:
+			return nil, fmt.Errorf("%s: unknown KRL section type %d", fileName, sectionType[0])
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%s: invalid KRL: %v", fileName, r.err)
+	}
+	return l, nil
+}
+
+func parseKRLCertificates(r *wireReader) (*krlCertificates, error) {
+	certs := &krlCertificates{CA: r.bytes(), KeyIDs: map[string]bool{}}
+	r.bytes() // reserved
+	for r.err == nil && len(r.buf) > 0 {
+		subType := r.fixed(1)
+		sub := &wireReader{buf: r.bytes()}
+		if r.err != nil {
+			break
+		}
+		switch subType[0] {
+		case krlCertSerialList:
+			for len(sub.buf) > 0 && sub.err == nil {
+				serial := sub.uint64()
+				certs.Ranges = append(certs.Ranges, [2]uint64{serial, serial})
+			}
+		case krlCertSerialRange:
+			certs.Ranges = append(certs.Ranges, [2]uint64{sub.uint64(), sub.uint64()})
+		case krlCertSerialBitmap:
+			certs.Bitmaps = append(certs.Bitmaps, krlBitmap{Offset: sub.uint64(), Bits: sub.mpint()})
+		case krlCertKeyID:
+			for len(sub.buf) > 0 && sub.err == nil {
+				certs.KeyIDs[sub.string()] = true
+			}
+		default:
+			return nil, fmt.Errorf("unknown KRL certificate section type %#x", subType[0])
+		}
+		if sub.err != nil {
+			return nil, fmt.Errorf("invalid KRL certificate section: %v", sub.err)
+		}
+	}
+	return certs, r.err
+}
+
+func (l *krl) keyRevoked(blob []byte) bool {
+	sum1 := sha1.Sum(blob)
+	sum256 := sha256.Sum256(blob)
+	return l.keys[string(blob)] || l.sha1[string(sum1[:])] || l.sha256[string(sum256[:])]
+}
+
+func (c *krlCertificates) revokes(cert *sshCertificate) bool {
+	if len(c.CA) > 0 && !bytes.Equal(c.CA, cert.SignedBy) {
+		return false
+	}
+	if c.KeyIDs[cert.KeyID] {
+		return true
+	}
+	for _, r := range c.Ranges {
+		if cert.Serial >= r[0] && cert.Serial <= r[1] {
+			return true
+		}
+	}
+	for _, b := range c.Bitmaps {
+		if cert.Serial >= b.Offset && cert.Serial-b.Offset < uint64(b.Bits.BitLen()) && b.Bits.Bit(int(cert.Serial-b.Offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked reports whether the KRL revokes key. Certificates are also revoked
+// by their key, their CA key or their serial or key ID.
+func (l *krl) Revoked(key *publicKey) bool {
+	if l.keyRevoked(key.Blob) {
+		return true
+	}
+	if !strings.Contains(key.Type, "-cert-") {
+		return false
+	}
+	cert, err := parseSSHCertificate(key.Blob)
+	if err != nil {
+		return false
+	}
+	if l.keyRevoked(cert.Key.Blob) || l.keyRevoked(cert.SignedBy) {
+		return true
+	}
+	for _, certs := range l.certs {
+		if certs.revokes(cert) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// localTarget is an authorized_keys file on a locally mounted filesystem.
+// UID and GID are the owner to give new files, -1 keeps the current user.
+type localTarget struct {
+	Path string
+	UID  int
+	GID  int
+}
+
+// lookupChrootUser finds the home directory and ids of user in the
+// /etc/passwd of the filesystem mounted at root.
+func lookupChrootUser(root, user string) (localTarget, error) {
+	file, err := os.Open(filepath.Join(root, "etc", "passwd"))
+	if err != nil {
+		return localTarget{}, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 6 || fields[0] != user {
+			continue
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return localTarget{}, fmt.Errorf("invalid passwd entry for %s", user)
+		}
+		return localTarget{Path: filepath.Join(root, fields[5], ".ssh", "authorized_keys"), UID: uid, GID: gid}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return localTarget{}, err
+	}
+	return localTarget{}, fmt.Errorf("user %s not found in %s/etc/passwd", user, root)
+}
+
+func resolveLocalTarget() (localTarget, error) {
+	if pCommandLineArgs.LocalPath != "" {
+		return localTarget{Path: pCommandLineArgs.LocalPath, UID: -1, GID: -1}, nil
+	}
+	if pCommandLineArgs.LocalUser == "" {
+		return localTarget{}, fmt.Errorf("chroot requires a user")
+	}
+	return lookupChrootUser(pCommandLineArgs.Chroot, pCommandLineArgs.LocalUser)
+}
+
+func (t localTarget) chown(path string) error {
+	if t.UID < 0 {
+		return nil
+	}
+	return os.Lchown(path, t.UID, t.GID)
+}
+
+// install adds line to the authorized_keys file with the same semantics as
+// the remote install command: the .ssh directory and the file are created
+// with restrictive permissions and an existing key is not added again
+// unless force is set.
+func (t localTarget) install(line string, force bool) (string, error) {
+	dir := filepath.Dir(t.Path)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return statusFailed, err
+		}
+		if err := t.chown(dir); err != nil {
+			return statusFailed, err
+		}
+	}
+	content, err := os.ReadFile(t.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return statusFailed, err
+	}
+	isNew := os.IsNotExist(err)
+	if !force {
+		_, key, err := parseAuthorizedKey(line)
+		if err != nil {
+			return statusFailed, err
+		}
+		if hp := diffAuthorizedKeys(t.Path, content, []*publicKey{key}, nil); len(hp.Add) == 0 {
+			return statusExists, nil
+		}
+	}
+	file, err := os.OpenFile(t.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return statusFailed, err
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		line = "\n" + line
+	}
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		file.Close()
+		return statusFailed, err
+	}
+	if err := file.Close(); err != nil {
+		return statusFailed, err
+	}
+	if err := os.Chmod(t.Path, 0600); err != nil {
+		return statusFailed, err
+	}
+	if isNew {
+		if err := t.chown(t.Path); err != nil {
+			return statusFailed, err
+		}
+	}
+	return statusInstalled, nil
+}
+
+// installLocal runs the install against the local filesystem and reports it
+// like a host of a fleet run.
+func installLocal(line string, force bool) hostResult {
+	t, err := resolveLocalTarget()
+	if err != nil {
+		return hostResult{Host: "local", Status: statusFailed, ExitCode: 1, Error: err.Error()}
+	}
+	r := hostResult{Host: t.Path}
+	r.Status, err = t.install(line, force)
+	switch {
+	case err != nil:
+		r.ExitCode, r.Error = 1, err.Error()
+	case r.Status == statusExists:
+		r.ExitCode = exitKeyExists
+	}
+	return r
+}
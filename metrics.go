@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the per-host latency
+// histogram.
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// fleetMetrics collects counters about key copies and exposes them in the
+// Prometheus text format.
+type fleetMetrics struct {
+	mu             sync.Mutex
+	attempted      uint64
+	succeeded      uint64
+	alreadyPresent uint64
+	failed         uint64
+	authFailures   uint64
+	latencyCounts  []uint64
+	latencySum     float64
+}
+
+var metrics = &fleetMetrics{latencyCounts: make([]uint64, len(latencyBuckets))}
+
+func (m *fleetMetrics) Observe(r hostResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attempted++
+	switch r.Status {
+	case statusInstalled:
+		m.succeeded++
+	case statusExists:
+		m.alreadyPresent++
+	case statusFailed:
+		m.failed++
+	}
+	if r.AuthFailure {
+		m.authFailures++
+	}
+	for i, bound := range latencyBuckets {
+		if r.Seconds <= bound {
+			m.latencyCounts[i]++
+		}
+	}
+	m.latencySum += r.Seconds
+}
+
+func (m *fleetMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	counter("ssh_copy_id_copies_attempted_total", "Number of hosts a key copy was attempted on.", m.attempted)
+	counter("ssh_copy_id_copies_succeeded_total", "Number of hosts the key was installed on.", m.succeeded)
+	counter("ssh_copy_id_copies_already_present_total", "Number of hosts that already had the key.", m.alreadyPresent)
+	counter("ssh_copy_id_copies_failed_total", "Number of hosts the copy failed on.", m.failed)
+	counter("ssh_copy_id_auth_failures_total", "Number of hosts that rejected authentication.", m.authFailures)
+
+	name := "ssh_copy_id_host_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent copying the key to a single host.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, m.latencyCounts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, m.attempted, name, m.latencySum, name, m.attempted)
+}
+
+// serveMetrics exposes the metrics on addr in the background.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "metrics endpoint on %s failed: %v\n", addr, err)
+		}
+	}()
+}
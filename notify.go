@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runSummary describes a completed run. Text carries a human readable line
+// so Slack and Teams incoming webhooks can display the payload directly.
+type runSummary struct {
+	Text         string         `json:"text"`
+	Time         time.Time      `json:"time"`
+	Fingerprints []string       `json:"fingerprints"`
+	Hosts        []string       `json:"hosts"`
+	Counts       map[string]int `json:"counts"`
+	Results      []hostResult   `json:"results"`
+}
+
+func newRunSummary(fingerprints []string, results []hostResult) runSummary {
+	summary := runSummary{
+		Time:         time.Now().UTC(),
+		Fingerprints: fingerprints,
+		Hosts:        make([]string, len(results)),
+		Counts:       map[string]int{},
+		Results:      results,
+	}
+	for i, r := range results {
+		summary.Hosts[i] = r.Host
+		summary.Counts[r.Status]++
+	}
+	hostName, _ := os.Hostname()
+	summary.Text = fmt.Sprintf("ssh-copy-id on %s: %v to %d hosts: %d installed, %d already present, %d failed",
+		hostName, fingerprints, len(results), summary.Counts[statusInstalled], summary.Counts[statusExists], summary.Counts[statusFailed])
+	return summary
+}
+
+func notifyWebhook(url string, summary runSummary) error {
+	buf, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// openstackKeypair creates the Nova keypair with the openstack client, which
+// authenticates from the OS_* environment. Keypairs cannot be modified, so a
+// keypair of the same name with a different key is replaced.
+func openstackKeypair(key *publicKey, name string) (string, error) {
+	if os.Getenv("OS_AUTH_URL") == "" && os.Getenv("OS_CLOUD") == "" {
+		return "", fmt.Errorf("no OpenStack credentials, source an openrc file or set OS_CLOUD")
+	}
+	action := "created"
+	fingerprint, err := runCLI("openstack", "keypair", "show", name, "-f", "value", "-c", "fingerprint")
+	if err == nil {
+		if fingerprint == key.FingerprintMD5() {
+			return fmt.Sprintf("already registered as keypair %q", name), nil
+		}
+		if _, err := runCLI("openstack", "keypair", "delete", name); err != nil {
+			return "", err
+		}
+		action = "replaced"
+	}
+	keyFile, cleanup, err := writeTempKeyFile(key)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if _, err := runCLI("openstack", "keypair", "create", "--public-key", keyFile, name); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s keypair %q", action, name), nil
+}
+
+func init() {
+	keyBackends["openstack"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.OpenStack },
+		Upload:  openstackKeypair,
+	}
+}
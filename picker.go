@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyCandidate is a local key pair the picker offers.
+type keyCandidate struct {
+	File     string // the private key
+	Key      *publicKey
+	Modified time.Time
+}
+
+// localKeyCandidates returns the key pairs in dir, .pub files with the
+// private key next to them, of the -key-type types. The files are sorted by
+// name.
+func localKeyCandidates(dir string) []keyCandidate {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pub"))
+	var candidates []keyCandidate
+	for _, pubFile := range files {
+		file := strings.TrimSuffix(pubFile, ".pub")
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		info, err := os.Stat(pubFile)
+		if err != nil {
+			continue
+		}
+		keys, err := readPublicKeys(pubFile)
+		if err != nil || len(keys) != 1 || !wantedKeyType(keys[0]) {
+			continue
+		}
+		candidates = append(candidates, keyCandidate{File: file, Key: keys[0], Modified: info.ModTime()})
+	}
+	return candidates
+}
+
+// keyAge describes how long ago t was, coarsely.
+func keyAge(t time.Time) string {
+	switch d := time.Since(t); {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	case d >= 2*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return "less than 2 hours"
+	}
+}
+
+// pickIdentity lists the candidates on the terminal and returns the private
+// key file of the one chosen.
+func pickIdentity(candidates []keyCandidate) (string, error) {
+	fmt.Fprintf(os.Stderr, "Several keys were found, -i selects one without asking:\n")
+	for i, c := range candidates {
+		fmt.Fprintf(os.Stderr, "  %d) %s  %s %s %s, %s old\n", i+1, c.File, keyTypeName(c.Key.Type), c.Key.Fingerprint(), c.Key.Comment, keyAge(c.Modified))
+	}
+	fmt.Fprintf(os.Stderr, "Key to copy [1-%d]: ", len(candidates))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	n, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || n < 1 || n > len(candidates) {
+		return "", fmt.Errorf("no key chosen")
+	}
+	return candidates[n-1].File, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	// hostPlan lists the exact authorized_keys lines to add to and remove
+	// from a host. Remove holds the lines as they are in the file, trailing
+	// spaces or CR included, so they match exactly.
+	hostPlan struct {
+		Host   string   `json:"host"`
+		Add    []string `json:"add,omitempty"`
+		Remove []string `json:"remove,omitempty"`
+	}
+
+	changePlan struct {
+		Created time.Time  `json:"created"`
+		Hosts   []hostPlan `json:"hosts"`
+	}
+)
+
+func (hp hostPlan) empty() bool {
+	return len(hp.Add) == 0 && len(hp.Remove) == 0
+}
+
+// diffAuthorizedKeys compares the remote authorized_keys content with the
+// keys that should be present and absent.
+func diffAuthorizedKeys(host string, remote []byte, add, remove []*publicKey) hostPlan {
+	hp := hostPlan{Host: host}
+	var present []*publicKey
+	for _, raw := range strings.Split(string(remote), "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, key, err := parseAuthorizedKey(line)
+		if err != nil {
+			continue
+		}
+		present = append(present, key)
+		for _, r := range remove {
+			if sameKey(key, r) {
+				hp.Remove = append(hp.Remove, raw)
+				break
+			}
+		}
+	}
+	for _, a := range add {
+		found := false
+		for _, key := range present {
+			if sameKey(key, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			hp.Add = append(hp.Add, a.String())
+		}
+	}
+	return hp
+}
+
+// applyCommand performs the changes of a host plan in a single session. It
+// exits with exitKeyNotFound, changing nothing, when a line to remove is no
+// longer present, and fails when one is still present afterwards.
+func applyCommand(hp hostPlan) string {
+	command := "mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys"
+	for _, line := range hp.Remove {
+		command += fmt.Sprintf(" && { LC_ALL=C grep -q -x -F -e %s ~/.ssh/authorized_keys || exit %d; }", shellQuote(line), exitKeyNotFound)
+	}
+	if len(hp.Remove) > 0 {
+		command += "; " + filterCommand(hp.Remove)
+		command += fmt.Sprintf("; if LC_ALL=C grep -q -x -F%s ~/.ssh/authorized_keys; then echo 'lines to remove are still present' >&2; exit 1; fi", grepPatterns(hp.Remove))
+	}
+	for _, line := range hp.Add {
+		command += fmt.Sprintf("; LC_ALL=C grep -q -x -F -e %s ~/.ssh/authorized_keys || %s", shellQuote(line), appendLineCommand(line, "~/.ssh/authorized_keys"))
+	}
+	return command
+}
+
+// maxCommandLength is the length up to which applyPlan sends the changes
+// within the remote command, well below the 128 KiB Linux allows for an
+// argument. Longer plans, e.g. a large team manifest, are streamed to
+// mergeCommand.
+const maxCommandLength = 16 * 1024
+
+// mergeCommand applies the changes read from stdin, lines of "+ line" to add
+// and "- line" to remove, like applyCommand in a single pass over
+// authorized_keys, also exiting with exitKeyNotFound when a line to remove
+// is no longer present.
+const mergeCommand = `mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys || exit 1
+f=~/.ssh/authorized_keys; LC_ALL=C awk '
+FNR == NR { if (sub(/^- /, "")) drop[$0] = 1; else if (sub(/^[+] /, "")) add[++n] = $0; next }
+$0 in drop { gone[$0] = 1; next }
+{ have[$0] = 1; print }
+END { for (l in drop) if (!(l in gone)) exit 3; for (i = 1; i <= n; i++) if (!(add[i] in have)) { have[add[i]] = 1; print add[i] } }' - "$f" > "$f.tmp"
+rc=$?; if [ $rc -ne 0 ]; then rm -f "$f.tmp"; [ $rc -eq 3 ] && exit 202; exit 1; fi
+cat "$f.tmp" > "$f" && rm -f "$f.tmp"`
+
+// mergeInput returns the input of mergeCommand for hp.
+func mergeInput(hp hostPlan) []byte {
+	var buf bytes.Buffer
+	for _, line := range hp.Remove {
+		fmt.Fprintf(&buf, "- %s\n", line)
+	}
+	for _, line := range hp.Add {
+		fmt.Fprintf(&buf, "+ %s\n", line)
+	}
+	return buf.Bytes()
+}
+
+func describeLine(line string) string {
+	line = strings.TrimSpace(line)
+	if _, key, err := parseAuthorizedKey(line); err == nil {
+		return strings.TrimSpace(key.Fingerprint() + " " + key.Comment)
+	}
+	return line
+}
+
+func (p *changePlan) print() {
+	for _, hp := range p.Hosts {
+		if hp.empty() {
+			fmt.Printf("%s: no changes\n", hp.Host)
+			continue
+		}
+		fmt.Printf("%s:\n", hp.Host)
+		for _, line := range hp.Remove {
+			fmt.Printf("\t\033[31m- %s\033[0m\n", describeLine(line))
+		}
+		for _, line := range hp.Add {
+			fmt.Printf("\t\033[32m+ %s\033[0m\n", describeLine(line))
+		}
+	}
+}
+
+// fetchAuthorizedKeys reads the authorized_keys of every host without
+// changing anything. Hosts that could not be read are reported and omitted.
+func fetchAuthorizedKeys(ctx context.Context, hosts []string) (map[string][]byte, int) {
+	f := &fleet{Runner: newRunner(nil, os.Stderr), Parallel: pCommandLineArgs.Parallel}
+	contents := map[string][]byte{}
+	failed := 0
+	for _, r := range f.Run(ctx, hosts, listCommand) {
+		if r.Status == statusFailed {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: Error reading authorized_keys.Reason: %v\n", r.Host, r.Error)
+			continue
+		}
+		contents[r.Host] = r.Output
+	}
+	return contents, failed
+}
+
+func runPlan(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	addConnectionFlags(fs)
+	addPolicyFlags(fs)
+	out := fs.String("out", "plan.json", "File to write the plan to")
+	removeFile := fs.String("remove", "", "Public keys that should be removed from the hosts")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return fmt.Errorf("you must assign a host name")
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	if err := resolveSSHFile(); err != nil {
+		return err
+	}
+	if err := checkKeyPolicy(pCommandLineArgs.KeyData); err != nil {
+		return err
+	}
+	options, key, err := parseAuthorizedKey(pCommandLineArgs.KeyData)
+	if err != nil {
+		return err
+	}
+	var remove []*publicKey
+	if *removeFile != "" {
+		if remove, err = readPublicKeys(*removeFile); err != nil {
+			return err
+		}
+	}
+
+	hosts, err := expandHosts(fs.Args())
+	if err != nil {
+		return err
+	}
+	contents, failed := fetchAuthorizedKeys(context.Background(), hosts)
+	p := &changePlan{Created: time.Now().UTC()}
+	for _, host := range hosts {
+		if remote, ok := contents[host]; ok {
+			hp := diffAuthorizedKeys(host, remote, []*publicKey{key}, remove)
+			if options != "" && len(hp.Add) > 0 {
+				// Add the line with the options of the .pub file.
+				hp.Add = []string{pCommandLineArgs.KeyData}
+			}
+			p.Hosts = append(p.Hosts, hp)
+		}
+	}
+	p.print()
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, buf, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Plan written to %s\n", *out)
+	if failed > 0 {
+		return fmt.Errorf("%d hosts could not be read and are not part of the plan", failed)
+	}
+	return nil
+}
+
+func readPlan(path string) (*changePlan, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(changePlan)
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("invalid plan %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// applyPlan executes the plan and returns the number of failed hosts.
+func applyPlan(ctx context.Context, p *changePlan) int {
+	plans := map[string]hostPlan{}
+	var hosts []string
+	for _, hp := range p.Hosts {
+		plans[hp.Host] = hp
+		hosts = append(hosts, hp.Host)
+	}
+	runner := newRunner(os.Stdout, os.Stderr)
+	_, streams := runner.(inputRunner)
+	stream := func(host string) bool {
+		return streams && len(applyCommand(plans[host])) > maxCommandLength
+	}
+	f := &fleet{
+		Runner:   runner,
+		Parallel: pCommandLineArgs.Parallel,
+		Skip:     func(host string) bool { return plans[host].empty() },
+		Input: func(host string) []byte {
+			if !stream(host) {
+				return nil
+			}
+			return mergeInput(plans[host])
+		},
+	}
+	failed := 0
+	results := f.RunEach(ctx, hosts, func(host string) string {
+		if stream(host) {
+			return mergeCommand
+		}
+		return applyCommand(plans[host])
+	})
+	for _, r := range results {
+		if r.Status == statusInstalled || r.Status == statusFailed {
+			recordChange("install", lineFingerprints(plans[r.Host].Add), []hostResult{r})
+			recordChange("remove", lineFingerprints(plans[r.Host].Remove), []hostResult{r})
+		}
+		switch r.Status {
+		case statusSkipped:
+			fmt.Printf("%s: no changes\n", r.Host)
+		case statusNotFound:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: plan is out of date, lines to remove are no longer present, nothing changed\n", r.Host)
+		case statusFailed:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: Error applying plan.Reason: %v\n", r.Host, r.Error)
+		default:
+			fmt.Printf("%s: %d added, %d removed\n", r.Host, len(plans[r.Host].Add), len(plans[r.Host].Remove))
+		}
+	}
+	return failed
+}
+
+func runApply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	addConnectionFlags(fs)
+	addPolicyFlags(fs)
+	addAuditFlags(fs)
+	planFile := fs.String("plan", "plan.json", "Plan file written by the plan command")
+	fs.Parse(args)
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	p, err := readPlan(*planFile)
+	if err != nil {
+		return err
+	}
+	// The plan may have been edited or written with another policy.
+	for _, hp := range p.Hosts {
+		for _, line := range hp.Add {
+			if err := checkKeyPolicy(line); err != nil {
+				return fmt.Errorf("%s: %v", hp.Host, err)
+			}
+		}
+	}
+	if failed := applyPlan(context.Background(), p); failed > 0 {
+		return fmt.Errorf("plan failed on %d hosts", failed)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["plan"] = subcommand{"Compute the changes of a copy without applying them", runPlan}
+	subcommands["apply"] = subcommand{"Apply a plan written by the plan command", runApply}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rsa"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// deprecatedKeyTypes are refused regardless of their size.
+var deprecatedKeyTypes = map[string]string{
+	"ssh-dss":                      "DSA keys are limited to 1024 bits and disabled in OpenSSH 7.0",
+	"ssh-dss-cert-v01@openssh.com": "DSA keys are limited to 1024 bits and disabled in OpenSSH 7.0",
+	"ssh-rsa1":                     "SSH protocol 1 keys are no longer supported",
+}
+
+// keyTypeFiles maps the -key-type names to the file name ssh uses for a
+// default identity of that type.
+var keyTypeFiles = map[string]string{
+	"ed25519":    "id_ed25519",
+	"ed25519-sk": "id_ed25519_sk",
+	"ecdsa":      "id_ecdsa",
+	"ecdsa-sk":   "id_ecdsa_sk",
+	"rsa":        "id_rsa",
+	"dsa":        "id_dsa",
+}
+
+// keyTypeName returns the -key-type name of a key algorithm, certificates
+// counting as their key's type.
+func keyTypeName(algorithm string) string {
+	algorithm = strings.TrimSuffix(algorithm, "-cert-v01@openssh.com")
+	switch {
+	case algorithm == "ssh-ed25519":
+		return "ed25519"
+	case algorithm == "sk-ssh-ed25519@openssh.com":
+		return "ed25519-sk"
+	case strings.HasPrefix(algorithm, "ecdsa-sha2-"):
+		return "ecdsa"
+	case strings.HasPrefix(algorithm, "sk-ecdsa-sha2-"):
+		return "ecdsa-sk"
+	case algorithm == "ssh-rsa":
+		return "rsa"
+	case algorithm == "ssh-dss":
+		return "dsa"
+	}
+	return algorithm
+}
+
+// keyTypes returns the -key-type list, nil when any type is accepted.
+func (args *commandLineArgs) keyTypes() []string {
+	var types []string
+	for _, name := range strings.Split(args.KeyTypes, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			types = append(types, name)
+		}
+	}
+	return types
+}
+
+// validateKeyTypes checks the names of -key-type.
+func validateKeyTypes() error {
+	for _, name := range pCommandLineArgs.keyTypes() {
+		if _, ok := keyTypeFiles[name]; !ok {
+			return fmt.Errorf("unknown key type %q for -key-type, use ed25519, ed25519-sk, ecdsa, ecdsa-sk, rsa or dsa", name)
+		}
+	}
+	return nil
+}
+
+// wantedKeyType reports whether key is of a -key-type type.
+func wantedKeyType(key *publicKey) bool {
+	types := pCommandLineArgs.keyTypes()
+	if len(types) == 0 {
+		return true
+	}
+	for _, name := range types {
+		if keyTypeName(key.Type) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKeyStrength rejects deprecated key types and RSA keys shorter than
+// minRSABits.
+func checkKeyStrength(key *publicKey, minRSABits int) error {
+	if reason, ok := deprecatedKeyTypes[key.Type]; ok {
+		return fmt.Errorf("%s key refused: %s", key.Type, reason)
+	}
+	if key.Type != "ssh-rsa" && !strings.HasPrefix(key.Type, "ssh-rsa-cert-") {
+		return nil
+	}
+	parsed, err := key.cryptoKey()
+	if err != nil {
+		// Certificates carry the RSA key after a nonce, parsing them is
+		// left to the server.
+		return nil
+	}
+	if bits := parsed.(*rsa.PublicKey).N.BitLen(); bits < minRSABits {
+		return fmt.Errorf("%d bit RSA key refused, at least %d bits are required", bits, minRSABits)
+	}
+	return nil
+}
+
+// addPolicyFlags adds the key policy flags to the flags of a command
+// installing keys.
+func addPolicyFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&pCommandLineArgs.AllowWeak, "allow-weak", false, "Copy keys the key policy refuses, e.g. DSA or short RSA keys")
+	fs.IntVar(&pCommandLineArgs.MinRSABits, "min-rsa-bits", 2048, "Minimum size of RSA keys")
+	fs.Var(&pCommandLineArgs.Denylists, "denylist", "Refuse the keys listed in this file by fingerprint or key line, may be repeated")
+	fs.StringVar(&pCommandLineArgs.KRL, "krl", "", "Refuse keys and certificates revoked by this OpenSSH KRL")
+}
+
+// checkKeyPolicy applies the key policy of the command line to the key
+// being copied. -allow-weak disables the strength checks but not the
+// denylists and the KRL.
+func checkKeyPolicy(keyData string) error {
+	if err := validateKeyLine(keyData); err != nil {
+		return fmt.Errorf("invalid key line: %v", err)
+	}
+	_, key, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return err
+	}
+	if !wantedKeyType(key) {
+		return fmt.Errorf("%s key refused, -key-type allows %s", keyTypeName(key.Type), pCommandLineArgs.KeyTypes)
+	}
+	if !pCommandLineArgs.AllowWeak {
+		if err := checkKeyStrength(key, pCommandLineArgs.MinRSABits); err != nil {
+			return err
+		}
+	}
+	denied, err := loadDenylist(pCommandLineArgs.Denylists)
+	if err != nil {
+		return err
+	}
+	if err := denied.Check(key); err != nil {
+		return err
+	}
+	if pCommandLineArgs.KRL != "" {
+		revocations, err := readKRL(pCommandLineArgs.KRL)
+		if err != nil {
+			return err
+		}
+		if revocations.Revoked(key) {
+			return fmt.Errorf("key %s is revoked by %s", key.Fingerprint(), pCommandLineArgs.KRL)
+		}
+	}
+	return nil
+}
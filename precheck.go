@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// precheckTimeout bounds the TCP check of -precheck=tcp per address.
+const precheckTimeout = 5 * time.Second
+
+// precheckRunner resolves the host name and, with TCP set, connects to the
+// ssh port before running the command, so an unknown name, a refused
+// connection and a timeout are told apart along with the address tried,
+// which ssh's exit code 255 does not.
+type precheckRunner struct {
+	Runner
+	TCP bool
+}
+
+func (r *precheckRunner) Run(ctx context.Context, host, command string) (Result, error) {
+	if err := precheckHost(ctx, host, r.TCP); err != nil {
+		return Result{ExitCode: 255}, withKind(ErrHostUnreachable, err)
+	}
+	return r.Runner.Run(ctx, host, command)
+}
+
+// proxied reports whether ssh reaches host through a ProxyJump or
+// ProxyCommand, which resolve the name on their side.
+func proxied(host string) bool {
+	config := resolveSSHConfig(host)
+	if isSet(config.Get("ProxyJump")) || isSet(config.Get("ProxyCommand")) {
+		return true
+	}
+	options := append([]string{}, pCommandLineArgs.Options...)
+	options = append(options, pCommandLineArgs.Targets[host].Options...)
+	for _, option := range options {
+		keyword, args := splitConfigLine(option)
+		if (keyword == "proxyjump" || keyword == "proxycommand") && len(args) > 0 && isSet(args[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func precheckHost(ctx context.Context, host string, tcp bool) error {
+	if proxied(host) {
+		return nil
+	}
+	name, port := hostPort(host)
+	addresses := []string{name}
+	if address, _, _ := strings.Cut(name, "%"); net.ParseIP(address) == nil {
+		var err error
+		addresses, err = net.DefaultResolver.LookupHost(ctx, name)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return fmt.Errorf("name not found: %s does not resolve", name)
+		} else if err != nil {
+			return fmt.Errorf("resolving %s: %v", name, err)
+		}
+	}
+	if !tcp {
+		return nil
+	}
+	var err error
+	for _, address := range addresses {
+		target := net.JoinHostPort(address, strconv.Itoa(port))
+		var dialer *net.Dialer
+		if dialer, err = bindDialer("tcp", host, address); err != nil {
+			return err
+		}
+		dialer.Timeout = precheckTimeout
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, "tcp", target); err == nil {
+			conn.Close()
+			return nil
+		}
+		var netErr net.Error
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			err = fmt.Errorf("connection refused by %s", target)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			err = fmt.Errorf("timed out connecting to %s", target)
+		default:
+			err = fmt.Errorf("connecting to %s: %v", target, err)
+		}
+	}
+	return err
+}
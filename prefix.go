@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+type (
+	// hostPrefixer multiplexes the output of concurrently running hosts onto
+	// one writer, prefixing every line with the host name like pssh.
+	hostPrefixer struct {
+		w  io.Writer
+		mu sync.Mutex
+	}
+
+	// prefixWriter writes the complete lines of one host to a hostPrefixer,
+	// keeping a partial last line until it is completed or flushed.
+	prefixWriter struct {
+		p       *hostPrefixer
+		prefix  []byte
+		partial []byte
+	}
+)
+
+func newHostPrefixer(w io.Writer) *hostPrefixer {
+	return &hostPrefixer{w: w}
+}
+
+func (p *hostPrefixer) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.w.Write(b)
+}
+
+func (w *prefixWriter) Write(b []byte) (int, error) {
+	w.partial = append(w.partial, b...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	var out []byte
+	for _, line := range bytes.SplitAfter(w.partial[:i+1], []byte("\n")) {
+		if len(line) > 0 {
+			out = append(append(out, w.prefix...), line...)
+		}
+	}
+	w.partial = append([]byte{}, w.partial[i+1:]...)
+	if _, err := w.p.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes a remaining partial line.
+func (w *prefixWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.p.Write(append(append(append([]byte{}, w.prefix...), w.partial...), '\n'))
+		w.partial = nil
+	}
+}
+
+// hostWriter returns the writer for the output of host, which is prefixed
+// with the host name when w is a hostPrefixer, and a function flushing it
+// once the command is done.
+func hostWriter(w io.Writer, host string) (io.Writer, func()) {
+	p, ok := w.(*hostPrefixer)
+	if !ok {
+		return w, func() {}
+	}
+	pw := &prefixWriter{p: p, prefix: []byte(host + ": ")}
+	return pw, pw.Flush
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// progress shows a live counter of a fleet run on a terminal. Every finished
+// host gets a status line above the counter.
+type progress struct {
+	w                   io.Writer
+	mu                  sync.Mutex
+	total, done, failed int
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(w io.Writer, total int) *progress {
+	p := &progress{w: w, total: total}
+	p.draw()
+	return p
+}
+
+func (p *progress) draw() {
+	const width = 30
+	filled := width * (p.done + p.failed) / p.total
+	bar := ""
+	for i := 0; i < width; i++ {
+		if i < filled {
+			bar += "#"
+		} else {
+			bar += "."
+		}
+	}
+	fmt.Fprintf(p.w, "\r\033[K[%s] %d done, %d failed, %d pending", bar, p.done, p.failed, p.total-p.done-p.failed)
+}
+
+// Update records the result of a host.
+func (p *progress) Update(r hostResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r.Status == statusFailed || r.Status == statusAborted {
+		p.failed++
+	} else {
+		p.done++
+	}
+	status := r.Status
+	if r.Error != "" {
+		status += ": " + r.Error
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s: %s\n", r.Host, status)
+	p.draw()
+}
+
+// Finish ends the counter line.
+func (p *progress) Finish() {
+	fmt.Fprintln(p.w)
+}
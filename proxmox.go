@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// proxmoxEscape encodes like the Proxmox UI does for sshkeys, which the API
+// expects URL encoded with %20 for spaces.
+func proxmoxEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// proxmoxRequest calls the Proxmox API at $PROXMOX_URL with the API token
+// $PROXMOX_TOKEN (user@realm!id=secret). $PROXMOX_INSECURE=1 accepts self
+// signed certificates.
+func proxmoxRequest(method, path string, form url.Values, out interface{}) error {
+	base, token := os.Getenv("PROXMOX_URL"), os.Getenv("PROXMOX_TOKEN")
+	if base == "" || token == "" {
+		return fmt.Errorf("set PROXMOX_URL and PROXMOX_TOKEN")
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+"/api2/json"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "PVEAPIToken="+token)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	if os.Getenv("PROXMOX_INSECURE") == "1" {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{Status: resp.StatusCode, Body: strings.TrimSpace(resp.Status + " " + string(buf))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(buf, out)
+}
+
+// proxmoxSSHKeys adds the key to the cloud-init sshkeys of the VM given as
+// node/vmid, keeping the keys already configured.
+func proxmoxSSHKeys(key *publicKey, name string) (string, error) {
+	node, vmid, ok := strings.Cut(pCommandLineArgs.Proxmox, "/")
+	if !ok || node == "" || vmid == "" {
+		return "", fmt.Errorf("invalid Proxmox VM %q, use node/vmid", pCommandLineArgs.Proxmox)
+	}
+	path := fmt.Sprintf("/nodes/%s/qemu/%s/config", url.PathEscape(node), url.PathEscape(vmid))
+	var config struct {
+		Data struct {
+			SSHKeys string `json:"sshkeys"`
+		} `json:"data"`
+	}
+	if err := proxmoxRequest(http.MethodGet, path, nil, &config); err != nil {
+		return "", err
+	}
+	existing, err := url.QueryUnescape(strings.ReplaceAll(config.Data.SSHKeys, "+", "%2B"))
+	if err != nil {
+		return "", fmt.Errorf("invalid sshkeys of VM %s: %v", pCommandLineArgs.Proxmox, err)
+	}
+	if hp := diffAuthorizedKeys(pCommandLineArgs.Proxmox, []byte(existing), []*publicKey{key}, nil); len(hp.Add) == 0 {
+		return "already in the cloud-init keys of VM " + pCommandLineArgs.Proxmox, nil
+	}
+	keys := strings.TrimRight(existing, "\n")
+	if keys != "" {
+		keys += "\n"
+	}
+	keys += key.String() + "\n"
+	if err := proxmoxRequest(http.MethodPut, path, url.Values{"sshkeys": {proxmoxEscape(keys)}}, nil); err != nil {
+		return "", err
+	}
+	return "added to the cloud-init keys of VM " + pCommandLineArgs.Proxmox, nil
+}
+
+func init() {
+	keyBackends["proxmox"] = keyBackend{
+		Enabled: func() bool { return pCommandLineArgs.Proxmox != "" },
+		Upload:  proxmoxSSHKeys,
+	}
+}
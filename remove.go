@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// removeKeyCommand removes every authorized_keys line holding one of the
+// keys, whatever options or comment it has, and exits with exitKeyNotFound
+// when none is present.
+func removeKeyCommand(keys []*publicKey) string {
+	return removeKeysFromFile("~/.ssh/authorized_keys", keys)
+}
+
+// keyBlobs returns the base64 key data of keys, separated by spaces.
+func keyBlobs(keys []*publicKey) string {
+	blobs := make([]string, len(keys))
+	for i, key := range keys {
+		blobs[i] = base64.StdEncoding.EncodeToString(key.Blob)
+	}
+	return strings.Join(blobs, " ")
+}
+
+// removeKeysFromFile is removeKeyCommand for an authorized_keys file, which
+// may be given relative to the home as ~/.
+func removeKeysFromFile(fileName string, keys []*publicKey) string {
+	if rest, ok := strings.CutPrefix(fileName, "~/"); ok {
+		fileName = "~/" + shellQuote(rest)
+	} else {
+		fileName = shellQuote(fileName)
+	}
+	return removeBlobsCommand(fileName, shellQuote(keyBlobs(keys)))
+}
+
+// removeBlobsCommand removes the lines holding one of the space separated
+// blobs from file, both given as shell words.
+func removeBlobsCommand(file, blobs string) string {
+	return fmt.Sprintf(`f=%s; [ -f "$f" ] || exit %d
+LC_ALL=C awk -v keys=%s 'BEGIN { n = split(keys, k, " "); for (i = 1; i <= n; i++) drop[k[i]] = 1 }
+{ for (i = 1; i <= NF; i++) if ($i in drop) { found = 1; next }; print }
+END { exit found ? 0 : 3 }' "$f" > "$f.tmp"
+rc=$?; if [ $rc -ne 0 ]; then rm -f "$f.tmp"; [ $rc -eq 3 ] && exit %d; exit 1; fi
+cat "$f.tmp" > "$f" && rm -f "$f.tmp"`, file, exitKeyNotFound, blobs, exitKeyNotFound)
+}
+
+// keyTarget names the authorized_keys files a key was installed in: File,
+// the ~/.ssh/authorized_keys of each of Users, or with neither set the one
+// of the login user.
+type keyTarget struct {
+	Users []string `json:"users,omitempty"`
+	File  string   `json:"file,omitempty"`
+}
+
+// runTarget returns the keyTarget a run with the -users and -server-flavor
+// of this run changes on host.
+func runTarget(host string) keyTarget {
+	if pCommandLineArgs.Users != "" {
+		return keyTarget{Users: pCommandLineArgs.users()}
+	}
+	user, _ := splitUserHost(host)
+	if user == "" {
+		user = currentActor()
+	}
+	return keyTarget{File: flavorKeyFile(pCommandLineArgs.ServerFlavor, user)}
+}
+
+// installedTarget narrows the runTarget of an install to the users the key
+// was installed for, as its output reports.
+func installedTarget(r hostResult) keyTarget {
+	t := runTarget(r.Host)
+	if t.Users == nil {
+		return t
+	}
+	var users []string
+	for _, line := range strings.Split(string(r.Output), "\n") {
+		if user, ok := strings.CutSuffix(line, ": installed"); ok {
+			users = append(users, user)
+		}
+	}
+	if users == nil {
+		return t
+	}
+	return keyTarget{Users: users}
+}
+
+// removeCommand returns the command removing keys from the files of t,
+// exiting with exitKeyNotFound when none was present.
+func (t keyTarget) removeCommand(keys []*publicKey) string {
+	switch {
+	case t.File != "":
+		return removeKeysFromFile(t.File, keys)
+	case t.Users != nil:
+		return usersRemoveCommand(t.Users, keys)
+	}
+	return removeKeyCommand(keys)
+}
+
+// shellWord quotes s for sh unless it consists of characters that need no
+// quoting.
+func shellWord(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return s
+	}
+	return shellQuote(s)
+}
+
+func runRemove(args []string) error {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() < 1 && !pCommandLineArgs.hasTargetSource() {
+		return fmt.Errorf("usage: remove -i key.pub [user@]hostname...")
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	if err := resolveSSHFile(); err != nil {
+		return err
+	}
+	_, key, err := parseAuthorizedKey(pCommandLineArgs.KeyData)
+	if err != nil {
+		return err
+	}
+	if pCommandLineArgs.Hosts, err = expandHosts(flag.Args()); err != nil {
+		return err
+	}
+	if err := discoverTargets(); err != nil {
+		return err
+	}
+	hosts := pCommandLineArgs.Hosts
+	f := &fleet{Runner: newRunner(os.Stdout, os.Stderr), Parallel: pCommandLineArgs.Parallel}
+	results := f.RunEach(context.Background(), hosts, func(host string) string {
+		return runTarget(host).removeCommand([]*publicKey{key})
+	})
+	failed := 0
+	for i, r := range results {
+		switch r.Status {
+		case statusInstalled:
+			results[i].Status = statusRemoved
+			fmt.Printf("%s: removed %s\n", r.Host, key.Fingerprint())
+		case statusNotFound:
+			fmt.Printf("%s: key not present\n", r.Host)
+		default:
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: Error removing key.Reason: %v\n", r.Host, r.Error)
+		}
+	}
+	recordChange("remove", []string{key.Fingerprint()}, results)
+	if failed > 0 {
+		return fmt.Errorf("removing the key failed on %d hosts", failed)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["remove"] = subcommand{"Remove a key from the hosts, whatever options it was installed with", runRemove}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type reportRow struct {
+	Host        string
+	User        string
+	Fingerprint string
+	Action      string
+	Result      string
+	Error       string
+	Seconds     string
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ssh-copy-id report {{.Time}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.failed { background: #fdd; }
+.installed, .removed { background: #dfd; }
+</style>
+</head>
+<body>
+<h1>ssh-copy-id report</h1>
+<p>Generated {{.Time}}</p>
+<table>
+<tr><th>Host</th><th>User</th><th>Fingerprint</th><th>Action</th><th>Result</th><th>Error</th><th>Seconds</th></tr>
+{{range .Rows}}<tr class="{{.Result}}"><td>{{.Host}}</td><td>{{.User}}</td><td>{{.Fingerprint}}</td><td>{{.Action}}</td><td>{{.Result}}</td><td>{{.Error}}</td><td>{{.Seconds}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func reportRows(action string, fingerprints []string, results []hostResult) []reportRow {
+	var rows []reportRow
+	for _, r := range results {
+		remoteUser, host := splitUserHost(r.Host)
+		for _, fingerprint := range fingerprints {
+			rows = append(rows, reportRow{
+				Host:        host,
+				User:        remoteUser,
+				Fingerprint: fingerprint,
+				Action:      action,
+				Result:      r.Status,
+				Error:       r.Error,
+				Seconds:     fmt.Sprintf("%.2f", r.Seconds),
+			})
+		}
+	}
+	return rows
+}
+
+// writeReport writes the results as HTML when path ends in .html or .htm
+// and as CSV otherwise.
+func writeReport(path, action string, fingerprints []string, results []hostResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rows := reportRows(action, fingerprints, results)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		err = reportTemplate.Execute(file, struct {
+			Time string
+			Rows []reportRow
+		}{time.Now().UTC().Format(time.RFC3339), rows})
+	default:
+		w := csv.NewWriter(file)
+		w.Write([]string{"host", "user", "fingerprint", "action", "result", "error", "seconds"})
+		for _, row := range rows {
+			w.Write([]string{row.Host, row.User, row.Fingerprint, row.Action, row.Result, row.Error, row.Seconds})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
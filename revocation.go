@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// revocationCommand returns the command line running command on host with
+// the transport of this run.
+func revocationCommand(host, command string) string {
+	var args []string
+	if transport, ok := execTransports[pCommandLineArgs.Transport]; ok {
+		args = transport(host, command)
+	} else {
+		args = append(append([]string{"ssh"}, newSSHRunner().hostArgs(host)...), "--", host, command)
+	}
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = shellWord(arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// writeRevocationScript writes a shell script undoing the run: it removes
+// the key from every host it was installed on. The script only needs ssh,
+// so the revocation can be run from another machine.
+func writeRevocationScript(path, keyData string, results []hostResult) error {
+	script, err := revocationScript(keyData, results, "")
+	if err != nil || script == "" {
+		return err
+	}
+	return os.WriteFile(path, []byte(script), 0700)
+}
+
+// revocationScript returns the script of writeRevocationScript, with note
+// added to its header when set, or "" when the key was installed nowhere.
+func revocationScript(keyData string, results []hostResult, note string) (string, error) {
+	_, key, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n# Revokes the key installed by ssh-copy-id at %s\n# %s %s\n",
+		time.Now().UTC().Format(time.RFC3339), key.Type, key.Fingerprint())
+	if note != "" {
+		fmt.Fprintf(&b, "# %s\n", note)
+	}
+	b.WriteString("failed=0\n")
+	installed := 0
+	for _, r := range results {
+		if r.Status != statusInstalled {
+			continue
+		}
+		installed++
+		command := installedTarget(r).removeCommand([]*publicKey{key})
+		fmt.Fprintf(&b, "\n%s\ncase $? in\n\t0) echo %s;;\n\t%d) echo %s;;\n\t*) echo %s >&2; failed=1;;\nesac\n",
+			revocationCommand(r.Host, command), shellWord(r.Host+": removed"), exitKeyNotFound,
+			shellWord(r.Host+": key not present"), shellWord(r.Host+": removing the key failed"))
+	}
+	if installed == 0 {
+		return "", nil
+	}
+	b.WriteString("exit $failed\n")
+	return b.String(), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rotateRunner replaces the old key of a host with the new one in stages:
+// the new key is installed while logged in with the old key, a login with
+// the new key is verified, and only then the old key is removed over that
+// login. When the verification fails the new key is removed again, unless
+// it was installed before this run. Keys are removed by their key data, so
+// lines with options or another comment are removed too.
+type rotateRunner struct {
+	Old     *sshRunner
+	New     *sshRunner
+	OldKey  *publicKey
+	NewKey  *publicKey
+	NewLine string
+}
+
+func (r *rotateRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	result, err := r.Old.Run(ctx, host, installCommand(r.NewLine, false))
+	if err != nil && result.ExitCode != exitKeyExists {
+		return result, fmt.Errorf("installing the new key failed: %v", err)
+	}
+	added := err == nil
+	if added {
+		r.record("install", host, r.NewKey, nil)
+	}
+	if result, err := r.New.Run(ctx, host, "true"); err != nil {
+		if !added {
+			return result, fmt.Errorf("login with the new key failed, it was installed before and is left in place: %v", err)
+		}
+		rollback, rerr := r.Old.Run(ctx, host, removeKeyCommand([]*publicKey{r.NewKey}))
+		if rerr != nil && rollback.ExitCode != exitKeyNotFound {
+			r.record("remove", host, r.NewKey, rerr)
+			return result, fmt.Errorf("login with the new key failed: %v, and removing it again failed: %v", err, rerr)
+		}
+		r.record("remove", host, r.NewKey, nil)
+		return result, fmt.Errorf("login with the new key failed, new key removed again: %v", err)
+	}
+	result, err = r.New.Run(ctx, host, removeKeyCommand([]*publicKey{r.OldKey}))
+	if result.ExitCode == exitKeyNotFound {
+		return result, fmt.Errorf("the old key was not found in authorized_keys, the new key is installed but the old one may still grant access")
+	}
+	r.record("remove", host, r.OldKey, err)
+	if err != nil {
+		return result, fmt.Errorf("removing the old key failed, both keys are installed: %v", err)
+	}
+	return Result{}, nil
+}
+
+// record writes the audit entry of one change of the rotation on host,
+// failed when err is set.
+func (r *rotateRunner) record(action, host string, key *publicKey, err error) {
+	status := statusInstalled
+	if err != nil {
+		status = statusFailed
+	}
+	recordChange(action, []string{key.Fingerprint()}, []hostResult{{Host: host, Status: status}})
+}
+
+// identityRunner returns a ssh runner logging in with only identity. The
+// identity files of -hosts-file entries are left out, so no other key of a
+// host is offered.
+func identityRunner(identity string) *sshRunner {
+	runner := newSSHRunner()
+	runner.Targets = make(map[string]targetConfig, len(pCommandLineArgs.Targets))
+	for host, t := range pCommandLineArgs.Targets {
+		t.IdentityFile = ""
+		runner.Targets[host] = t
+	}
+	runner.Stdout = nil
+	runner.Args = append(runner.Args, "-i", identity, "-o", "IdentitiesOnly=yes", "-o", "BatchMode=yes")
+	return runner
+}
+
+func runRotate(args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	addConnectionFlags(fs)
+	addPolicyFlags(fs)
+	addAuditFlags(fs)
+	oldIdentity := fs.String("old", "", "Private key of the key being replaced, its .pub is removed from the hosts")
+	fleetMode := fs.Bool("fleet", false, "Rotate more than one host")
+	fs.Parse(args)
+	if fs.NArg() < 1 || *oldIdentity == "" || pCommandLineArgs.IdentityFile == "" {
+		return fmt.Errorf("usage: rotate -i new_key -old old_key [-fleet] [user@]hostname...")
+	}
+	if pCommandLineArgs.Transport != "ssh" {
+		return fmt.Errorf("rotate verifies the login with the new key and requires the ssh transport")
+	}
+	hosts, err := expandHosts(fs.Args())
+	if err != nil {
+		return err
+	}
+	if len(hosts) > 1 && !*fleetMode {
+		return fmt.Errorf("rotate changes %d hosts, pass -fleet to confirm", len(hosts))
+	}
+	if err := resolveSSHFile(); err != nil {
+		return err
+	}
+	oldData, err := os.ReadFile(strings.TrimSuffix(*oldIdentity, ".pub") + ".pub")
+	if err != nil {
+		return err
+	}
+	oldKey, err := parsePublicKey(string(oldData))
+	if err != nil {
+		return fmt.Errorf("%s.pub: %v", strings.TrimSuffix(*oldIdentity, ".pub"), err)
+	}
+	if err := checkKeyPolicy(pCommandLineArgs.KeyData); err != nil {
+		return err
+	}
+	_, newKey, err := parseAuthorizedKey(pCommandLineArgs.KeyData)
+	if err != nil {
+		return err
+	}
+	runner := &rotateRunner{
+		Old:     identityRunner(strings.TrimSuffix(*oldIdentity, ".pub")),
+		New:     identityRunner(pCommandLineArgs.IdentityFile),
+		OldKey:  oldKey,
+		NewKey:  newKey,
+		NewLine: pCommandLineArgs.KeyData,
+	}
+	f := &fleet{Runner: runner, Parallel: pCommandLineArgs.Parallel}
+	failed := 0
+	for _, r := range f.Run(context.Background(), hosts, "") {
+		if r.Status == statusFailed {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %v\n", r.Host, r.Error)
+			continue
+		}
+		fmt.Printf("%s: rotated\n", r.Host)
+	}
+	if failed > 0 {
+		return fmt.Errorf("rotation failed on %d of %d hosts", failed, len(hosts))
+	}
+	return nil
+}
+
+func init() {
+	subcommands["rotate"] = subcommand{"Replace a key on the hosts, verifying the new key before removing the old", runRotate}
+}
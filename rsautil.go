@@ -5,6 +5,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
@@ -81,3 +82,27 @@ func generatePrivateKey(bits int) (*rsa.PrivateKey, error) {
 	log.Printf("Failed to generate signing key :%s", err.Error())
 	return key, err
 }
+
+// readRSAPrivateKey loads a PKCS#1 or PKCS#8 PEM encoded RSA private key.
+func readRSAPrivateKey(fileName string) (*rsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", fileName)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse RSA private key %s: %v", fileName, err)
+	}
+	key, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a RSA private key", fileName)
+	}
+	return key, nil
+}
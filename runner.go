@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type (
+	// Result is the outcome of a remote command.
+	Result struct {
+		ExitCode int
+		Stdout   []byte
+		Stderr   []byte
+	}
+
+	// Runner executes a command on a remote host.
+	Runner interface {
+		Run(ctx context.Context, host string, command string) (Result, error)
+	}
+
+	// inputRunner is a Runner that can feed input to the stdin of the
+	// remote command.
+	inputRunner interface {
+		RunInput(ctx context.Context, host, command string, input []byte) (Result, error)
+	}
+
+	// sshRunner runs commands through the ssh binary. Remote output is
+	// captured in the Result and copied to Stdout and Stderr when set.
+	// Targets holds per host settings that override Args.
+	sshRunner struct {
+		Args    []string
+		Targets map[string]targetConfig
+		Stdout  io.Writer
+		Stderr  io.Writer
+	}
+)
+
+func newSSHRunner() *sshRunner {
+	return &sshRunner{
+		Args:    getCommandLineArgs(),
+		Targets: pCommandLineArgs.Targets,
+		Stdout:  os.Stdout,
+		Stderr:  os.Stderr,
+	}
+}
+
+// copyBuffers holds the buffers output is copied with, shared by the hosts
+// of a fleet.
+var copyBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
+// handleOutput copies r to w with a pooled buffer. The loop is explicit as
+// io.CopyBuffer would ignore the buffer for a w like *bytes.Buffer, which
+// reads from r with its own allocations.
+func handleOutput(w io.Writer, r io.Reader) error {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	for {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			if _, werr := w.Write((*buf)[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func teeWriter(buf *bytes.Buffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
+}
+
+// runHostProcess is runProcess for a program working on host, whose output
+// lines get the host name as prefix when written to a hostPrefixer.
+func runHostProcess(ctx context.Context, host, name string, args []string, stdin io.Reader, stdoutW, stderrW io.Writer) (Result, error) {
+	stdoutW, flushStdout := hostWriter(stdoutW, host)
+	stderrW, flushStderr := hostWriter(stderrW, host)
+	defer flushStderr()
+	defer flushStdout()
+	return runProcess(ctx, name, args, stdin, stdoutW, stderrW)
+}
+
+// runProcess runs a local program, reading stdin when set, capturing its
+// output in the Result and copying it to stdoutW and stderrW when set.
+func runProcess(ctx context.Context, name string, args []string, stdin io.Reader, stdoutW, stderrW io.Writer) (Result, error) {
+	var result Result
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = stdin
+	var errStdout, errStderr error
+	var stdout, stderr bytes.Buffer
+
+	stdoutIn, _ := cmd.StdoutPipe()
+	stderrIn, _ := cmd.StderrPipe()
+	err := cmd.Start()
+	if err != nil {
+		result.ExitCode = 1
+		return result, fmt.Errorf("cmd.Start() failed with '%s'", err)
+	}
+	// cmd.Wait() should be called only after we finish reading
+	// from stdoutIn and stderrIn.
+	// wg ensures that we finish
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		errStdout = handleOutput(teeWriter(&stdout, stdoutW), stdoutIn)
+		wg.Done()
+	}()
+
+	errStderr = handleOutput(teeWriter(&stderr, stderrW), stderrIn)
+
+	wg.Wait()
+	result.Stdout, result.Stderr = stdout.Bytes(), stderr.Bytes()
+
+	if errStdout != nil || errStderr != nil {
+		result.ExitCode = 1
+		return result, fmt.Errorf("failed to capture stdout or stderr")
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exiterr.ExitCode()
+			return result, err
+		} else {
+			result.ExitCode = 1
+			return result, fmt.Errorf("cmd.Wait: %v", err)
+		}
+	}
+	ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	result.ExitCode = ws.ExitStatus()
+	return result, err
+}
+
+// hostArgs returns the ssh options for host. The settings of its target come
+// first, as ssh uses the first value given for an option.
+func (r *sshRunner) hostArgs(host string) []string {
+	var args []string
+	if target, ok := r.Targets[host]; ok {
+		if target.Port != 0 {
+			args = append(args, "-p", strconv.Itoa(target.Port))
+		}
+		if target.IdentityFile != "" {
+			args = append(args, "-i", target.IdentityFile)
+		}
+		for _, option := range target.Options {
+			args = append(args, "-o", option)
+		}
+	}
+	return append(args, r.Args...)
+}
+
+// withTargets returns a copy of r that also applies the settings of targets,
+// which take precedence over those r already has.
+func (r *sshRunner) withTargets(targets map[string]targetConfig) *sshRunner {
+	c := *r
+	c.Targets = make(map[string]targetConfig, len(r.Targets)+len(targets))
+	for host, t := range r.Targets {
+		c.Targets[host] = t
+	}
+	for host, t := range targets {
+		c.Targets[host] = t
+	}
+	return &c
+}
+
+// Run runs command on host. The host follows --, so ssh never takes it for
+// an option.
+func (r *sshRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	args := append(r.hostArgs(host), "--", host, command)
+	return runHostProcess(ctx, host, "ssh", args, nil, r.Stdout, r.Stderr)
+}
+
+func (r *sshRunner) RunInput(ctx context.Context, host, command string, input []byte) (Result, error) {
+	args := append(r.hostArgs(host), "--", host, command)
+	return runHostProcess(ctx, host, "ssh", args, bytes.NewReader(input), r.Stdout, r.Stderr)
+}
+
+// Upload copies the local file to remote on host with sftp, which takes the
+// port as -P instead of -p.
+func (r *sshRunner) Upload(ctx context.Context, host, local, remote string) (Result, error) {
+	batch, err := os.CreateTemp("", "ssh-copy-id-sftp")
+	if err != nil {
+		return Result{ExitCode: 1}, err
+	}
+	defer os.Remove(batch.Name())
+	_, err = fmt.Fprintf(batch, "put \"%s\" \"%s\"\n", local, remote)
+	if cerr := batch.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Result{ExitCode: 1}, err
+	}
+	args := []string{"-b", batch.Name()}
+	for _, arg := range r.hostArgs(host) {
+		if arg == "-p" {
+			arg = "-P"
+		}
+		args = append(args, arg)
+	}
+	// sftp would take the text after the first colon of an IPv6 address
+	// for a path.
+	destination := host
+	if user, address := splitUserHost(host); strings.Contains(address, ":") {
+		destination = "[" + address + "]"
+		if user != "" {
+			destination = user + "@" + destination
+		}
+	}
+	return runHostProcess(ctx, host, "sftp", append(args, "--", destination), nil, nil, r.Stderr)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeRunner runs the commands with the local sh instead of on a host, with
+// HOME in a temporary directory of each host.
+type fakeRunner struct {
+	t     *testing.T
+	mu    sync.Mutex
+	homes map[string]string
+}
+
+func newFakeRunner(t *testing.T) *fakeRunner {
+	return &fakeRunner{t: t, homes: map[string]string{}}
+}
+
+// home returns the home directory of host.
+func (r *fakeRunner) home(host string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.homes[host] == "" {
+		r.homes[host] = r.t.TempDir()
+	}
+	return r.homes[host]
+}
+
+// authorizedKeys returns the authorized_keys of host.
+func (r *fakeRunner) authorizedKeys(host string) string {
+	buf, _ := os.ReadFile(filepath.Join(r.home(host), ".ssh", "authorized_keys"))
+	return string(buf)
+}
+
+func (r *fakeRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	return r.RunInput(ctx, host, command, nil)
+}
+
+func (r *fakeRunner) RunInput(ctx context.Context, host, command string, input []byte) (Result, error) {
+	home := r.home(host)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Dir = home
+	cmd.Env = append(os.Environ(), "HOME="+home)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	result := Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		result.ExitCode = 1
+	}
+	return result, err
+}
+
+// output stands in for a process pipe, which implements neither
+// io.WriterTo nor io.ReaderFrom.
+type output struct{ r io.Reader }
+
+func (o *output) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+var remoteOutput = bytes.Repeat([]byte("Number of key(s) added: 1\n"), 4096)
+
+func TestHandleOutput(t *testing.T) {
+	var buf bytes.Buffer
+	if err := handleOutput(&buf, &output{bytes.NewReader(remoteOutput)}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), remoteOutput) {
+		t.Errorf("copied %d bytes, want %d", buf.Len(), len(remoteOutput))
+	}
+}
+
+func BenchmarkHandleOutput(b *testing.B) {
+	b.ReportAllocs()
+	dst := bytes.NewBuffer(make([]byte, 0, len(remoteOutput)))
+	for i := 0; i < b.N; i++ {
+		dst.Reset()
+		handleOutput(dst, &output{bytes.NewReader(remoteOutput)})
+	}
+}
+
+// BenchmarkCopy is the io.Copy handleOutput replaces, for comparison.
+func BenchmarkCopy(b *testing.B) {
+	b.ReportAllocs()
+	dst := bytes.NewBuffer(make([]byte, 0, len(remoteOutput)))
+	for i := 0; i < b.N; i++ {
+		dst.Reset()
+		io.Copy(struct{ io.Writer }{dst}, &output{bytes.NewReader(remoteOutput)})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type inventoryEntry struct {
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	File        string `json:"file"`
+	Line        int    `json:"line"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	Options     string `json:"options,omitempty"`
+	key         *publicKey
+}
+
+// inventoryMarker is the token of the file markers of allUsersListCommand,
+// random per run so no authorized_keys line can pass for a marker.
+var inventoryMarker = func() string {
+	var token [8]byte
+	rand.Read(token[:])
+	return "### ssh-copy-id-" + hex.EncodeToString(token[:]) + " "
+}()
+
+// allUsersListCommand prints every authorized_keys file readable by the
+// login user, with a line of marker, user and file in front of each. As
+// root that covers all users.
+func allUsersListCommand(marker string) string {
+	return fmt.Sprintf(`(getent passwd 2>/dev/null || cat /etc/passwd) | while IFS=: read -r u _ _ _ _ h _; do
+	for f in "$h/.ssh/authorized_keys" "$h/.ssh/authorized_keys2"; do
+		if [ -f "$f" ] && [ -r "$f" ]; then printf '%%s%%s %%s\n' %s "$u" "$f"; cat "$f"; echo; fi
+	done
+done`, shellQuote(marker))
+}
+
+// listMarker returns the marker of the inventory output collectInventory
+// reads, "" for the listCommand output of the login user, which has none.
+func listMarker(allUsers bool) string {
+	if allUsers {
+		return inventoryMarker
+	}
+	return ""
+}
+
+// parseInventory turns the output of listCommand or allUsersListCommand into
+// inventory entries. Lines that are no keys are skipped. The file markers
+// are only recognized when marker is set.
+func parseInventory(host string, output []byte, marker string) []inventoryEntry {
+	user, _ := splitUserHost(host)
+	if user == "" {
+		user = currentActor()
+	}
+	file, lineNo := "~/.ssh/authorized_keys", 0
+	var entries []inventoryEntry
+	for _, line := range strings.Split(string(output), "\n") {
+		lineNo++
+		if u, f, ok := cutMarker(line, marker); ok {
+			user, file, lineNo = u, f, 0
+			continue
+		}
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		options, key, err := parseAuthorizedKey(line)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, inventoryEntry{
+			Host:        host,
+			User:        user,
+			File:        file,
+			Line:        lineNo,
+			Type:        key.Type,
+			Fingerprint: key.Fingerprint(),
+			Comment:     key.Comment,
+			Options:     options,
+			key:         key,
+		})
+	}
+	return entries
+}
+
+// cutMarker returns the user and file of a marker line of
+// allUsersListCommand, never matching when marker is "".
+func cutMarker(line, marker string) (user, file string, ok bool) {
+	if marker == "" {
+		return "", "", false
+	}
+	rest, ok := strings.CutPrefix(line, marker)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, " ")
+}
+
+// inventoryFiles splits the output of listCommand or allUsersListCommand
+// into the lines of each file, in the order of the output.
+func inventoryFiles(output []byte, marker string) ([]string, map[string][]string) {
+	file := "~/.ssh/authorized_keys"
+	files := []string{file}
+	lines := map[string][]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if _, f, ok := cutMarker(line, marker); ok {
+			file = f
+			files = append(files, file)
+			continue
+		}
+		lines[file] = append(lines[file], line)
+	}
+	for f, l := range lines {
+		for len(l) > 0 && l[len(l)-1] == "" {
+			l = l[:len(l)-1]
+		}
+		lines[f] = l
+	}
+	return files, lines
+}
+
+// collectInventory reads the authorized_keys of the hosts, of all users
+// where permitted when allUsers is set. It returns the entries, the output
+// of every host that was read and the number of hosts that failed.
+func collectInventory(ctx context.Context, hosts []string, allUsers bool) ([]inventoryEntry, map[string][]byte, int) {
+	command := listCommand
+	if allUsers {
+		command = allUsersListCommand(inventoryMarker)
+	}
+	f := &fleet{Runner: newRunner(nil, os.Stderr), Parallel: pCommandLineArgs.Parallel}
+	var entries []inventoryEntry
+	outputs := map[string][]byte{}
+	failed := 0
+	for _, r := range f.Run(ctx, hosts, command) {
+		if r.Status == statusFailed {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: Error reading authorized_keys.Reason: %v\n", r.Host, r.Error)
+			continue
+		}
+		outputs[r.Host] = r.Output
+		entries = append(entries, parseInventory(r.Host, r.Output, listMarker(allUsers))...)
+	}
+	return entries, outputs, failed
+}
+
+func writeInventory(w io.Writer, format string, entries []inventoryEntry) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []inventoryEntry{}
+		}
+		return enc.Encode(entries)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"host", "user", "file", "line", "type", "fingerprint", "comment", "options"})
+		for _, e := range entries {
+			cw.Write([]string{e.Host, e.User, e.File, strconv.Itoa(e.Line), e.Type, e.Fingerprint, e.Comment, e.Options})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format %q, use json or csv", format)
+}
+
+// runScan writes an inventory of the keys on the hosts, or with -krl
+// reports the keys a KRL revokes.
+func runScan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	addConnectionFlags(fs)
+	krlFile := fs.String("krl", "", "Report the keys this key revocation list revokes")
+	allUsers := fs.Bool("all-users", false, "Collect the authorized_keys of every user the login user may read")
+	out := fs.String("out", "", "Write the inventory to this file instead of stdout")
+	format := fs.String("format", "", "Inventory format, json or csv, by default from the -out extension or json")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: scan [-krl revoked.krl] [-all-users] [-format json|csv] [-out file] [user@]hostname...")
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	var revocations *krl
+	if *krlFile != "" {
+		var err error
+		if revocations, err = readKRL(*krlFile); err != nil {
+			return err
+		}
+	}
+	hosts, err := expandHosts(fs.Args())
+	if err != nil {
+		return err
+	}
+	entries, _, failed := collectInventory(context.Background(), hosts, *allUsers)
+	if revocations != nil {
+		return reportRevoked(revocations, hosts, entries, failed)
+	}
+	if *format == "" {
+		*format = "json"
+		if strings.EqualFold(filepath.Ext(*out), ".csv") {
+			*format = "csv"
+		}
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := writeInventory(w, *format, entries); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d hosts failed", failed)
+	}
+	return nil
+}
+
+// reportRevoked prints the inventory entries a KRL revokes.
+func reportRevoked(revocations *krl, hosts []string, entries []inventoryEntry, failed int) error {
+	revoked := 0
+	for _, e := range entries {
+		if revocations.Revoked(e.key) {
+			revoked++
+			fmt.Printf("%s: revoked key %s %s\n", e.Host, e.Fingerprint, e.Comment)
+		}
+	}
+	if revoked > 0 || failed > 0 {
+		return fmt.Errorf("%d revoked keys found, %d hosts failed", revoked, failed)
+	}
+	fmt.Printf("No revoked keys on %d hosts\n", len(hosts))
+	return nil
+}
+
+func init() {
+	subcommands["scan"] = subcommand{"Collect an inventory of the keys on the hosts, or report keys revoked by a KRL", runScan}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	releaseAsset struct {
+		Name        string `json:"name"`
+		DownloadURL string `json:"browser_download_url"`
+	}
+
+	releaseInfo struct {
+		TagName string         `json:"tag_name"`
+		Assets  []releaseAsset `json:"assets"`
+	}
+)
+
+const defaultReleaseURL = "https://api.github.com/repos/flaming-moe/ssh-copy-id/releases/latest"
+
+// releaseManifest is the release asset listing the version and the SHA-256
+// of every artifact, signed in releaseManifest + ".sig".
+const releaseManifest = "ssh-copy-id_manifest.txt"
+
+// releasePublicKey is the PEM encoded key release artifacts are signed with,
+// injected at build time with -ldflags "-X main.releasePublicKey=...".
+var releasePublicKey = ""
+
+// updateClient bounds the release downloads, so a stalled server does not
+// hang the update.
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+func httpGet(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func fetchRelease(url string) (*releaseInfo, error) {
+	buf, err := httpGet(url)
+	if err != nil {
+		return nil, err
+	}
+	release := new(releaseInfo)
+	if err := json.Unmarshal(buf, release); err != nil {
+		return nil, fmt.Errorf("invalid release information: %v", err)
+	}
+	return release, nil
+}
+
+func (r *releaseInfo) findAsset(name string) (releaseAsset, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset, true
+		}
+	}
+	return releaseAsset{}, false
+}
+
+// parseVersion splits a version like v1.2.3 or 1.2.3-rc1 into its numbers
+// and pre-release suffix.
+func parseVersion(v string) ([]int, string, error) {
+	numbers, pre, _ := strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	parts := strings.Split(numbers, ".")
+	nums := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", fmt.Errorf("invalid version %q", v)
+		}
+		nums[i] = n
+	}
+	return nums, pre, nil
+}
+
+// compareVersions returns -1, 0 or 1 when version a is older than, the same
+// as or newer than b. A pre-release is older than its release.
+func compareVersions(a, b string) (int, error) {
+	an, apre, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bn, bpre, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		x, y := 0, 0
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		if x != y {
+			if x < y {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case apre == bpre:
+		return 0, nil
+	case apre == "":
+		return 1, nil
+	case bpre == "", apre < bpre:
+		return -1, nil
+	}
+	return 1, nil
+}
+
+// checkManifest verifies that the release manifest, a line "version <tag>"
+// followed by "<sha256>  <artifact>" lines as sha256sum writes them, is that
+// of release tag and lists data as artifact name.
+func checkManifest(manifest, tag, name string, data []byte) error {
+	lines := strings.Split(strings.TrimSpace(manifest), "\n")
+	if got := strings.TrimSpace(strings.TrimPrefix(lines[0], "version ")); !strings.HasPrefix(lines[0], "version ") || got != tag {
+		return fmt.Errorf("the manifest is not that of release %s", tag)
+	}
+	sum := sha256.Sum256(data)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			if fields[0] != hex.EncodeToString(sum[:]) {
+				return fmt.Errorf("%s does not match the checksum of the manifest", name)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("the manifest does not list %s", name)
+}
+
+// replaceExecutable writes data next to the running binary and renames it
+// over the original, so the binary is never observed half written.
+func replaceExecutable(data []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".new")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
+
+func runSelfUpdate(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	url := fs.String("url", defaultReleaseURL, "Release endpoint to check for updates")
+	pubKeyFile := fs.String("pubkey", "", "PEM public key used to verify the release signature")
+	check := fs.Bool("check", false, "Only report whether an update is available")
+	force := fs.Bool("force", false, "Install the release even when it is not newer, e.g. to downgrade or to replace a development build")
+	sigAlg := fs.String("sig-alg", "sha256", "Signature algorithm of the release: sha256, sha384, sha512 or pss-sha256/384/512")
+	fs.BoolVar(&AllowSHA1, "legacy-sha1", false, "Accept SHA-1 release signatures")
+	fs.Parse(args)
+
+	release, err := fetchRelease(*url)
+	if err != nil {
+		return err
+	}
+	newer, err := compareVersions(release.TagName, version)
+	switch {
+	case *force:
+	case err != nil:
+		return fmt.Errorf("cannot compare release %s with the running version %s: %v, use -force to install it anyway", release.TagName, version, err)
+	case newer == 0:
+		fmt.Printf("Already running the latest version %s\n", version)
+		return nil
+	case newer < 0:
+		return fmt.Errorf("release %s is older than the running version %s, use -force to downgrade", release.TagName, version)
+	}
+	fmt.Printf("Update available: %s -> %s\n", version, release.TagName)
+	if *check {
+		return nil
+	}
+
+	pubKey := releasePublicKey
+	if *pubKeyFile != "" {
+		buf, err := os.ReadFile(*pubKeyFile)
+		if err != nil {
+			return err
+		}
+		pubKey = string(buf)
+	}
+	if pubKey == "" {
+		return fmt.Errorf("no release signing key configured, use -pubkey")
+	}
+
+	assetName := fmt.Sprintf("ssh-copy-id_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		assetName += ".exe"
+	}
+	asset, ok := release.findAsset(assetName)
+	if !ok {
+		return fmt.Errorf("release %s has no artifact %s", release.TagName, assetName)
+	}
+	manifestAsset, ok := release.findAsset(releaseManifest)
+	if !ok {
+		return fmt.Errorf("release %s has no manifest %s", release.TagName, releaseManifest)
+	}
+	sigAsset, ok := release.findAsset(releaseManifest + ".sig")
+	if !ok {
+		return fmt.Errorf("release %s has no signature for %s", release.TagName, releaseManifest)
+	}
+
+	manifest, err := httpGet(manifestAsset.DownloadURL)
+	if err != nil {
+		return err
+	}
+	signature, err := httpGet(sigAsset.DownloadURL)
+	if err != nil {
+		return err
+	}
+	if err := CheckPEM(pubKey, strings.TrimSpace(string(signature)), string(manifest), SignatureAlgorithm(*sigAlg)); err != nil {
+		return fmt.Errorf("signature verification of %s failed: %v", releaseManifest, err)
+	}
+	data, err := httpGet(asset.DownloadURL)
+	if err != nil {
+		return err
+	}
+	if err := checkManifest(string(manifest), release.TagName, assetName, data); err != nil {
+		return err
+	}
+	if err := replaceExecutable(data); err != nil {
+		return err
+	}
+	fmt.Printf("Updated to %s\n", release.TagName)
+	return nil
+}
+
+func init() {
+	subcommands["self-update"] = subcommand{"Download, verify and install the latest release", runSelfUpdate}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type (
+	installRequest struct {
+		Fingerprint string   `json:"fingerprint"`
+		User        string   `json:"user"`
+		Hosts       []string `json:"hosts"`
+	}
+
+	installResponse struct {
+		Fingerprint string       `json:"fingerprint"`
+		Results     []hostResult `json:"results"`
+	}
+
+	// keyServer installs keys from a fixed catalog on request.
+	keyServer struct {
+		Token string
+		Keys  map[string]*publicKey
+		// Fleet runs the installs with SSH, which each request copies with
+		// its own target ports, so requests never share settings.
+		Fleet *fleet
+		SSH   *sshRunner
+		Audit *auditLog
+	}
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+func (s *keyServer) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+// maxRequestSize bounds the body of an install request.
+const maxRequestSize = 1 << 20
+
+// validTarget reports whether a user or host name of a request is safe to
+// hand to ssh: no option-like leading - and no whitespace or control
+// characters.
+func validTarget(s string) bool {
+	if s == "" || strings.HasPrefix(s, "-") {
+		return false
+	}
+	for _, c := range s {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *keyServer) handleInstall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "invalid or missing token")
+		return
+	}
+	var req installRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	key, ok := s.Keys[req.Fingerprint]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown key fingerprint %s", req.Fingerprint)
+		return
+	}
+	if len(req.Hosts) == 0 {
+		writeError(w, http.StatusBadRequest, "no hosts given")
+		return
+	}
+	targets := map[string]targetConfig{}
+	hosts, err := expandTargets(req.Hosts, targets)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	if req.User != "" && (!validTarget(req.User) || strings.Contains(req.User, "@")) {
+		writeError(w, http.StatusBadRequest, "invalid user %q", req.User)
+		return
+	}
+	for i, host := range hosts {
+		if !validTarget(host) {
+			writeError(w, http.StatusBadRequest, "invalid host %q", host)
+			return
+		}
+		if req.User != "" && !strings.Contains(host, "@") {
+			hosts[i] = req.User + "@" + host
+			if t, ok := targets[host]; ok {
+				targets[hosts[i]] = t
+			}
+		}
+	}
+	fleet := *s.Fleet
+	fleet.Runner = s.SSH.withTargets(targets)
+	// The API installs in ~/.ssh/authorized_keys of the login user with the
+	// openssh command; serve takes no -server-flavor or -users.
+	log.Printf("installing %s on %d hosts for %s", key.Fingerprint(), len(hosts), r.RemoteAddr)
+	results := fleet.Run(r.Context(), hosts, installCommand(key.String(), false))
+	if s.Audit != nil {
+		if err := s.Audit.Record("api:"+r.RemoteAddr, "install", []string{key.Fingerprint()}, results); err != nil {
+			log.Printf("writing audit log failed: %v", err)
+		}
+	}
+	writeJSON(w, http.StatusOK, installResponse{Fingerprint: key.Fingerprint(), Results: results})
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8022", "Address to listen on")
+	tokenFile := fs.String("token-file", "", "File containing the API bearer token (default $SSH_COPY_ID_TOKEN)")
+	keysFile := fs.String("keys", "", "File with the public keys that may be installed, in authorized_keys format")
+	certFile := fs.String("tls-cert", "", "TLS certificate file")
+	keyFile := fs.String("tls-key", "", "TLS private key file")
+	auditLogFile := fs.String("audit-log", "", "Append a record of every operation to this log file")
+	auditKey := fs.String("audit-key", "", "PEM RSA private key used to sign audit log entries")
+	parallel := fs.Int("parallel", 10, "Number of hosts to copy a key to concurrently")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Longest time an install request may take, including the response")
+	metricsListen := fs.String("metrics-listen", "", "Expose Prometheus metrics on this address, which has no token check")
+	fs.Parse(args)
+
+	token := os.Getenv("SSH_COPY_ID_TOKEN")
+	if *tokenFile != "" {
+		buf, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(buf))
+	}
+	if token == "" {
+		return fmt.Errorf("an API token is required, use -token-file or SSH_COPY_ID_TOKEN")
+	}
+	if *keysFile == "" {
+		return fmt.Errorf("a key catalog is required, use -keys")
+	}
+	keys, err := readPublicKeys(*keysFile)
+	if err != nil {
+		return err
+	}
+
+	runner := newSSHRunner()
+	runner.Stdout, runner.Stderr = nil, nil
+	s := &keyServer{
+		Token: token,
+		Keys:  make(map[string]*publicKey, len(keys)),
+		Fleet: &fleet{Parallel: *parallel, Metrics: metrics},
+		SSH:   runner,
+	}
+	for _, key := range keys {
+		if err := checkKeyPolicy(key.String()); err != nil {
+			return fmt.Errorf("%s: key %s: %v", *keysFile, key.Fingerprint(), err)
+		}
+		s.Keys[key.Fingerprint()] = key
+	}
+
+	if *auditLogFile != "" {
+		if s.Audit, err = openAuditLog(*auditLogFile, *auditKey); err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/install", s.handleInstall)
+	if *metricsListen != "" {
+		serveMetrics(*metricsListen)
+	}
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           http.TimeoutHandler(mux, *timeout, `{"error":"request timed out"}`),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      *timeout + 10*time.Second,
+	}
+	log.Printf("serving %d keys on %s", len(s.Keys), *listen)
+	if *certFile != "" {
+		return server.ListenAndServeTLS(*certFile, *keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+func init() {
+	subcommands["serve"] = subcommand{"Run an HTTP API that installs keys on request", runServe}
+}
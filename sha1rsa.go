@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sha1RSARunner warns once an RSA key is on a host whose server is OpenSSH
+// 8.8 or later, which refuses ssh-rsa (SHA-1) signatures: logging in with
+// the key needs a client or agent that signs with rsa-sha2-256 or -512.
+type sha1RSARunner struct {
+	Runner
+}
+
+func (r *sha1RSARunner) Run(ctx context.Context, host, command string) (Result, error) {
+	result, err := r.Runner.Run(ctx, host, command)
+	if (err != nil && result.ExitCode != exitKeyExists) || proxied(host) {
+		return result, err
+	}
+	banner, berr := serverBanner(ctx, host)
+	if berr != nil {
+		return result, err
+	}
+	if major, minor, ok := openSSHVersion(banner); ok && (major > 8 || major == 8 && minor >= 8) {
+		fmt.Fprintf(os.Stderr, "%s: warning: the server (%s) refuses ssh-rsa SHA-1 signatures, so logging in with this RSA key fails from clients and agents that cannot sign with rsa-sha2-256/512, e.g. OpenSSH before 7.2 or old PuTTY; prefer an ed25519 key, or allow the key with PubkeyAcceptedAlgorithms +ssh-rsa in sshd_config\n", host, strings.TrimPrefix(banner, "SSH-2.0-"))
+	}
+	return result, err
+}
+
+// serverBanner returns the identification line the ssh server of host sends
+// on connecting, e.g. SSH-2.0-OpenSSH_9.6p1.
+func serverBanner(ctx context.Context, host string) (string, error) {
+	name, port := hostPort(host)
+	dialer, err := bindDialer("tcp", host, name)
+	if err != nil {
+		return "", err
+	}
+	dialer.Timeout = precheckTimeout
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(name, strconv.Itoa(port)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(precheckTimeout))
+	reader := bufio.NewReader(conn)
+	// Servers may send other lines before the identification.
+	for i := 0; i < 20; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		if line = strings.TrimRight(line, "\r\n"); strings.HasPrefix(line, "SSH-") {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("no ssh identification from %s", name)
+}
+
+// openSSHVersion returns the version of an OpenSSH server banner, and false
+// for other servers.
+func openSSHVersion(banner string) (int, int, bool) {
+	// SSH-protoversion-softwareversion comments
+	parts := strings.SplitN(banner, "-", 3)
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	version, ok := strings.CutPrefix(parts[2], "OpenSSH_")
+	if !ok {
+		return 0, 0, false
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// restrictedShells cannot run the install command at all.
+var restrictedShells = map[string]bool{
+	"rbash": true, "rksh": true, "rzsh": true, "git-shell": true, "lshell": true,
+	"rssh": true, "scponly": true, "nologin": true, "false": true,
+}
+
+// shellQuote quotes s as a single word for sh, csh and fish alike.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// powerShellCommand runs script with PowerShell. The script is passed encoded
+// so neither cmd nor PowerShell as login shell interprets it.
+func powerShellCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	buf := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		buf = append(buf, byte(u), byte(u>>8))
+	}
+	return "powershell -NoProfile -NonInteractive -EncodedCommand " + base64.StdEncoding.EncodeToString(buf)
+}
+
+// windowsInstallCommand installs the key in %USERPROFILE%\.ssh for the
+// Windows OpenSSH server.
+func windowsInstallCommand(user, keyData string, force bool) string {
+	script := fmt.Sprintf("$k = '%s'; $d = Join-Path $env:USERPROFILE '.ssh'; New-Item -ItemType Directory -Force $d | Out-Null; $f = Join-Path $d 'authorized_keys'; ", strings.ReplaceAll(keyData, "'", "''"))
+	if !force {
+		script += "if ((Test-Path $f) -and (Select-String -Path $f -SimpleMatch -Quiet -Pattern $k)) { exit 201 }; "
+	}
+	return powerShellCommand(script + "Add-Content -Path $f -Value $k")
+}
+
+// portableCommand wraps the POSIX command so every login shell runs it with
+// sh in the same session: the command is passed as octal escapes to
+// printf, leaving nothing for cmd, PowerShell, csh or fish to interpret,
+// and restricted login shells are refused before it runs. Windows answers
+// that there is no sh, which windowsShell detects.
+func portableCommand(command string) string {
+	names := make([]string, 0, len(restrictedShells))
+	for name := range restrictedShells {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	script := fmt.Sprintf(`case "${SHELL##*/}" in %s) echo "the login shell $SHELL is restricted and cannot install keys" >&2; exit 1;; esac
+%s`, strings.Join(names, "|"), command)
+	var b strings.Builder
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		if c == ' ' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, `\%03o`, c)
+		}
+	}
+	return fmt.Sprintf(`sh -c 'eval "$(printf "%s")"'`, b.String())
+}
+
+// windowsShell reports whether result is cmd or PowerShell failing to find
+// sh, the positive sign of a Windows host.
+func windowsShell(result Result) bool {
+	output := string(result.Stderr) + string(result.Stdout)
+	return result.ExitCode != 0 && strings.Contains(output, "'sh' is not recognized as")
+}
+
+// windowsUnsupported names the options of this run the Windows install
+// command cannot honor, "" if there are none.
+func windowsUnsupported() string {
+	var names []string
+	if pCommandLineArgs.PreCmd != "" || pCommandLineArgs.PostCmd != "" {
+		names = append(names, "-pre-cmd/-post-cmd")
+	}
+	if pCommandLineArgs.Users != "" {
+		names = append(names, "-users")
+	}
+	if pCommandLineArgs.RemoteTemplate != "" {
+		names = append(names, "-remote-template")
+	}
+	return strings.Join(names, ", ")
+}
+
+// shellRunner runs the POSIX install command through portableCommand, so
+// it works whatever the login shell is, in a single session. Only when the
+// host turns out to run Windows is the PowerShell install command run in a
+// second session.
+type shellRunner struct {
+	Runner
+	KeyData string
+	Force   bool
+}
+
+func (r *shellRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	result, err := r.Runner.Run(ctx, host, portableCommand(command))
+	if err == nil || !windowsShell(result) {
+		return result, err
+	}
+	if unsupported := windowsUnsupported(); unsupported != "" {
+		return Result{ExitCode: 1}, fmt.Errorf("the host runs Windows, where %s cannot be used", unsupported)
+	}
+	user, _ := splitUserHost(host)
+	return r.Runner.Run(ctx, host, windowsInstallCommand(user, r.KeyData, r.Force))
+}
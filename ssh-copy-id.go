@@ -1,41 +1,154 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
-	"syscall"
+	"text/template"
+	"time"
 )
 
 type (
 	optionFlags []string
 
+	subcommand struct {
+		Description string
+		Run         func(args []string) error
+	}
+
 	commandLineArgs struct {
+		ShowVersion            bool
+		Quiet                  bool
+		ErrorIfExists          bool
+		Hardened               bool
+		HardenedOptions        string
+		FromSelf               bool
+		FromCIDR               string
+		GrantFor               string
+		RevocationScript       string
+		grantExpires           time.Time
+		AssumeYes              bool
+		AllAgentKeys           bool
+		RefreshHostKey         bool
+		DisablePasswordAuth    bool
+		PreCmd                 string
+		PostCmd                string
+		RemoteTemplate         string
+		Users                  string
+		Events                 string
+		CIDR                   string
+		Inventory              string
+		HostsFile              string
+		Limit                  string
+		Tag                    string
+		ExcludeTag             string
+		FromKnownHosts         optionalFlag
+		Vagrant                optionalFlag
+		LocalPath              string
+		Chroot                 string
+		LocalUser              string
+		EC2InstanceConnect     string
+		EC2User                string
+		EC2Permanent           bool
+		Region                 string
+		EC2ImportKeyPair       bool
+		KeyName                string
+		GCPOSLogin             bool
+		TTL                    string
+		AzureVM                string
+		AzureUser              string
+		DigitalOcean           bool
+		HetznerCloud           bool
+		OpenStack              bool
+		Proxmox                string
+		GitHubUpload           bool
+		GitLabUpload           optionalFlag
+		GiteaUpload            string
 		ForceMode              bool
 		DryRun                 bool
 		IdentityFile           string
+		Generate               optionalFlag
+		KeyType                string
+		KeyTypes               string
+		KeyBits                int
+		PublicKeyFile          string
 		KeyData                string
+		RequireSignedBy        string
+		AllowWeak              bool
+		MinRSABits             int
+		Denylists              optionFlags
+		KRL                    string
+		SignerIdentity         string
 		Port                   int
 		AlternateSshConfigFile string
+		Canonicalize           bool
+		ForwardAgent           bool
+		BindAddress            string
+		BindInterface          string
 		Options                optionFlags
-		UserAndHostName        string
+		Parallel               int
+		Transport              string
+		ServerFlavor           string
+		Namespace              string
+		FailFast               bool
+		MaxFailures            int
+		MaxFailurePct          float64
+		Rate                   string
+		interval               time.Duration
+		remoteTemplate         *template.Template
+		MetricsListen          string
+		NotifyURL              string
+		ReportFile             string
+		StateFile              string
+		Cache                  optionalFlag
+		Precheck               optionalFlag
+		CacheTTL               time.Duration
+		Resume                 bool
+		Journal                string
+		AuditLog               string
+		AuditKey               string
+		Hosts                  []string
+		Targets                map[string]targetConfig
 	}
 )
 
 var pCommandLineArgs *commandLineArgs
 
+// subcommands are registered by the files implementing them and are selected
+// by the first command line argument.
+var subcommands = map[string]subcommand{}
+
+// isLocal reports whether the key is installed into a locally mounted
+// filesystem instead of remote hosts.
+func (args *commandLineArgs) isLocal() bool {
+	return args.LocalPath != "" || args.Chroot != ""
+}
+
+// hasTargetSource reports whether an option other than host arguments
+// selects where the key goes.
+func (args *commandLineArgs) hasTargetSource() bool {
+	return args.CIDR != "" || args.Inventory != "" || args.HostsFile != "" || args.FromKnownHosts.Enabled || args.Vagrant.Enabled ||
+		args.isLocal() || args.EC2InstanceConnect != "" || len(enabledBackends()) > 0
+}
+
 func resolvePublicData(pubIdFile string) error {
-	buf, err := os.ReadFile(pubIdFile)
+	text, err := readKeyText(pubIdFile)
 	if err != nil {
 		return err
 	}
-	pCommandLineArgs.KeyData = strings.ReplaceAll(strings.ReplaceAll(string(buf), "\n", ""), "\r", "")
+	keyData, err := normalizePublicKey(text)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pubIdFile, err)
+	}
+	pCommandLineArgs.KeyData = keyData
 	return nil
 }
 
@@ -46,48 +159,108 @@ func resolveSSHFile() error {
 			return err
 		}
 		pCommandLineArgs.IdentityFile = filepath.Join(dirname, ".ssh", "id_rsa")
+		if candidates := localKeyCandidates(filepath.Join(dirname, ".ssh")); len(candidates) > 1 && isTerminal(os.Stdin) && !pCommandLineArgs.AssumeYes {
+			if pCommandLineArgs.IdentityFile, err = pickIdentity(candidates); err != nil {
+				return err
+			}
+		} else if types := pCommandLineArgs.keyTypes(); len(types) > 0 {
+			pCommandLineArgs.IdentityFile = typedIdentity(filepath.Join(dirname, ".ssh"), types)
+		} else if pCommandLineArgs.Generate.Enabled {
+			pCommandLineArgs.IdentityFile = defaultIdentity(filepath.Join(dirname, ".ssh"))
+		}
+	}
+	if _, err := os.Stat(pCommandLineArgs.IdentityFile); os.IsNotExist(err) && pCommandLineArgs.Generate.Enabled {
+		if err := generateKey(pCommandLineArgs.IdentityFile, generatedKeyType(), pCommandLineArgs.KeyBits); err != nil {
+			return err
+		}
 	}
 	if _, err := os.Stat(pCommandLineArgs.IdentityFile); err != nil {
 		return fmt.Errorf("identy file %s cannot be found", pCommandLineArgs.IdentityFile)
 	}
+	if strings.EqualFold(filepath.Ext(pCommandLineArgs.IdentityFile), ".ppk") {
+		// PuTTY keys carry their public key.
+		pCommandLineArgs.PublicKeyFile = pCommandLineArgs.IdentityFile
+		return resolvePublicData(pCommandLineArgs.IdentityFile)
+	}
 	fileWithoutEx := strings.TrimSuffix(pCommandLineArgs.IdentityFile, filepath.Ext(pCommandLineArgs.IdentityFile))
 	publicIdFile := fileWithoutEx + ".pub"
 	if _, err := os.Stat(publicIdFile); err != nil {
 		return fmt.Errorf("public file %s cannot be found", publicIdFile)
 	}
+	pCommandLineArgs.PublicKeyFile = publicIdFile
 	return resolvePublicData(publicIdFile)
 }
 
-func validateCommandLineArgs() error {
-	flag.Parse()
-	if flag.NArg() < 1 {
+func validateCommandLineArgs(args []string) error {
+	flag.CommandLine.Parse(args)
+	if pCommandLineArgs.ShowVersion {
+		return nil
+	}
+	if flag.NArg() < 1 && !pCommandLineArgs.hasTargetSource() {
 		return fmt.Errorf("you must assign a host name")
-	} else if flag.NArg() > 1 {
-		return fmt.Errorf("only one host name is allowed")
 	}
-	pCommandLineArgs.UserAndHostName = flag.Arg(0)
-	return resolveSSHFile()
-}
-
-func handleOutput(w io.Writer, r io.Reader) error {
-	buf := make([]byte, 1024)
-	for {
-		n, err := r.Read(buf[:])
-		if n > 0 {
-			d := buf[:n]
-			_, err := w.Write(d)
-			if err != nil {
-				return err
-			}
+	if pCommandLineArgs.Parallel < 1 {
+		return fmt.Errorf("parallel must be at least 1")
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	if err := validateFlavor(pCommandLineArgs.ServerFlavor); err != nil {
+		return err
+	}
+	if err := validateHooks(); err != nil {
+		return err
+	}
+	if err := validateKeyTypes(); err != nil {
+		return err
+	}
+	if v := pCommandLineArgs.Precheck.Value; v != "" && v != "tcp" {
+		return fmt.Errorf("invalid -precheck=%s, use -precheck or -precheck=tcp", v)
+	}
+	if pCommandLineArgs.GrantFor != "" {
+		d, err := parseGrantDuration(pCommandLineArgs.GrantFor)
+		if err != nil {
+			return err
+		}
+		pCommandLineArgs.grantExpires = time.Now().Add(d)
+	}
+	if pCommandLineArgs.Hardened || pCommandLineArgs.FromSelf || pCommandLineArgs.FromCIDR != "" || pCommandLineArgs.GrantFor != "" {
+		if err := validateHardened(); err != nil {
+			return err
 		}
+	}
+	if pCommandLineArgs.Users != "" && (nonShellFlavors[pCommandLineArgs.ServerFlavor] || pCommandLineArgs.RemoteTemplate != "") {
+		return fmt.Errorf("-users needs a POSIX shell and cannot be combined with -remote-template")
+	}
+	if pCommandLineArgs.Rate != "" {
+		interval, err := parseRate(pCommandLineArgs.Rate)
 		if err != nil {
-			// Read returns io.EOF at the end of file, which is not an error for us
-			if err == io.EOF {
-				err = nil
-			}
 			return err
 		}
+		pCommandLineArgs.interval = interval
 	}
+	if pCommandLineArgs.Resume && pCommandLineArgs.StateFile == "" {
+		return fmt.Errorf("resume requires a state file")
+	}
+	if pCommandLineArgs.RemoteTemplate != "" {
+		tmpl, err := loadRemoteTemplate(pCommandLineArgs.RemoteTemplate)
+		if err != nil {
+			return err
+		}
+		pCommandLineArgs.remoteTemplate = tmpl
+	}
+	hosts, err := expandHosts(flag.Args())
+	if err != nil {
+		return err
+	}
+	pCommandLineArgs.Hosts = hosts
+	if pCommandLineArgs.AllAgentKeys {
+		if pCommandLineArgs.IdentityFile != "" {
+			return fmt.Errorf("-all-agent-keys installs the agent's keys and cannot be combined with -i")
+		}
+		return nil
+	}
+	return resolveSSHFile()
 }
 
 func (i *optionFlags) String() string {
@@ -104,19 +277,121 @@ func simplifyFileName(fileName string) string {
 	return strings.TrimSuffix(fName, filepath.Ext(fName))
 }
 
+// confirm asks a yes/no question on the terminal, unless -y was given.
+func confirm(prompt string) bool {
+	if pCommandLineArgs.AssumeYes {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func printUsage() {
-	fmt.Fprintf(os.Stderr, "Description:\n\tInstall a public key in a remote machine's authorized_keys\nUsage:\n\t%s [options] [user@]hostname \nOptions:\n", simplifyFileName(os.Args[0]))
+	prog := simplifyFileName(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Description:\n\tInstall a public key in a remote machine's authorized_keys\nUsage:\n\t%s [options] [user@]hostname... \n\t%s <command> [arguments]\nCommands:\n", prog, prog)
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, subcommands[name].Description)
+	}
+	fmt.Fprintf(os.Stderr, "Options:\n")
 	flag.PrintDefaults()
 }
 
+// addConnectionFlags registers the identity and ssh connection options, so
+// subcommands with their own flag set accept them as well.
+func addConnectionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&pCommandLineArgs.IdentityFile, "i", "", "Provide an optional identifile")
+	fs.IntVar(&pCommandLineArgs.Port, "p", 22, "Provide a SSH port number")
+	fs.StringVar(&pCommandLineArgs.AlternateSshConfigFile, "F", "", "Provide an alternative SSH configuration file")
+	fs.Var(&pCommandLineArgs.Options, "o", "Provide option -- Add ssh -o options")
+	fs.IntVar(&pCommandLineArgs.Parallel, "parallel", 1, "Number of hosts to copy the key to concurrently")
+	fs.StringVar(&pCommandLineArgs.Transport, "transport", "ssh", "How to reach the hosts: "+transportNames())
+	fs.StringVar(&pCommandLineArgs.Namespace, "namespace", "", "Kubernetes namespace of the pods for -transport kubectl")
+	fs.BoolVar(&pCommandLineArgs.ForwardAgent, "A", false, "Forward the ssh agent to the host, e.g. for -pre-cmd or -post-cmd steps that use ssh")
+	fs.StringVar(&pCommandLineArgs.BindAddress, "bind-address", "", "Source connections from this local address, as ssh -o BindAddress")
+	fs.StringVar(&pCommandLineArgs.BindInterface, "bind-interface", "", "Source connections from the address of this interface, as ssh -o BindInterface")
+	fs.BoolVar(&pCommandLineArgs.Canonicalize, "canonicalize", false, "Canonicalize short host names within the CanonicalDomains of ssh_config, as ssh -o CanonicalizeHostname=yes")
+}
+
 func init() {
-	pCommandLineArgs = new(commandLineArgs)
+	pCommandLineArgs = &commandLineArgs{Targets: map[string]targetConfig{}}
+	flag.BoolVar(&pCommandLineArgs.ShowVersion, "version", false, "Print version information and exit")
 	flag.BoolVar(&pCommandLineArgs.ForceMode, "f", false, "Force mode -- copy keys without trying to check if they are already ")
 	flag.BoolVar(&pCommandLineArgs.DryRun, "n", false, "Dry run    -- no keys are actually copied")
-	flag.StringVar(&pCommandLineArgs.IdentityFile, "i", "", "Provide an optional identifile")
-	flag.IntVar(&pCommandLineArgs.Port, "p", 22, "Provide a SSH port number")
-	flag.StringVar(&pCommandLineArgs.AlternateSshConfigFile, "F", "", "Provide an alternative SSH configuration file")
-	flag.Var(&pCommandLineArgs.Options, "o", "Provide option -- Add ssh -o options")
+	flag.BoolVar(&pCommandLineArgs.Quiet, "q", false, "Quiet mode -- print nothing but failures, the exit code tells the outcome")
+	flag.BoolVar(&pCommandLineArgs.ErrorIfExists, "error-if-exists", false, "Exit with 201 when the key is already present instead of succeeding")
+	flag.BoolVar(&pCommandLineArgs.AssumeYes, "y", false, "Answer yes to all confirmation prompts")
+	flag.BoolVar(&pCommandLineArgs.AllAgentKeys, "all-agent-keys", false, "Install every key the ssh agent holds, after listing them and asking for confirmation")
+	addConnectionFlags(flag.CommandLine)
+	flag.Var(&pCommandLineArgs.Precheck, "precheck", "Resolve each host name before running ssh, -precheck=tcp also connects to the ssh port, for clearer errors")
+	flag.BoolVar(&pCommandLineArgs.RefreshHostKey, "refresh-hostkey", false, "Offer to remove stale known_hosts entries of hosts whose host key changed and retry")
+	flag.BoolVar(&pCommandLineArgs.DisablePasswordAuth, "disable-password-auth", false, "After the key is installed and logs in, set PasswordAuthentication no in sshd_config (with sudo) and reload sshd")
+	flag.StringVar(&pCommandLineArgs.PreCmd, "pre-cmd", "", "Remote command to run before installing the key, in the same session")
+	flag.StringVar(&pCommandLineArgs.PostCmd, "post-cmd", "", "Remote command to run after installing the key, in the same session")
+	flag.StringVar(&pCommandLineArgs.RemoteTemplate, "remote-template", "", "Go text/template file rendering the remote install command, replacing the server flavor's")
+	flag.StringVar(&pCommandLineArgs.Users, "users", "", "Install the key for these remote users (alice,bob,...) in one connection, using sudo for other users")
+	flag.BoolVar(&pCommandLineArgs.Hardened, "hardened", false, "Install the key with the -hardened-options restricting what it may do")
+	flag.StringVar(&pCommandLineArgs.HardenedOptions, "hardened-options", defaultHardenedOptions, "authorized_keys options -hardened prepends to the key")
+	flag.BoolVar(&pCommandLineArgs.FromSelf, "from-self", false, "Restrict the key with from= to the local address the hosts are reached from")
+	flag.StringVar(&pCommandLineArgs.FromCIDR, "from-cidr", "", "Restrict the key with from= to these networks, e.g. 10.1.0.0/16")
+	flag.StringVar(&pCommandLineArgs.GrantFor, "grant-for", "", "Grant temporary access: install the key with an expiry-time this far ahead, e.g. 8h or 2d, and schedule its removal")
+	flag.StringVar(&pCommandLineArgs.ServerFlavor, "server-flavor", "auto", "Kind of server the hosts are: "+flavorNames())
+	flag.Var(&pCommandLineArgs.Generate, "generate", "Create the identity when it does not exist, -generate=type selects the key type (ed25519)")
+	flag.StringVar(&pCommandLineArgs.KeyType, "type", "", "Key type for -generate: ed25519, ecdsa or rsa")
+	flag.StringVar(&pCommandLineArgs.KeyTypes, "key-type", "", "Only consider keys of these types (ed25519,ecdsa,...) when picking the default identity and with -all-agent-keys, and refuse others")
+	flag.IntVar(&pCommandLineArgs.KeyBits, "bits", 0, "Key size for -generate, defaults to 3072 for RSA and 256 for ECDSA")
+	addPolicyFlags(flag.CommandLine)
+	flag.StringVar(&pCommandLineArgs.RequireSignedBy, "require-signed-by", "", "Refuse keys without a .sig made by this public key or allowed_signers file")
+	flag.StringVar(&pCommandLineArgs.SignerIdentity, "signer-identity", "", "Principal the -require-signed-by allowed_signers must list the signer for")
+	flag.StringVar(&pCommandLineArgs.HostsFile, "hosts-file", "", "Take the hosts, with optional per-host user, port, identity and jump host, from this file")
+	flag.StringVar(&pCommandLineArgs.Inventory, "inventory", "", "Take the hosts from an Ansible inventory in INI or YAML format")
+	flag.StringVar(&pCommandLineArgs.Limit, "limit", "", "Limit the inventory to these groups or hosts")
+	flag.StringVar(&pCommandLineArgs.Tag, "tag", "", "Only copy to the hosts with one of these tags (prod,db) of the -hosts-file")
+	flag.StringVar(&pCommandLineArgs.ExcludeTag, "exclude-tag", "", "Leave out the hosts with one of these tags of the -hosts-file")
+	flag.Var(&pCommandLineArgs.FromKnownHosts, "from-known-hosts", "Take the hosts from ~/.ssh/known_hosts, -from-known-hosts=pattern selects matching hosts")
+	flag.Var(&pCommandLineArgs.Vagrant, "vagrant", "Take the hosts from vagrant ssh-config, -vagrant=machine selects one machine")
+	flag.StringVar(&pCommandLineArgs.LocalPath, "local-path", "", "Install into this local authorized_keys file instead of a remote host")
+	flag.StringVar(&pCommandLineArgs.Chroot, "chroot", "", "Install into the home of -user below this locally mounted root filesystem")
+	flag.StringVar(&pCommandLineArgs.LocalUser, "user", "", "User of the -chroot filesystem to install the key for")
+	flag.StringVar(&pCommandLineArgs.EC2InstanceConnect, "ec2-instance-connect", "", "Push the key to this EC2 instance with EC2 Instance Connect")
+	flag.StringVar(&pCommandLineArgs.EC2User, "ec2-user", "ec2-user", "Instance user for -ec2-instance-connect")
+	flag.BoolVar(&pCommandLineArgs.EC2Permanent, "ec2-permanent", false, "After -ec2-instance-connect also copy the key to make it permanent")
+	flag.BoolVar(&pCommandLineArgs.EC2ImportKeyPair, "ec2-import-key-pair", false, "Import the key as EC2 key pair named -key-name")
+	flag.BoolVar(&pCommandLineArgs.GCPOSLogin, "gcp-oslogin", false, "Add the key to the GCP OS Login profile of the gcloud account")
+	flag.StringVar(&pCommandLineArgs.AzureVM, "azure-vm", "", "Install the key on these Azure VMs (resource-group/name,...) through VMAccess")
+	flag.StringVar(&pCommandLineArgs.AzureUser, "azure-user", "azureuser", "VM user for -azure-vm")
+	flag.BoolVar(&pCommandLineArgs.DigitalOcean, "digitalocean", false, "Register the key with the DigitalOcean account of $DIGITALOCEAN_TOKEN")
+	flag.BoolVar(&pCommandLineArgs.HetznerCloud, "hcloud", false, "Register the key with the Hetzner Cloud project of $HCLOUD_TOKEN")
+	flag.BoolVar(&pCommandLineArgs.OpenStack, "openstack", false, "Create or update the Nova keypair -key-name using the OS_* credentials")
+	flag.StringVar(&pCommandLineArgs.Proxmox, "proxmox", "", "Add the key to the cloud-init keys of this Proxmox VE VM (node/vmid)")
+	flag.BoolVar(&pCommandLineArgs.GitHubUpload, "github-upload", false, "Add the key to the GitHub account of $GITHUB_TOKEN")
+	flag.Var(&pCommandLineArgs.GitLabUpload, "gitlab-upload", "Add the key to the GitLab account of $GITLAB_TOKEN, optionally on this instance URL")
+	flag.StringVar(&pCommandLineArgs.GiteaUpload, "gitea-upload", "", "Add the key to the account of $GITEA_TOKEN on this Gitea or Forgejo URL")
+	flag.StringVar(&pCommandLineArgs.TTL, "ttl", "", "Lifetime of the key for backends supporting expiry, e.g. 30d")
+	flag.StringVar(&pCommandLineArgs.KeyName, "key-name", "", "Name to register the key under with cloud providers, defaults to the key comment")
+	flag.StringVar(&pCommandLineArgs.Region, "region", "", "Cloud region, defaults to the configuration of the cloud CLI")
+	flag.StringVar(&pCommandLineArgs.CIDR, "cidr", "", "Discover the SSH servers of this network and use them as hosts")
+	flag.BoolVar(&pCommandLineArgs.FailFast, "fail-fast", false, "Stop starting new hosts after the first failure")
+	flag.IntVar(&pCommandLineArgs.MaxFailures, "max-failures", 0, "Stop starting new hosts after this many failures")
+	flag.Float64Var(&pCommandLineArgs.MaxFailurePct, "max-failure-pct", 0, "Stop starting new hosts once this percentage of hosts failed")
+	flag.StringVar(&pCommandLineArgs.Rate, "rate", "", "Maximum rate of new connections, e.g. 5/s or 100/m")
+	flag.StringVar(&pCommandLineArgs.StateFile, "state", "", "Record the progress of the run in this state file")
+	flag.Var(&pCommandLineArgs.Cache, "cache", "Skip hosts a previous run found compliant without connecting, -cache=file selects the cache file")
+	flag.DurationVar(&pCommandLineArgs.CacheTTL, "cache-ttl", 24*time.Hour, "How long -cache trusts a host to still have the key")
+	flag.BoolVar(&pCommandLineArgs.Resume, "resume", false, "Skip the hosts the state file records as done")
+	flag.StringVar(&pCommandLineArgs.RevocationScript, "revocation-script", "", "Write a shell script removing the key again from the hosts it was installed on")
+	flag.StringVar(&pCommandLineArgs.Journal, "journal", defaultJournalPath(), "Journal of the keys added by the last run, used by undo")
+	addAuditFlags(flag.CommandLine)
+	flag.StringVar(&pCommandLineArgs.NotifyURL, "notify-url", "", "POST a JSON summary of the run to this webhook")
+	flag.StringVar(&pCommandLineArgs.ReportFile, "report", "", "Write a CSV report, or HTML when the name ends in .html, of the run")
+	flag.StringVar(&pCommandLineArgs.Events, "events", "", "Write newline-delimited JSON events of the run to this file, - for stdout")
+	flag.StringVar(&pCommandLineArgs.MetricsListen, "metrics-listen", "", "Expose Prometheus metrics on this address during the run")
 	flag.Usage = printUsage
 }
 
@@ -127,80 +402,373 @@ func getCommandLineArgs() []string {
 		args = append(args, strconv.Itoa(pCommandLineArgs.Port))
 	}
 
+	if pCommandLineArgs.Canonicalize {
+		args = append(args, "-o", "CanonicalizeHostname=yes")
+	}
+	if pCommandLineArgs.ForwardAgent {
+		// Spelled as an option, which sftp takes as well.
+		args = append(args, "-o", "ForwardAgent=yes")
+	}
+	if pCommandLineArgs.BindAddress != "" {
+		args = append(args, "-o", "BindAddress="+pCommandLineArgs.BindAddress)
+	}
+	if pCommandLineArgs.BindInterface != "" {
+		args = append(args, "-o", "BindInterface="+pCommandLineArgs.BindInterface)
+	}
+	identitiesOnly := false
 	for _, option := range pCommandLineArgs.Options {
 		args = append(args, "-o")
 		args = append(args, option)
+		if keyword, _ := splitConfigLine(option); keyword == "identitiesonly" {
+			identitiesOnly = true
+		}
+	}
+	// With an explicit key, don't let the keys of a well stocked agent use
+	// up the server's MaxAuthTries before the password prompt. -o
+	// IdentitiesOnly=no overrides.
+	if pCommandLineArgs.IdentityFile != "" && !identitiesOnly {
+		args = append(args, "-o", "IdentitiesOnly=yes")
 	}
-	args = append(args, pCommandLineArgs.UserAndHostName)
 	return args
 }
 
-func runSSHExec(command string) (int, error) {
-	args := append(getCommandLineArgs(), command)
-	cmd := exec.Command("ssh", args...)
-	var errStdout, errStderr error
-
-	stdoutIn, _ := cmd.StdoutPipe()
-	stderrIn, _ := cmd.StderrPipe()
-	err := cmd.Start()
+// keyFingerprints returns the fingerprints of the keys being copied.
+func keyFingerprints() []string {
+	_, key, err := parseAuthorizedKey(pCommandLineArgs.KeyData)
 	if err != nil {
-		return 1, fmt.Errorf("cmd.Start() failed with '%s'", err)
+		return nil
+	}
+	return []string{key.Fingerprint()}
+}
+
+// spaceCheckCommand exits with exitNoSpace when the file system of the home
+// directory is full or the user is over quota.
+const spaceCheckCommand = "if [ \"$(df -P ~ 2>/dev/null | awk 'NR==2 {print $4}')\" = 0 ]; then exit 203; fi; if command -v quota >/dev/null 2>&1 && [ -n \"$(quota -q 2>/dev/null)\" ]; then exit 203; fi; "
+
+func installCommand(keyData string, force bool) string {
+	if force {
+		return spaceCheckCommand + "mkdir -p ~/.ssh; " + appendLineCommand(keyData, "~/.ssh/authorized_keys")
 	}
-	// cmd.Wait() should be called only after we finish reading
-	// from stdoutIn and stderrIn.
-	// wg ensures that we finish
-	var wg sync.WaitGroup
-	wg.Add(1)
+	return spaceCheckCommand + fmt.Sprintf("if [ ! -e ~/.ssh/authorized_keys ]; then mkdir -p ~/.ssh; touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys; fi; if %s;then exit 201;else %s;fi", keyPresentCommand(keyData, "~/.ssh/authorized_keys"), appendLineCommand(keyData, "~/.ssh/authorized_keys"))
+}
 
-	go func() {
-		errStdout = handleOutput(os.Stdout, stdoutIn)
-		wg.Done()
-	}()
+// keyPresentCommand returns a condition that holds when file has a line
+// with the key of keyData. The base64 blob is compared with every field of
+// the lines, so other options or comments do not matter and a longer entry
+// merely containing the blob does not match.
+func keyPresentCommand(keyData, file string) string {
+	_, key, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return fmt.Sprintf("LC_ALL=C grep -q -x -F -e %s %s", shellQuote(keyData), file)
+	}
+	return fmt.Sprintf("LC_ALL=C awk -v b=%s '{ for (i = 1; i <= NF; i++) if ($i == b) found = 1 } END { exit !found }' %s", base64.StdEncoding.EncodeToString(key.Blob), file)
+}
 
-	errStderr = handleOutput(os.Stderr, stderrIn)
+// appendLineCommand appends line to file. printf is used as echo interprets
+// backslashes in some shells, and the line is quoted, so comments and
+// options with quotes, $ or backticks arrive as they are. Line breaks, which
+// would start another authorized_keys line, become spaces.
+func appendLineCommand(line, file string) string {
+	line = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(line)
+	return "printf '%s\\n' " + shellQuote(line) + " >> " + file
+}
 
-	wg.Wait()
+// listCommand prints the remote authorized_keys without modifying it.
+const listCommand = "cat ~/.ssh/authorized_keys 2>/dev/null || true"
 
-	if errStdout != nil || errStderr != nil {
-		return 1, fmt.Errorf("failed to capture stdout or stderr")
+func grepPatterns(lines []string) string {
+	var patterns string
+	for _, line := range lines {
+		patterns += " -e " + shellQuote(line)
 	}
+	return patterns
+}
+
+// filterCommand drops the exact lines from authorized_keys, keeping the file
+// itself so its permissions are preserved.
+func filterCommand(lines []string) string {
+	return fmt.Sprintf("LC_ALL=C grep -v -x -F%s ~/.ssh/authorized_keys > ~/.ssh/authorized_keys.tmp; cat ~/.ssh/authorized_keys.tmp > ~/.ssh/authorized_keys && rm -f ~/.ssh/authorized_keys.tmp", grepPatterns(lines))
+}
+
+// removeCommand removes the exact lines from authorized_keys and exits with
+// exitKeyNotFound when none of them is present.
+func removeCommand(lines []string) string {
+	return fmt.Sprintf("if ! LC_ALL=C grep -q -x -F%s ~/.ssh/authorized_keys;then exit 202;fi; %s", grepPatterns(lines), filterCommand(lines))
+}
 
-	if err := cmd.Wait(); err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			return exiterr.ExitCode(), err
-		} else {
-			return 1, fmt.Errorf("cmd.Wait: %v", err)
+// reportResults prints the failures of a run and returns the process exit
+// code, which is the exit code of the first host that did not succeed. A key
+// that is already present counts as success unless -error-if-exists is set.
+func reportResults(results []hostResult) int {
+	exitCode := 0
+	for _, r := range results {
+		prefix := ""
+		if len(results) > 1 {
+			prefix = r.Host + ": "
+		}
+		switch r.Status {
+		case statusExists:
+			if !pCommandLineArgs.ErrorIfExists {
+				if !pCommandLineArgs.Quiet {
+					fmt.Fprintf(os.Stderr, "%sPublic key data '%s' already exists in authorized_keys, nothing to do.\n", prefix, pCommandLineArgs.KeyData)
+				}
+				continue
+			}
+			if pCommandLineArgs.Quiet {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "Error execution command:\n\t\n\033[31m%sPublic key data '%s' already exists in authorized_keys.\033[0m\n\n", prefix, pCommandLineArgs.KeyData)
+		case statusFailed:
+			fmt.Fprintf(os.Stderr, "%sError adding key.Reason: %v\n", prefix, r.Error)
+		case statusAborted:
+			fmt.Fprintf(os.Stderr, "%snot attempted, run aborted after too many failures\n", prefix)
+		}
+		if exitCode == 0 {
+			exitCode = r.ExitCode
 		}
 	}
-	ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
-	return ws.ExitStatus(), err
+	return exitCode
 }
 
 func main() {
 
-	if err := validateCommandLineArgs(); err != nil {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd.Run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error running %s:\n\t\033[31m%v\033[0m\n", os.Args[1], err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	if err := validateCommandLineArgs(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "Error parsing command line arguments:\n\t\033[31m%v\033[0m\n", err.Error())
 		printUsage()
 		os.Exit(1)
 	}
+	if pCommandLineArgs.ShowVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if pCommandLineArgs.AllAgentKeys {
+		if err := installAgentKeys(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error installing the agent's keys:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
-	var command string
-	if !pCommandLineArgs.ForceMode {
-		command = fmt.Sprintf("if [[ ! -e ~/.ssh/authorized_keys ]]; then mkdir -p ~/.ssh; touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys; fi; if  grep -q '%s' ~/.ssh/authorized_keys;then exit 201;else echo '%s' >> ~/.ssh/authorized_keys;fi", pCommandLineArgs.KeyData, pCommandLineArgs.KeyData)
-	} else {
-		command = fmt.Sprintf("mkdir -p \"~/.ssh\"; echo '%s' >> ~/.ssh/authorized_keys", pCommandLineArgs.KeyData)
-	}
-
-	exitCode, err := runSSHExec(command)
-	if exitCode == 201 {
-		fmt.Fprintf(os.Stderr, "Error execution command:\n\t\n\033[31mPublic key data '%s' already exists in authorized_keys.\033[0m\n\n", pCommandLineArgs.KeyData)
-		os.Exit(exitCode)
-	} else if err != nil {
-		fmt.Fprintf(os.Stderr, "Error adding key.Reason: %v", err)
-		if exitCode != 0 {
-			os.Exit(exitCode)
-		} else {
+	if err := checkKeyPolicy(pCommandLineArgs.KeyData); err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking key policy:\n\t\033[31m%v\033[0m\n", err.Error())
+		os.Exit(1)
+	}
+	if pCommandLineArgs.remoteTemplate != nil {
+		if _, err := templateInstallCommand(pCommandLineArgs.remoteTemplate, "user@host", pCommandLineArgs.KeyData, pCommandLineArgs.ForceMode); err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking remote template:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if pCommandLineArgs.IdentityFile != pCommandLineArgs.PublicKeyFile {
+		if err := checkKeyPair(pCommandLineArgs.IdentityFile, pCommandLineArgs.KeyData); err != nil {
+			fmt.Fprintf(os.Stderr, "Error checking key pair:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if pCommandLineArgs.RequireSignedBy != "" {
+		if err := checkKeySignature(pCommandLineArgs.PublicKeyFile, pCommandLineArgs.RequireSignedBy, pCommandLineArgs.SignerIdentity); err != nil {
+			fmt.Fprintf(os.Stderr, "Error verifying key signature:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := discoverTargets(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error discovering hosts:\n\t\033[31m%v\033[0m\n", err.Error())
+		os.Exit(1)
+	}
+	if pCommandLineArgs.EC2InstanceConnect != "" {
+		hosts, err := ec2InstanceConnect()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error pushing key with EC2 Instance Connect:\n\t\033[31m%v\033[0m\n", err.Error())
 			os.Exit(1)
 		}
+		if len(hosts) == 0 {
+			return
+		}
+		pCommandLineArgs.Hosts = hosts
+	}
+	if backends := enabledBackends(); len(backends) > 0 {
+		failed := uploadToBackends(backends)
+		if len(pCommandLineArgs.Hosts) == 0 && !pCommandLineArgs.isLocal() {
+			if failed > 0 {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	if pCommandLineArgs.Hardened {
+		pCommandLineArgs.KeyData = withKeyOptions(pCommandLineArgs.HardenedOptions, pCommandLineArgs.KeyData)
+	}
+	if from, err := fromOption(pCommandLineArgs.Hosts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error computing the from= restriction:\n\t\033[31m%v\033[0m\n", err.Error())
+		os.Exit(1)
+	} else if from != "" {
+		pCommandLineArgs.KeyData = withKeyOptions(from, pCommandLineArgs.KeyData)
+	}
+	if !pCommandLineArgs.grantExpires.IsZero() {
+		pCommandLineArgs.KeyData = withKeyOptions(expiryOption(pCommandLineArgs.grantExpires), pCommandLineArgs.KeyData)
+	}
+	if err := checkFlavorKey(pCommandLineArgs.ServerFlavor, pCommandLineArgs.KeyData); err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking key:\n\t\033[31m%v\033[0m\n", err.Error())
+		os.Exit(1)
+	}
+	if pCommandLineArgs.MetricsListen != "" {
+		serveMetrics(pCommandLineArgs.MetricsListen)
+	}
+	if _, err := openChangeAudit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening audit log:\n\t\033[31m%v\033[0m\n", err.Error())
+		os.Exit(1)
+	}
+	if pCommandLineArgs.Events != "" {
+		var err error
+		if events, err = openEventStream(pCommandLineArgs.Events); err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening event stream:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if len(pCommandLineArgs.Hosts) > 1 && pCommandLineArgs.Parallel > 1 {
+		stdout, stderr = newHostPrefixer(os.Stdout), newHostPrefixer(os.Stderr)
+	}
+	if pCommandLineArgs.Quiet {
+		stdout, stderr = nil, nil
+	}
+	if pCommandLineArgs.PreCmd != "" || pCommandLineArgs.PostCmd != "" {
+		stdout = nil
+	}
+	runner, cleanup, err := newFlavorRunner(newRunner(stdout, stderr), pCommandLineArgs.KeyData)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error preparing key upload:\n\t\033[31m%v\033[0m\n", err.Error())
+		os.Exit(1)
+	}
+	if pCommandLineArgs.RefreshHostKey && pCommandLineArgs.Transport == "ssh" {
+		runner = &hostKeyRefreshRunner{Runner: runner, KnownHosts: defaultKnownHostsFile()}
+	}
+	if _, key, err := parseAuthorizedKey(pCommandLineArgs.KeyData); err == nil && keyTypeName(key.Type) == "rsa" && pCommandLineArgs.Transport == "ssh" && !pCommandLineArgs.Quiet {
+		runner = &sha1RSARunner{Runner: runner}
+	}
+	if pCommandLineArgs.Precheck.Enabled && pCommandLineArgs.Transport == "ssh" {
+		runner = &precheckRunner{Runner: runner, TCP: pCommandLineArgs.Precheck.Value == "tcp"}
+	}
+	f := &fleet{
+		Runner:        runner,
+		Parallel:      pCommandLineArgs.Parallel,
+		Metrics:       metrics,
+		MaxFailures:   pCommandLineArgs.MaxFailures,
+		MaxFailurePct: pCommandLineArgs.MaxFailurePct,
+		Interval:      pCommandLineArgs.interval,
+	}
+	if pCommandLineArgs.FailFast {
+		f.MaxFailures = 1
+	}
+	if pCommandLineArgs.StateFile != "" {
+		state, err := loadRunState(pCommandLineArgs.StateFile, keyFingerprints(), pCommandLineArgs.Resume)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading state file:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+		f.Skip, f.OnResult = state.Done, state.Update
+	}
+	var cache *hostCache
+	if pCommandLineArgs.Cache.Enabled && !pCommandLineArgs.ForceMode {
+		path := pCommandLineArgs.Cache.Value
+		if path == "" {
+			path = defaultCachePath()
+		}
+		if cache, err = loadHostCache(path, pCommandLineArgs.CacheTTL); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading cache:\n\t\033[31m%v\033[0m\n", err.Error())
+			os.Exit(1)
+		}
+		skip, fingerprints := f.Skip, keyFingerprints()
+		f.Skip = func(host string) bool {
+			return (skip != nil && skip(host)) || cache.Compliant(host, fingerprints)
+		}
+	}
+	if events != nil {
+		f.OnStart = events.Connect
+		onResult := f.OnResult
+		f.OnResult = func(r hostResult) {
+			if onResult != nil {
+				onResult(r)
+			}
+			events.Install(r)
+		}
+	}
+	var bar *progress
+	if len(pCommandLineArgs.Hosts) > 1 && isTerminal(os.Stderr) && !pCommandLineArgs.Quiet {
+		bar = newProgress(os.Stderr, len(pCommandLineArgs.Hosts))
+		onResult := f.OnResult
+		f.OnResult = func(r hostResult) {
+			if onResult != nil {
+				onResult(r)
+			}
+			bar.Update(r)
+		}
+		f.OnPass = bar.Update
+	}
+	var results []hostResult
+	if pCommandLineArgs.isLocal() {
+		results = []hostResult{installLocal(pCommandLineArgs.KeyData, pCommandLineArgs.ForceMode)}
+	} else {
+		results = f.RunEach(context.Background(), pCommandLineArgs.Hosts, func(host string) string {
+			return withHooks(flavorInstallCommand(host, pCommandLineArgs.KeyData, pCommandLineArgs.ForceMode))
+		})
+		if bar != nil {
+			bar.Finish()
+		}
+		if stdout == nil && !pCommandLineArgs.Quiet {
+			printHookOutput(results)
+		}
+	}
+	cleanup()
+	if cache != nil && !pCommandLineArgs.isLocal() {
+		if err := cache.Record(keyFingerprints(), results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing cache: %v\n", err)
+		}
+	}
+	if !pCommandLineArgs.grantExpires.IsZero() && !pCommandLineArgs.isLocal() {
+		if err := scheduleRevocation(pCommandLineArgs.grantExpires, pCommandLineArgs.KeyData, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error scheduling the revocation: %v\n", err)
+		}
+	}
+	hardeningFailed := 0
+	if pCommandLineArgs.DisablePasswordAuth && pCommandLineArgs.Transport == "ssh" && !pCommandLineArgs.isLocal() && !pCommandLineArgs.DryRun {
+		hardeningFailed = disablePasswordAuth(context.Background(), results)
+	}
+	recordChange("install", keyFingerprints(), results)
+	if pCommandLineArgs.Journal != "" && !pCommandLineArgs.isLocal() {
+		if err := recordJournal(pCommandLineArgs.Journal, pCommandLineArgs.KeyData, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing journal: %v\n", err)
+		}
+	}
+	if pCommandLineArgs.RevocationScript != "" && !pCommandLineArgs.isLocal() {
+		if err := writeRevocationScript(pCommandLineArgs.RevocationScript, pCommandLineArgs.KeyData, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing revocation script: %v\n", err)
+		}
+	}
+	if pCommandLineArgs.ReportFile != "" {
+		if err := writeReport(pCommandLineArgs.ReportFile, "install", keyFingerprints(), results); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+		}
+	}
+	if pCommandLineArgs.NotifyURL != "" {
+		if err := notifyWebhook(pCommandLineArgs.NotifyURL, newRunSummary(keyFingerprints(), results)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sending notification: %v\n", err)
+		}
+	}
+	events.Done(results)
+	exitCode := reportResults(results)
+	if exitCode == 0 && hardeningFailed > 0 {
+		exitCode = 1
 	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKdSJ6CFQW1R6ENgKrNRTew4IaOIhQOkO/wpFaQV7wIt"
+	otherKey  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKMDwyF+GVcgnlEHmp+sYMXXNDfuQc2t8tQt7bn/OLWg"
+	pwnedFile = "pwned"
+)
+
+// quotingCases are key lines whose comments and options try to break out of
+// the quoting of the remote command.
+var quotingCases = []struct {
+	name string
+	line string
+}{
+	{"plain", testKey + " user@host"},
+	{"single quotes", testKey + " it's 'quoted'"},
+	{"double quotes", testKey + ` say "hi"`},
+	{"command substitution", testKey + " $(touch " + pwnedFile + ")"},
+	{"backticks", testKey + " `touch " + pwnedFile + "`"},
+	{"variables", testKey + " $HOME ${PATH}"},
+	{"backslashes", testKey + ` a\nb\\c`},
+	{"leading dash", "-n " + testKey},
+	{"options", `command="echo 'hi' > /dev/null",no-pty ` + testKey + " opts"},
+	{"glob", testKey + " * ?"},
+	{"closing quote", testKey + " '; touch " + pwnedFile + "; '"},
+	{"newline", testKey + " a\ntouch " + pwnedFile},
+	{"crlf", testKey + " a\r\nb"},
+	{"echo flags", testKey + " -e -n --"},
+	{"escaped quotes", testKey + ` \'\"\\`},
+}
+
+// writtenLine returns line as appendLineCommand writes it, with the line
+// breaks turned into spaces.
+func writtenLine(line string) string {
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(line)
+}
+
+func runOn(t *testing.T, r *fakeRunner, host, command string) hostResult {
+	t.Helper()
+	f := &fleet{Runner: r, Parallel: 1}
+	return f.Run(context.Background(), []string{host}, command)[0]
+}
+
+func checkNotPwned(t *testing.T, r *fakeRunner, host string) {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(r.home(host), pwnedFile)); err == nil {
+		t.Errorf("the remote shell ran a command of the key line")
+	}
+}
+
+func TestInstallCommandQuoting(t *testing.T) {
+	for _, tc := range quotingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newFakeRunner(t)
+			if res := runOn(t, r, "h", installCommand(tc.line, false)); res.Status != statusInstalled {
+				t.Fatalf("install: status %s, %s", res.Status, res.Error)
+			}
+			if got, want := r.authorizedKeys("h"), writtenLine(tc.line)+"\n"; got != want {
+				t.Errorf("authorized_keys = %q, want %q", got, want)
+			}
+			if res := runOn(t, r, "h", installCommand(tc.line, false)); res.Status != statusExists {
+				t.Errorf("second install: status %s, want %s", res.Status, statusExists)
+			}
+			if res := runOn(t, r, "h", installCommand(tc.line, true)); res.Status != statusInstalled {
+				t.Errorf("forced install: status %s, %s", res.Status, res.Error)
+			}
+			if got := r.authorizedKeys("h"); got != strings.Repeat(writtenLine(tc.line)+"\n", 2) {
+				t.Errorf("authorized_keys after forced install = %q", got)
+			}
+			checkNotPwned(t, r, "h")
+		})
+	}
+}
+
+func TestKeyPresentCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keyData string
+		present bool
+	}{
+		{"same line", testKey + " a\n", testKey + " a", true},
+		{"other comment", testKey + " a\n", testKey + " $(touch " + pwnedFile + ")", true},
+		{"with options", `from="2001:db8::1" ` + testKey + " a\n", testKey, true},
+		{"other key", otherKey + " a\n", testKey, false},
+		{"longer blob", strings.Replace(testKey, "wIt", "wItX", 1) + "\n", testKey, false},
+		{"blob in comment only", otherKey + " AAAAC3NzaC1lZDI1NTE5\n", testKey, false},
+		{"no file", "", testKey, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newFakeRunner(t)
+			if tc.content != "" {
+				dir := filepath.Join(r.home("h"), ".ssh")
+				os.MkdirAll(dir, 0700)
+				os.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(tc.content), 0600)
+			}
+			command := "if " + keyPresentCommand(tc.keyData, "~/.ssh/authorized_keys") + " 2>/dev/null; then exit 201; fi"
+			got := runOn(t, r, "h", command).Status == statusExists
+			if got != tc.present {
+				t.Errorf("present = %v, want %v", got, tc.present)
+			}
+			checkNotPwned(t, r, "h")
+		})
+	}
+}
+
+func TestRemoveCommandQuoting(t *testing.T) {
+	for _, tc := range quotingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newFakeRunner(t)
+			dir := filepath.Join(r.home("h"), ".ssh")
+			os.MkdirAll(dir, 0700)
+			kept := otherKey + " kept\n"
+			line := writtenLine(tc.line)
+			os.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(line+"\n"+kept), 0600)
+			if res := runOn(t, r, "h", removeCommand([]string{line})); res.Status != statusInstalled {
+				t.Fatalf("remove: status %s, %s", res.Status, res.Error)
+			}
+			if got := r.authorizedKeys("h"); got != kept {
+				t.Errorf("authorized_keys = %q, want %q", got, kept)
+			}
+			if res := runOn(t, r, "h", removeCommand([]string{line})); res.Status != statusNotFound {
+				t.Errorf("second remove: status %s, want %s", res.Status, statusNotFound)
+			}
+			checkNotPwned(t, r, "h")
+		})
+	}
+}
+
+// checkSyntax runs the command through sh -n.
+func checkSyntax(t *testing.T, command string) {
+	t.Helper()
+	if out, err := exec.Command("sh", "-n", "-c", command).CombinedOutput(); err != nil {
+		t.Fatalf("sh -n: %v: %s", err, out)
+	}
+}
+
+func TestAppendLineCommandQuoting(t *testing.T) {
+	for _, tc := range quotingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newFakeRunner(t)
+			command := "mkdir -p ~/.ssh; " + appendLineCommand(tc.line, "~/.ssh/authorized_keys")
+			checkSyntax(t, command)
+			if res := runOn(t, r, "h", command); res.Status != statusInstalled {
+				t.Fatalf("status %s, %s", res.Status, res.Error)
+			}
+			if got, want := r.authorizedKeys("h"), writtenLine(tc.line)+"\n"; got != want {
+				t.Errorf("authorized_keys = %q, want %q", got, want)
+			}
+			checkNotPwned(t, r, "h")
+		})
+	}
+}
+
+func TestRemoveKeyCommandQuoting(t *testing.T) {
+	for _, tc := range quotingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, key, err := parseAuthorizedKey(tc.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := otherKey + " " + writtenLine(key.Comment) + "\n"
+			r := newFakeRunner(t)
+			dir := filepath.Join(r.home("h"), ".ssh")
+			os.MkdirAll(dir, 0700)
+			content := `from="10.0.0.1" ` + writtenLine(key.String()) + "\n" + kept + testKey + " -\n"
+			os.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(content), 0600)
+
+			command := removeKeyCommand([]*publicKey{key})
+			checkSyntax(t, command)
+			if res := runOn(t, r, "h", command); res.Status != statusInstalled {
+				t.Fatalf("remove: status %s, %s", res.Status, res.Error)
+			}
+			if got := r.authorizedKeys("h"); got != kept {
+				t.Errorf("authorized_keys = %q, want %q", got, kept)
+			}
+			if res := runOn(t, r, "h", command); res.Status != statusNotFound {
+				t.Errorf("second remove: status %s, want %s", res.Status, statusNotFound)
+			}
+			checkNotPwned(t, r, "h")
+		})
+	}
+}
+
+func TestParseSSHConfigHosts(t *testing.T) {
+	out := []byte(`Host web
+  HostName 127.0.0.1
+  User vagrant
+  Port 2222
+  IdentityFile "/vm/web/private_key"
+  StrictHostKeyChecking no
+
+Host db
+  HostName 127.0.0.1
+  User vagrant
+  Port 2200
+  IdentityFile /vm/db/private_key
+`)
+	targets := map[string]targetConfig{}
+	hosts, err := parseSSHConfigHosts(out, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"vagrant@web", "vagrant@db"}; !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("hosts = %q, want %q", hosts, want)
+	}
+	want := map[string]targetConfig{
+		"vagrant@web": {Port: 2222, IdentityFile: "/vm/web/private_key", Options: []string{"HostName=127.0.0.1", "StrictHostKeyChecking=no"}},
+		"vagrant@db":  {Port: 2200, IdentityFile: "/vm/db/private_key", Options: []string{"HostName=127.0.0.1"}},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("targets = %+v, want %+v", targets, want)
+	}
+}
+
+func TestParseInventoryMarkers(t *testing.T) {
+	marker := "### ssh-copy-id-0123456789abcdef "
+	tests := []struct {
+		name   string
+		output string
+		marker string
+		files  []string
+	}{
+		{"comment in plain output", "### ops team keys\n" + testKey + " a\n", "", []string{"~/.ssh/authorized_keys"}},
+		{"comment in all users output", marker + "bob /home/bob/.ssh/authorized_keys\n### ops team keys\n" + testKey + " a\n", marker, []string{"/home/bob/.ssh/authorized_keys"}},
+		{"marker of another run", "### ssh-copy-id-ffffffffffffffff bob team\n" + testKey + " a\n", marker, []string{"~/.ssh/authorized_keys"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := parseInventory("alice@h", []byte(tc.output), tc.marker)
+			if len(entries) != 1 || entries[0].File != tc.files[0] {
+				t.Fatalf("entries = %+v, want one in %s", entries, tc.files[0])
+			}
+			files, lines := inventoryFiles([]byte(tc.output), tc.marker)
+			if got := files[len(files)-1]; got != tc.files[0] {
+				t.Errorf("files = %q, want the key in %s", files, tc.files[0])
+			}
+			if got := lines[tc.files[0]]; len(got) == 0 || got[len(got)-1] != testKey+" a" {
+				t.Errorf("lines of %s = %q", tc.files[0], got)
+			}
+		})
+	}
+}
+
+func TestApplyRemovesRawLines(t *testing.T) {
+	key, err := parsePublicKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := otherKey + " kept\n"
+	content := testKey + " a \r\n" + kept
+	plans := []struct {
+		name string
+		plan hostPlan
+	}{
+		{"diff", diffAuthorizedKeys("h", []byte(content), nil, []*publicKey{key})},
+		{"sync", syncPlan("h", []byte(content), []string{otherKey + " kept"})},
+	}
+	for _, p := range plans {
+		if want := []string{testKey + " a \r"}; !reflect.DeepEqual(p.plan.Remove, want) {
+			t.Fatalf("%s: Remove = %q, want %q", p.name, p.plan.Remove, want)
+		}
+		for _, merge := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s merge=%v", p.name, merge), func(t *testing.T) {
+				r := newFakeRunner(t)
+				dir := filepath.Join(r.home("h"), ".ssh")
+				os.MkdirAll(dir, 0700)
+				os.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(content), 0600)
+				f := &fleet{Runner: r, Parallel: 1}
+				command := applyCommand(p.plan)
+				if merge {
+					command = mergeCommand
+					f.Input = func(string) []byte { return mergeInput(p.plan) }
+				}
+				checkSyntax(t, command)
+				if res := f.Run(context.Background(), []string{"h"}, command)[0]; res.Status != statusInstalled {
+					t.Fatalf("apply: status %s, %s", res.Status, res.Error)
+				}
+				if got := r.authorizedKeys("h"); got != kept {
+					t.Errorf("authorized_keys = %q, want %q", got, kept)
+				}
+				if res := f.Run(context.Background(), []string{"h"}, command)[0]; res.Status != statusNotFound {
+					t.Errorf("second apply: status %s, want %s", res.Status, statusNotFound)
+				}
+				if got := r.authorizedKeys("h"); got != kept {
+					t.Errorf("authorized_keys after second apply = %q, want %q", got, kept)
+				}
+			})
+		}
+	}
+}
+
+func TestHostsFileTargets(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(fileName, []byte("# fleet\n[fe80::1%eth0]:2222 user=root\n[2001:db8::1]:2200 tags=prod\nweb[1-2] port=2201 identity=/k jump=bastion\n[2001:db8::2]:2200 port=2300\n"), 0600)
+	targets := map[string]targetConfig{}
+	hosts, err := hostsFileTargets(fileName, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"root@fe80::1%eth0", "2001:db8::1", "web1", "web2", "2001:db8::2"}; !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("hosts = %q, want %q", hosts, want)
+	}
+	web := targetConfig{Port: 2201, IdentityFile: "/k", Options: []string{"ProxyJump=bastion"}}
+	want := map[string]targetConfig{
+		"root@fe80::1%eth0": {Port: 2222},
+		"2001:db8::1":       {Port: 2200, Tags: []string{"prod"}},
+		"web1":              web,
+		"web2":              web,
+		"2001:db8::2":       {Port: 2300},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("targets = %+v, want %+v", targets, want)
+	}
+}
+
+func TestHostArgsOverrideArgs(t *testing.T) {
+	r := &sshRunner{
+		Args:    []string{"-p", "22", "-o", "User=global"},
+		Targets: map[string]targetConfig{"h": {Port: 2222, Options: []string{"User=host"}}},
+	}
+	if got, want := r.hostArgs("h"), []string{"-p", "2222", "-o", "User=host", "-p", "22", "-o", "User=global"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hostArgs(h) = %q, want %q", got, want)
+	}
+	if got := r.hostArgs("other"); !reflect.DeepEqual(got, r.Args) {
+		t.Errorf("hostArgs(other) = %q, want %q", got, r.Args)
+	}
+}
+
+func TestJunosInstallCommand(t *testing.T) {
+	command := serverFlavors["junos"]("admin", testKey+` it's "quoted" \n`, false)
+	want := `set system login user admin authentication ssh-ed25519 "` + testKey + ` it's \"quoted\" \\n"`
+	if lines := strings.Split(command, "\n"); len(lines) != 3 || lines[1] != want {
+		t.Errorf("command = %q, want the statement %q", command, want)
+	}
+	if err := checkFlavorKey("junos", `from="10.0.0.1" `+testKey); err == nil {
+		t.Errorf("a key with options is accepted")
+	}
+	if err := checkFlavorKey("junos", testKey+" a"); err != nil {
+		t.Errorf("checkFlavorKey: %v", err)
+	}
+}
+
+func TestIOSXEInstallCommand(t *testing.T) {
+	blob := strings.Fields(testKey)[1]
+	want := strings.Join(append(append([]string{"configure terminal", "ip ssh pubkey-chain", "username admin", "key-string"},
+		chunkString(blob, 80)...), "exit", "exit", "exit", "end", "write memory"), "\n")
+	for _, keyData := range []string{testKey, testKey + " with comment", `restrict,command="x y" ` + testKey} {
+		if got := serverFlavors["ios-xe"]("admin", keyData, false); got != want {
+			t.Errorf("command for %q = %q, want %q", keyData, got, want)
+		}
+	}
+	if err := checkFlavorKey("ios-xe", `restrict `+testKey); err == nil {
+		t.Errorf("a key with options is accepted")
+	}
+}
+
+func TestESXiInstallCommandQuoting(t *testing.T) {
+	for _, tc := range quotingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			command := serverFlavors["esxi"]("x y; touch "+pwnedFile, tc.line, false)
+			checkSyntax(t, command)
+			file := `'/etc/ssh/keys-x y; touch ` + pwnedFile + `/authorized_keys'`
+			if !strings.Contains(command, appendLineCommand(tc.line, file)) {
+				t.Errorf("the key is not appended with printf to the quoted key file in %q", command)
+			}
+		})
+	}
+}
+
+func TestBusyBoxInstallCommandQuoting(t *testing.T) {
+	for _, tc := range quotingCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newFakeRunner(t)
+			if res := runOn(t, r, "h", busyBoxInstallCommand("u", tc.line, false)); res.Status != statusInstalled {
+				t.Fatalf("install: status %s, %s", res.Status, res.Error)
+			}
+			if got, want := r.authorizedKeys("h"), writtenLine(tc.line)+"\n"; got != want {
+				t.Errorf("authorized_keys = %q, want %q", got, want)
+			}
+			if res := runOn(t, r, "h", busyBoxInstallCommand("u", tc.line, false)); res.Status != statusExists {
+				t.Errorf("second install: status %s, want %s", res.Status, statusExists)
+			}
+			checkNotPwned(t, r, "h")
+		})
+	}
+}
+
+// Keys and signatures made with ssh-keygen for the parser tests. The
+// signatures are of "hello\n" in the file namespace, the certificate of
+// ecdsaKey has serial 42 and is signed by otherKey.
+const (
+	ecdsaKey  = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBDlSvwCS1Pi5zqP4ygn5oO9IMbdiWNcsQEkYMRKZNYc1FuFV8FW+73IS9n4SY5aGoxfPmwmAkosNX+sqIIjUQZY= ec@x"
+	rsaKey    = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCzKd6Vhz+lBXjtyEV54jAe7dwAPPmwuKAHHzgZ4M6st7Jy2LUM3l3zDXBO3nUkAml3dzfX4fIlk+8JcJKJITd5sDgmYAgoqDg+gF2wmXikm7QPVnALguJPtkrRLkKQCfU5Ce+e92X/WHxJ3RhHKnbVOF+j7+1tJp2z1sqi5QvpsML87uQyZEzh5Lc+BMs1sg0nFoiV854sJKaigHzaF3U/anI8eEwsEBnbieOrdF3QCigoET7VawZT07klw+EKnj+HnJg+eZERw8LizHL22TgZp3NsaJIzMVyepuwiE+kE3+9uUl4GOypKU6Fsd1YZCqAESbZ1FRHpVtwU9Iw4jkZn rsa@x"
+	ecdsaCert = "ecdsa-sha2-nistp256-cert-v01@openssh.com AAAAKGVjZHNhLXNoYTItbmlzdHAyNTYtY2VydC12MDFAb3BlbnNzaC5jb20AAAAgxec3bTJ8NUxggSSq81z6m9Q0qs2buxnF+In72lPchIsAAAAIbmlzdHAyNTYAAABBBDlSvwCS1Pi5zqP4ygn5oO9IMbdiWNcsQEkYMRKZNYc1FuFV8FW+73IS9n4SY5aGoxfPmwmAkosNX+sqIIjUQZYAAAAAAAAAKgAAAAEAAAAGY2VydGlkAAAACQAAAAVhbGljZQAAAAAAAAAA//////////8AAAAAAAAAggAAABVwZXJtaXQtWDExLWZvcndhcmRpbmcAAAAAAAAAF3Blcm1pdC1hZ2VudC1mb3J3YXJkaW5nAAAAAAAAABZwZXJtaXQtcG9ydC1mb3J3YXJkaW5nAAAAAAAAAApwZXJtaXQtcHR5AAAAAAAAAA5wZXJtaXQtdXNlci1yYwAAAAAAAAAAAAAAMwAAAAtzc2gtZWQyNTUxOQAAACCjA8MhfhlXIJ5RB5qfrGDF1zQ37kHNrfLULe25/zi1oAAAAFMAAAALc3NoLWVkMjU1MTkAAABAUVOByewbP/vfvpeNyl0j5YLM3NDnW1GE/zHbpSVnoBF4y2SqrINMXoPLkUTaYyPOYbl2dtSh+CtXdmJ33KL+AQ== ec@x"
+
+	ecdsaPKIX = `-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEOVK/AJLU+LnOo/jKCfmg70gxt2JY
+1yxASRgxEpk1hzUW4VXwVb7vchL2fhJjloajF8+bCYCSiw1f6yogiNRBlg==
+-----END PUBLIC KEY-----
+`
+	rsaPKCS1 = `-----BEGIN RSA PUBLIC KEY-----
+MIIBCgKCAQEAsynelYc/pQV47chFeeIwHu3cADz5sLigBx84GeDOrLeycti1DN5d
+8w1wTt51JAJpd3c31+HyJZPvCXCSiSE3ebA4JmAIKKg4PoBdsJl4pJu0D1ZwC4Li
+T7ZK0S5CkAn1OQnvnvdl/1h8Sd0YRyp21Thfo+/tbSads9bKouUL6bDC/O7kMmRM
+4eS3PgTLNbINJxaIlfOeLCSmooB82hd1P2pyPHhMLBAZ24njq3Rd0AooKBE+1WsG
+U9O5JcPhCp4/h5yYPnmREcPC4sxy9tk4GadzbGiSMzFcnqbsIhPpBN/vblJeBjsq
+SlOhbHdWGQqgBEm2dRUR6VbcFPSMOI5GZwIDAQAB
+-----END RSA PUBLIC KEY-----
+`
+	testKeyRFC4716 = `---- BEGIN SSH2 PUBLIC KEY ----
+Comment: "256-bit ED25519, converted by root@vm from OpenSSH"
+AAAAC3NzaC1lZDI1NTE5AAAAIKdSJ6CFQW1R6ENgKrNRTew4IaOIhQOkO/wpFaQV7wIt
+---- END SSH2 PUBLIC KEY ----
+`
+
+	ed25519Signature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgp1InoIVBbVHoQ2Aqs1FN7Dgho4
+iFA6Q7/CkVpBXvAi0AAAAEZmlsZQAAAAAAAAAGc2hhNTEyAAAAUwAAAAtzc2gtZWQyNTUx
+OQAAAECe9M5Id96QSdriiEsLJ+9WJ3zQ4YWTcctuiRprNEZAGL2wOMO7wjm4MCdKGISP3B
+XeA4+fUkBBphKYF5WwYP4L
+-----END SSH SIGNATURE-----
+`
+	ecdsaSignature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAAGgAAAATZWNkc2Etc2hhMi1uaXN0cDI1NgAAAAhuaXN0cDI1NgAAAE
+EEOVK/AJLU+LnOo/jKCfmg70gxt2JY1yxASRgxEpk1hzUW4VXwVb7vchL2fhJjloajF8+b
+CYCSiw1f6yogiNRBlgAAAARmaWxlAAAAAAAAAAZzaGE1MTIAAABkAAAAE2VjZHNhLXNoYT
+ItbmlzdHAyNTYAAABJAAAAIBAMAfRugRj6e3mB/kjuA4QhTe8EicSBDQgiwOQKdE07AAAA
+IQDp94LMp1BKEBeypNN1hBINA0SC2Lqiv/rfa+0ulF2DUA==
+-----END SSH SIGNATURE-----
+`
+	rsaSignature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAARcAAAAHc3NoLXJzYQAAAAMBAAEAAAEBALMp3pWHP6UFeO3IRXniMB
+7t3AA8+bC4oAcfOBngzqy3snLYtQzeXfMNcE7edSQCaXd3N9fh8iWT7wlwkokhN3mwOCZg
+CCioOD6AXbCZeKSbtA9WcAuC4k+2StEuQpAJ9TkJ7573Zf9YfEndGEcqdtU4X6Pv7W0mnb
+PWyqLlC+mwwvzu5DJkTOHktz4EyzWyDScWiJXzniwkpqKAfNoXdT9qcjx4TCwQGduJ46t0
+XdAKKCgRPtVrBlPTuSXD4QqeP4ecmD55kRHDwuLMcvbZOBmnc2xokjMxXJ6m7CIT6QTf72
+5SXgY7KkpToWx3VhkKoARJtnUVEelW3BT0jDiORmcAAAAEZmlsZQAAAAAAAAAGc2hhNTEy
+AAABFAAAAAxyc2Etc2hhMi01MTIAAAEAN58nmmX6aIYC4DxCo5uJO8HupQHxFecftOmXoW
+3XynnrMWfhuGanBKCBPbMyK7SOOcSE0bObtHgqOyedvYpLkO8CKE65OCxcLbcT9ZHYzBsh
+bTI0/ba39kmiMTDS7R0zEmBg0HfhfqdjGnLCbNVATHkY1Tz0gpFFVWKi3uNw5dInMil4ZH
+/yVneETs8YxCfQQ28QjypwEkhS/7qXM7xTm/1eoQMdGZu60VUY1T1YJKnOhBIAOufBaFbp
+UP7cYvwEW54DWcikCSBoiPT8lBp1P9ur8lkDuOMcfeDnjEvRNUtenrSWYKb+Oi4D3K3fug
+NZt19OtZv0RDmGUf5cGzQ3GQ==
+-----END SSH SIGNATURE-----
+`
+)
+
+func TestExpandRange(t *testing.T) {
+	tests := []struct {
+		spec   string
+		values []string
+		err    bool
+	}{
+		{"01-03,07", []string{"01", "02", "03", "07"}, false},
+		{"9-11", []string{"9", "10", "11"}, false},
+		{"a,b", []string{"a", "b"}, false},
+		{"3-1", nil, true},
+		{"1-x", nil, true},
+		{"0-65536", nil, true},
+	}
+	for _, tc := range tests {
+		values, err := expandRange(tc.spec)
+		if (err != nil) != tc.err || !reflect.DeepEqual(values, tc.values) {
+			t.Errorf("expandRange(%q) = %q, %v", tc.spec, values, err)
+		}
+	}
+}
+
+func TestExpandPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		hosts   []string
+		err     bool
+	}{
+		{"web.example.com", []string{"web.example.com"}, false},
+		{"web[1-2].example.com", []string{"web1.example.com", "web2.example.com"}, false},
+		{"r[1-2]n[01-02]", []string{"r1n01", "r1n02", "r2n01", "r2n02"}, false},
+		{"root@[2001:db8::1]:2222", []string{"root@[2001:db8::1]:2222"}, false},
+		{"web[1-2", nil, true},
+		{"web[2-1]", nil, true},
+		{"a[0-255]b[0-255]c[0-255]", nil, true},
+	}
+	for _, tc := range tests {
+		hosts, err := expandPattern(tc.pattern)
+		if (err != nil) != tc.err || !reflect.DeepEqual(hosts, tc.hosts) {
+			t.Errorf("expandPattern(%q) = %q, %v", tc.pattern, hosts, err)
+		}
+	}
+}
+
+func TestUnbracketTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		host   string
+		port   int
+		err    bool
+	}{
+		{"web", "web", 0, false},
+		{"root@web", "root@web", 0, false},
+		{"[2001:db8::1]", "2001:db8::1", 0, false},
+		{"root@[2001:db8::1]:2222", "root@2001:db8::1", 2222, false},
+		{"[fe80::1%eth0]:2222", "fe80::1%eth0", 2222, false},
+		{"root@[fe80::1%25eth0]", "root@fe80::1%25eth0", 0, false},
+		{"[fe80::1%eth0", "", 0, true},
+		{"[::1]2222", "", 0, true},
+		{"[::1]:0", "", 0, true},
+		{"[::1]:65536", "", 0, true},
+	}
+	for _, tc := range tests {
+		host, port, err := unbracketTarget(tc.target)
+		if (err != nil) != tc.err || host != tc.host || port != tc.port {
+			t.Errorf("unbracketTarget(%q) = %q, %d, %v", tc.target, host, port, err)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate     string
+		interval time.Duration
+		err      bool
+	}{
+		{"5/s", 200 * time.Millisecond, false},
+		{"4", 250 * time.Millisecond, false},
+		{"30/m", 2 * time.Second, false},
+		{"100/h", 36 * time.Second, false},
+		{"0.5/s", 2 * time.Second, false},
+		{"0/s", 0, true},
+		{"-1/s", 0, true},
+		{"x/s", 0, true},
+		{"5/d", 0, true},
+	}
+	for _, tc := range tests {
+		interval, err := parseRate(tc.rate)
+		if (err != nil) != tc.err || interval != tc.interval {
+			t.Errorf("parseRate(%q) = %v, %v", tc.rate, interval, err)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+		err  bool
+	}{
+		{"1.2.3", "v1.2.3", 0, false},
+		{"1.2", "1.2.0", 0, false},
+		{"1.10.0", "1.9.9", 1, false},
+		{"1.2.3", "1.3", -1, false},
+		{"1.0.0-rc1", "1.0.0", -1, false},
+		{"1.0.0", "1.0.0-rc1", 1, false},
+		{"1.0.0-rc1", "1.0.0-rc2", -1, false},
+		{"1.0.0-rc2", "1.0.0-rc2", 0, false},
+		{"1.x", "1.0", 0, true},
+		{"1.0", "", 0, true},
+	}
+	for _, tc := range tests {
+		got, err := compareVersions(tc.a, tc.b)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, %v", tc.a, tc.b, got, err)
+		}
+	}
+}
+
+func TestParseINIVars(t *testing.T) {
+	got := parseINIVars([]string{"ansible_user=deploy", `ansible_host="10.0.0.1"`, "ansible_port='2222'", "no_value", "a=b=c"})
+	want := map[string]string{"ansible_user": "deploy", "ansible_host": "10.0.0.1", "ansible_port": "2222", "a": "b=c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseINIVars = %q, want %q", got, want)
+	}
+}
+
+func TestINIInventoryTargets(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "hosts")
+	os.WriteFile(fileName, []byte(`# fleet
+; old style comment
+bastion ansible_host=192.0.2.1
+
+[web]
+web[01:02] ansible_user=deploy
+[db]
+db1 ansible_port=2222 ansible_ssh_private_key_file=/k/db
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ansible_user=ops
+ansible_port="2200"
+
+[all:vars]
+ansible_user=root
+`), 0600)
+	tests := []struct {
+		limit   string
+		hosts   []string
+		targets map[string]targetConfig
+	}{
+		{"", []string{"root@192.0.2.1", "ops@db1", "deploy@web01", "deploy@web02"},
+			map[string]targetConfig{"deploy@web01": {Port: 2200}, "deploy@web02": {Port: 2200}, "ops@db1": {Port: 2222, IdentityFile: "/k/db"}}},
+		{"prod:!db", []string{"deploy@web01", "deploy@web02"},
+			map[string]targetConfig{"deploy@web01": {Port: 2200}, "deploy@web02": {Port: 2200}}},
+		{"bastion,db1", []string{"root@192.0.2.1", "ops@db1"},
+			map[string]targetConfig{"ops@db1": {Port: 2222, IdentityFile: "/k/db"}}},
+	}
+	for _, tc := range tests {
+		targets := map[string]targetConfig{}
+		hosts, err := inventoryTargets(fileName, tc.limit, targets)
+		if err != nil {
+			t.Fatalf("limit %q: %v", tc.limit, err)
+		}
+		if !reflect.DeepEqual(hosts, tc.hosts) {
+			t.Errorf("limit %q: hosts = %q, want %q", tc.limit, hosts, tc.hosts)
+		}
+		if !reflect.DeepEqual(targets, tc.targets) {
+			t.Errorf("limit %q: targets = %+v, want %+v", tc.limit, targets, tc.targets)
+		}
+	}
+	if _, err := inventoryTargets(fileName, "staging", map[string]targetConfig{}); err == nil {
+		t.Errorf("a limit matching no host is accepted")
+	}
+	os.WriteFile(fileName, []byte("[web:other]\nweb1\n"), 0600)
+	if _, err := parseINIInventory(fileName); err == nil {
+		t.Errorf("an unknown section type is accepted")
+	}
+}
+
+func TestKnownHostsTargets(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(fileName, []byte(`# comment
+web.example.com,192.0.2.10 `+testKey+`
+[git.example.com]:2222 `+testKey+`
+[web.example.com]:22 `+otherKey+`
+|1|gqR1yEAdMy86alkncePhTcenzsM=|QVnxksPuObqGvUbmQAMrzOS3gJY= ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKdSJ6CFQW1R6ENgKrNRTew4IaOIhQOkO/wpFaQV7wIt
+@cert-authority *.example.com `+otherKey+`
+@revoked old.example.com `+otherKey+`
+*.internal,!db.internal `+otherKey+`
+broken
+`), 0600)
+	tests := []struct {
+		pattern string
+		hosts   []string
+		targets map[string]targetConfig
+	}{
+		{"", []string{"web.example.com", "192.0.2.10", "git.example.com"}, map[string]targetConfig{"git.example.com": {Port: 2222}}},
+		{"*.example.com", []string{"web.example.com", "git.example.com"}, map[string]targetConfig{"git.example.com": {Port: 2222}}},
+		{"db.example.com", []string{"db.example.com"}, map[string]targetConfig{}},
+	}
+	for _, tc := range tests {
+		targets := map[string]targetConfig{}
+		hosts, err := knownHostsTargets(fileName, tc.pattern, targets)
+		if err != nil {
+			t.Fatalf("pattern %q: %v", tc.pattern, err)
+		}
+		if !reflect.DeepEqual(hosts, tc.hosts) || !reflect.DeepEqual(targets, tc.targets) {
+			t.Errorf("pattern %q: hosts = %q, targets = %+v", tc.pattern, hosts, targets)
+		}
+	}
+	if _, err := knownHostsTargets(fileName, "old.example.com", map[string]targetConfig{}); err == nil {
+		t.Errorf("a @revoked line is taken as a host")
+	}
+}
+
+func TestMatchKnownHostLine(t *testing.T) {
+	hashed := "|1|gqR1yEAdMy86alkncePhTcenzsM=|QVnxksPuObqGvUbmQAMrzOS3gJY= ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKdSJ6CFQW1R6ENgKrNRTew4IaOIhQOkO/wpFaQV7wIt"
+	tests := []struct {
+		line  string
+		name  string
+		match bool
+	}{
+		{"web.example.com,192.0.2.10 " + testKey, "192.0.2.10", true},
+		{"Web.Example.com " + testKey, "web.example.com", true},
+		{"[web.example.com]:2222 " + testKey, "web.example.com", false},
+		{"[web.example.com]:2222 " + testKey, "[web.example.com]:2222", true},
+		{hashed, "db.example.com", true},
+		{hashed, "web.example.com", false},
+		{"@revoked web.example.com " + testKey, "web.example.com", false},
+		{"# web.example.com " + testKey, "web.example.com", false},
+		{"web.example.com", "web.example.com", false},
+	}
+	for _, tc := range tests {
+		key, ok := matchKnownHostLine(tc.line, tc.name)
+		if ok != tc.match {
+			t.Errorf("matchKnownHostLine(%q, %q) = %v, want %v", tc.line, tc.name, ok, tc.match)
+		}
+		if ok && strings.Join(key, " ") != testKey {
+			t.Errorf("matchKnownHostLine(%q, %q) key = %q", tc.line, tc.name, key)
+		}
+	}
+}
+
+func TestSplitConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"  HostName web.example.com", "hostname", []string{"web.example.com"}},
+		{"Port=2222", "port", []string{"2222"}},
+		{"User = deploy", "user", []string{"deploy"}},
+		{"\tIdentityFile \"~/my keys/id\" other", "identityfile", []string{"~/my keys/id", "other"}},
+		{"Match host \"*.example.com\" user root", "match", []string{"host", "*.example.com", "user", "root"}},
+		{"ProxyCommand \"unterminated", "proxycommand", []string{"unterminated"}},
+		{"Compression", "compression", nil},
+		{"# Port 22", "", nil},
+		{"", "", nil},
+	}
+	for _, tc := range tests {
+		keyword, args := splitConfigLine(tc.line)
+		if keyword != tc.keyword || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("splitConfigLine(%q) = %q, %q", tc.line, keyword, args)
+		}
+	}
+}
+
+func TestSSHConfigIncludeMatch(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "conf.d"), 0700)
+	os.WriteFile(filepath.Join(dir, "conf.d", "10-web.conf"), []byte("Host web*\n  Port 2201\n  IdentityFile ~/.ssh/web\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "conf.d", "20-db.conf"), []byte("Host db\n  HostName db.internal\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "loop"), []byte("Include "+filepath.Join(dir, "loop")+"\nPort 2299\n"), 0600)
+	config := filepath.Join(dir, "config")
+	os.WriteFile(config, []byte(`Include `+filepath.Join(dir, "conf.d", "*.conf")+`
+
+Host *.example.com !bastion.example.com
+  ProxyJump bastion.example.com
+
+Match originalhost db host db.internal
+  User dbadmin
+
+Match user deploy !host web*
+  Port 2202
+
+Match exec "true"
+  Port 2203
+
+Host loop
+  Include `+filepath.Join(dir, "loop")+`
+
+Host *
+  IdentityFile ~/.ssh/default
+  Port 22
+`), 0600)
+	tests := []struct {
+		target string
+		want   sshHostConfig
+	}{
+		{"web1", sshHostConfig{"port": {"2201"}, "identityfile": {"~/.ssh/web", "~/.ssh/default"}}},
+		{"app.example.com", sshHostConfig{"proxyjump": {"bastion.example.com"}, "identityfile": {"~/.ssh/default"}, "port": {"22"}}},
+		{"bastion.example.com", sshHostConfig{"identityfile": {"~/.ssh/default"}, "port": {"22"}}},
+		{"db", sshHostConfig{"hostname": {"db.internal"}, "user": {"dbadmin"}, "identityfile": {"~/.ssh/default"}, "port": {"22"}}},
+		{"deploy@app", sshHostConfig{"port": {"2202"}, "identityfile": {"~/.ssh/default"}}},
+		{"deploy@web2", sshHostConfig{"port": {"2201"}, "identityfile": {"~/.ssh/web", "~/.ssh/default"}}},
+		{"loop", sshHostConfig{"port": {"2299"}, "identityfile": {"~/.ssh/default"}}},
+	}
+	for _, tc := range tests {
+		user, host := splitUserHost(tc.target)
+		r := &sshConfigResolver{host: host, user: user, config: sshHostConfig{}, userFile: true}
+		r.readFile(config, 0)
+		if !reflect.DeepEqual(r.config, tc.want) {
+			t.Errorf("%s: config = %q, want %q", tc.target, r.config, tc.want)
+		}
+	}
+}
+
+func TestCheckPEM(t *testing.T) {
+	message := "authenticmessage"
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix := func(key crypto.PublicKey) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	sign := func(signature []byte, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+	sum256, sum384, sum512 := sha256.Sum256([]byte(message)), sha512.Sum384([]byte(message)), sha512.Sum512([]byte(message))
+	sum1 := sha1.Sum([]byte(message))
+	rsaPEM := pkix(&rsaKey.PublicKey)
+	rsaPKCS1PEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)}))
+	ecPEM := pkix(&ecKey.PublicKey)
+	edPEM := pkix(edPublic)
+	pkcs1 := sign(rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum256[:]))
+	pkcs1SHA512 := sign(rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA512, sum512[:]))
+	pkcs1SHA1 := sign(rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA1, sum1[:]))
+	pss := sign(rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA384, sum384[:], nil))
+	ecSignature := sign(ecdsa.SignASN1(rand.Reader, ecKey, sum384[:]))
+	ecSHA256 := sign(ecdsa.SignASN1(rand.Reader, ecKey, sum256[:]))
+	edSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(edKey, []byte(message)))
+	tests := []struct {
+		name      string
+		key       string
+		signature string
+		alg       SignatureAlgorithm
+		ok        bool
+	}{
+		{"rsa default", rsaPEM, pkcs1, "", true},
+		{"rsa pkcs1 pem", rsaPKCS1PEM, pkcs1, "sha256", true},
+		{"rsa sha512", rsaPEM, pkcs1SHA512, "sha512", true},
+		{"rsa wrong hash", rsaPEM, pkcs1SHA512, "sha256", false},
+		{"rsa sha1 refused", rsaPEM, pkcs1SHA1, "sha1", false},
+		{"rsa pss", rsaPEM, pss, "pss-sha384", true},
+		{"rsa pss as pkcs1", rsaPEM, pss, "sha384", false},
+		{"rsa unknown algorithm", rsaPEM, pkcs1, "md5", false},
+		{"ecdsa curve hash", ecPEM, ecSignature, "", true},
+		{"ecdsa sha256", ecPEM, ecSHA256, "sha256", true},
+		{"ecdsa wrong hash", ecPEM, ecSHA256, "", false},
+		{"ecdsa pss", ecPEM, ecSignature, "pss-sha384", false},
+		{"ed25519", edPEM, edSignature, "", true},
+		{"ed25519 other message", edPEM, sign(ed25519.Sign(edKey, []byte("other")), nil), "", false},
+		{"ed25519 with rsa signature", edPEM, pkcs1, "", false},
+		{"not pem", "ssh-ed25519 AAAA", edSignature, "", false},
+		{"not base64", edPEM, "%%%", "", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := CheckPEM(tc.key, tc.signature, message, tc.alg); (err == nil) != tc.ok {
+				t.Errorf("CheckPEM = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestSSHSignatureVerify(t *testing.T) {
+	message := []byte("hello\n")
+	tests := []struct {
+		name      string
+		signature string
+		key       string
+		namespace string
+		message   []byte
+		ok        bool
+	}{
+		{"ed25519", ed25519Signature, testKey, "file", message, true},
+		{"ecdsa", ecdsaSignature, ecdsaKey, "file", message, true},
+		{"rsa", rsaSignature, rsaKey, "file", message, true},
+		{"other namespace", ed25519Signature, testKey, "git", message, false},
+		{"other message", ecdsaSignature, ecdsaKey, "file", []byte("hello"), false},
+		{"flipped bit", strings.Replace(rsaSignature, "UP7cYvwEW54D", "UP7cYvwEW54E", 1), rsaKey, "file", message, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sig, err := parseSSHSignature([]byte(tc.signature))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := parsePublicKey(tc.key)
+			if !sameKey(sig.PublicKey, want) {
+				t.Errorf("signed by %s, want %s", sig.PublicKey.Fingerprint(), want.Fingerprint())
+			}
+			if err := sig.Verify(tc.namespace, tc.message); (err == nil) != tc.ok {
+				t.Errorf("Verify = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+	for _, armored := range []string{testKey, "-----BEGIN SSH SIGNATURE-----\nU1NIU0lHAAAAAg==\n-----END SSH SIGNATURE-----\n", "-----BEGIN SSH SIGNATURE-----\nU1NIU0lHAAAAAQ==\n-----END SSH SIGNATURE-----\n"} {
+		if _, err := parseSSHSignature([]byte(armored)); err == nil {
+			t.Errorf("parseSSHSignature(%q) accepts an invalid signature", armored)
+		}
+	}
+}
+
+func TestVerifyAllowedSignature(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		signers  []string
+		identity string
+		ok       bool
+	}{
+		{"any signer", []string{"alice@example.com " + testKey}, "", true},
+		{"principal", []string{"bob@example.com " + otherKey, "*@example.com " + testKey}, "alice@example.com", true},
+		{"other principal", []string{"bob@example.com " + testKey}, "alice@example.com", false},
+		{"other key", []string{"alice@example.com " + otherKey}, "alice@example.com", false},
+		{"namespace", []string{`alice@example.com namespaces="git,file" ` + testKey}, "alice@example.com", true},
+		{"other namespace", []string{`alice@example.com namespaces="git" ` + testKey}, "alice@example.com", false},
+		{"valid", []string{`alice@example.com valid-after="20250101",valid-before="20270101Z" ` + testKey}, "alice@example.com", true},
+		{"expired", []string{`alice@example.com valid-before="20251231Z" ` + testKey}, "alice@example.com", false},
+		{"not yet valid", []string{`alice@example.com valid-after="202601020000Z" ` + testKey}, "alice@example.com", false},
+		{"cert authority", []string{`alice@example.com cert-authority ` + testKey}, "alice@example.com", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var signers []*allowedSigner
+			for _, line := range tc.signers {
+				signer, err := parseAllowedSigner(line)
+				if err != nil {
+					t.Fatalf("parseAllowedSigner(%q): %v", line, err)
+				}
+				signers = append(signers, signer)
+			}
+			err := verifyAllowedSignature(signers, tc.identity, "file", []byte("hello\n"), []byte(ed25519Signature), now)
+			if (err == nil) != tc.ok {
+				t.Errorf("verifyAllowedSignature = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+	for _, line := range []string{"alice@example.com", `alice@example.com unknown-option ` + testKey, `alice@example.com valid-before="tomorrow" ` + testKey} {
+		if _, err := parseAllowedSigner(line); err == nil {
+			t.Errorf("parseAllowedSigner(%q) accepts an invalid line", line)
+		}
+	}
+}
+
+func TestReadKRL(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		buf, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileName := filepath.Join(dir, name)
+		os.WriteFile(fileName, buf, 0600)
+		return fileName
+	}
+	tests := []struct {
+		name    string
+		krl     string
+		revoked []string
+		allowed []string
+	}{
+		{"explicit key", "U1NIS1JMCgAAAAABAAAAAAAAAAAAAAAAas/U7QAAAAAAAAAAAAAAAAAAAAACAAAANwAAADMAAAALc3NoLWVkMjU1MTkAAAAgp1InoIVBbVHoQ2Aqs1FN7Dgho4iFA6Q7/CkVpBXvAi0=", []string{testKey + " a"}, []string{otherKey, rsaKey}},
+		{"sha256 fingerprint", "U1NIS1JMCgAAAAABAAAAAAAAAAAAAAAAas/U7wAAAAAAAAAAAAAAAAAAAAAFAAAAJAAAACDLYZk3hvXTk9If1ULbIvewCYe6vMltzJNSOfToDKHciQ==", []string{rsaKey}, []string{testKey, ecdsaKey}},
+		{"certificate serial", "U1NIS1JMCgAAAAABAAAAAAAAAAAAAAAAas/U7wAAAAAAAAAAAAAAAAAAAAABAAAASAAAADMAAAALc3NoLWVkMjU1MTkAAAAgowPDIX4ZVyCeUQean6xgxdc0N+5Bza3y1C3tuf84taAAAAAAIAAAAAgAAAAAAAAAKg==", []string{ecdsaCert}, []string{ecdsaKey, otherKey}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := readKRL(write(tc.name, tc.krl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for revoked, lines := range map[bool][]string{true: tc.revoked, false: tc.allowed} {
+				for _, line := range lines {
+					key, err := parsePublicKey(line)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := l.Revoked(key); got != revoked {
+						t.Errorf("Revoked(%s) = %v, want %v", key.Fingerprint(), got, revoked)
+					}
+				}
+			}
+		})
+	}
+	if _, err := readKRL(write("not a krl", base64.StdEncoding.EncodeToString([]byte(testKey)))); err == nil {
+		t.Errorf("a public key is read as a KRL")
+	}
+	if _, err := readKRL(write("truncated", "U1NIS1JMCgAAAAABAAAAAAAAAAAAAAAAas/U7QAAAAAAAAAAAAAAAAAAAAACAAAANwAAADMAAAALc3NoLWVkMjU1MTkAAAAgp1InoIVBbVHoQ2Aqs1FN7Dgho4iFA6Q7/CkVpBXvAi0="[:60])); err == nil {
+		t.Errorf("a truncated KRL is accepted")
+	}
+}
+
+func TestNormalizePublicKey(t *testing.T) {
+	blob := strings.Fields(testKey)[1]
+	ppk := "PuTTY-User-Key-File-3: ssh-ed25519\r\nEncryption: none\r\nComment: laptop key\r\nPublic-Lines: 2\r\n" + blob[:40] + "\r\n" + blob[40:] + "\r\nPrivate-Lines: 1\r\nAAAA\r\n"
+	tests := []struct {
+		name string
+		data string
+		want string
+		err  bool
+	}{
+		{"openssh", testKey + " a\n", testKey + " a", false},
+		{"openssh options", `restrict,command="x y" ` + testKey + " a\n", `restrict,command="x y" ` + testKey + " a", false},
+		{"openssh wrapped", "# key\n" + testKey[:40] + "\n" + testKey[40:] + "\n\n", testKey, false},
+		{"rfc4716", testKeyRFC4716, testKey + " 256-bit ED25519, converted by root@vm from OpenSSH", false},
+		{"rfc4716 continued header", strings.Replace(testKeyRFC4716, `converted by root@vm`, "con\\\nverted by root@vm", 1), testKey + " 256-bit ED25519, converted by root@vm from OpenSSH", false},
+		{"rfc4716 truncated", strings.SplitAfter(testKeyRFC4716, "\n")[0], "", true},
+		{"ppk", ppk, testKey + " laptop key", false},
+		{"ppk version 1", "PuTTY-User-Key-File-1: ssh-rsa\n", "", true},
+		{"ppk no public lines", "PuTTY-User-Key-File-2: ssh-rsa\nComment: x\n", "", true},
+		{"ppk short", "PuTTY-User-Key-File-3: ssh-ed25519\nPublic-Lines: 3\n" + blob + "\n", "", true},
+		{"pkix ecdsa", ecdsaPKIX, strings.Fields(ecdsaKey)[0] + " " + strings.Fields(ecdsaKey)[1], false},
+		{"pkcs1 rsa", rsaPKCS1, strings.Fields(rsaKey)[0] + " " + strings.Fields(rsaKey)[1], false},
+		{"pem garbage", "-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n", "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizePublicKey(tc.data)
+			if (err != nil) != tc.err || got != tc.want {
+				t.Errorf("normalizePublicKey = %q, %v, want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeKeyText(t *testing.T) {
+	utf16 := func(s string, bigEndian bool) []byte {
+		buf := []byte{0xff, 0xfe}
+		if bigEndian {
+			buf = []byte{0xfe, 0xff}
+		}
+		for _, c := range []byte(s) {
+			if bigEndian {
+				buf = append(buf, 0, c)
+			} else {
+				buf = append(buf, c, 0)
+			}
+		}
+		return buf
+	}
+	tests := []struct {
+		name  string
+		buf   []byte
+		text  string
+		fixes []string
+	}{
+		{"plain", []byte(testKey + "\n"), testKey + "\n", nil},
+		{"bom", []byte("\xef\xbb\xbf" + testKey + "\n"), testKey + "\n", []string{"removed the UTF-8 byte order mark"}},
+		{"crlf", []byte(testKey + " a\r\n" + otherKey + "\r\n"), testKey + " a\n" + otherKey + "\n", []string{"converted CRLF line endings"}},
+		{"cr", []byte(testKey + "\r" + otherKey + "\r"), testKey + "\n" + otherKey + "\n", []string{"converted CR line endings"}},
+		{"bom and crlf", []byte("\xef\xbb\xbf" + testKey + "\r\n"), testKey + "\n", []string{"removed the UTF-8 byte order mark", "converted CRLF line endings"}},
+		{"utf-16le", utf16(testKey+"\r\n", false), testKey + "\n", []string{"decoded UTF-16", "converted CRLF line endings"}},
+		{"utf-16be", utf16(testKey+"\n", true), testKey + "\n", []string{"decoded UTF-16"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			text, fixes := normalizeKeyText(tc.buf)
+			if text != tc.text || !reflect.DeepEqual(fixes, tc.fixes) {
+				t.Errorf("normalizeKeyText = %q, %q, want %q, %q", text, fixes, tc.text, tc.fixes)
+			}
+		})
+	}
+}
+
+func TestDiffAuthorizedKeys(t *testing.T) {
+	key, _ := parsePublicKey(testKey + " new")
+	other, _ := parsePublicKey(otherKey)
+	tests := []struct {
+		name           string
+		remote         string
+		add, remove    []*publicKey
+		added, removed []string
+	}{
+		{"add to empty", "", []*publicKey{key}, nil, []string{testKey + " new"}, nil},
+		{"already present", `from="10.0.0.1" ` + testKey + " old\n", []*publicKey{key}, nil, nil, nil},
+		{"only in a comment", "# " + testKey + "\n", []*publicKey{key}, nil, []string{testKey + " new"}, nil},
+		{"remove every line of the key", testKey + " a\n" + otherKey + "\n  " + testKey + " b\t\n", nil, []*publicKey{key}, nil, []string{testKey + " a", "  " + testKey + " b\t"}},
+		{"add and remove", otherKey + " old\r\ngarbage\n", []*publicKey{key}, []*publicKey{other}, []string{testKey + " new"}, []string{otherKey + " old\r"}},
+		{"remove absent", otherKey + "\n", nil, []*publicKey{key}, nil, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hp := diffAuthorizedKeys("h", []byte(tc.remote), tc.add, tc.remove)
+			if !reflect.DeepEqual(hp.Add, tc.added) || !reflect.DeepEqual(hp.Remove, tc.removed) {
+				t.Errorf("plan = add %q, remove %q, want add %q, remove %q", hp.Add, hp.Remove, tc.added, tc.removed)
+			}
+		})
+	}
+}
+
+func TestSyncPlan(t *testing.T) {
+	same := testKey + " a"
+	tests := []struct {
+		name           string
+		remote         string
+		desired        []string
+		added, removed []string
+	}{
+		{"in sync", "# keys\n" + same + "\n\n", []string{same}, nil, nil},
+		{"whitespace only", "  " + testKey + "\t a \r\n", []string{same}, nil, nil},
+		{"other comment", testKey + " b\n", []string{same}, []string{same}, []string{testKey + " b"}},
+		{"other options", `restrict ` + same + "\n", []string{same}, []string{same}, []string{`restrict ` + same}},
+		{"extra key", same + "\n" + otherKey + " x\r\n", []string{same}, nil, []string{otherKey + " x\r"}},
+		{"duplicate desired", "", []string{same, same}, []string{same}, nil},
+		{"empty desired", same + "\n", nil, nil, []string{same}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hp := syncPlan("h", []byte(tc.remote), tc.desired)
+			if !reflect.DeepEqual(hp.Add, tc.added) || !reflect.DeepEqual(hp.Remove, tc.removed) {
+				t.Errorf("plan = add %q, remove %q, want add %q, remove %q", hp.Add, hp.Remove, tc.added, tc.removed)
+			}
+		})
+	}
+}
+
+func TestAuditRecordChangedUsers(t *testing.T) {
+	defer func(users string) { pCommandLineArgs.Users = users }(pCommandLineArgs.Users)
+	tests := []struct {
+		name   string
+		users  string
+		result hostResult
+		want   []string
+	}{
+		{"login user", "", hostResult{Host: "deploy@h", Status: statusInstalled}, []string{"deploy"}},
+		{"users", "alice,bob,carol", hostResult{Host: "h", Status: statusInstalled, Output: []byte("alice: installed\nbob: exists\ncarol: removed\n")}, []string{"alice", "carol"}},
+		{"users unchanged", "alice,bob", hostResult{Host: "h", Status: statusExists, Output: []byte("alice: exists\nbob: exists\n")}, []string{"alice", "bob"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pCommandLineArgs.Users = tc.users
+			l, err := openAuditLog(filepath.Join(t.TempDir(), "audit.log"), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := l.Record("ops", "install", []string{"SHA256:x"}, []hostResult{tc.result}); err != nil {
+				t.Fatal(err)
+			}
+			buf, _ := os.ReadFile(l.path)
+			var users []string
+			for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+				var entry auditEntry
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				users = append(users, entry.User)
+			}
+			if !reflect.DeepEqual(users, tc.want) {
+				t.Errorf("users = %q, want %q", users, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxIncludeDepth limits nested Include directives as ssh does.
+const maxIncludeDepth = 16
+
+// sshHostConfig holds the ssh_config settings applying to a host, keyed by
+// lower-case keyword. As in ssh the first value obtained for a keyword is
+// used, except for IdentityFile, of which every value is kept.
+type sshHostConfig map[string][]string
+
+// Get returns the first value of keyword, or "".
+func (c sshHostConfig) Get(keyword string) string {
+	if values := c[strings.ToLower(keyword)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+type sshConfigResolver struct {
+	host     string // host as given, for Host and Match originalhost
+	user     string // remote user of the target, "" when not given
+	config   sshHostConfig
+	userFile bool // whether the file being read is a user configuration
+	final    bool // whether this is the pass after canonicalization
+	// sawFinal is set when a Match final asks for a final pass.
+	sawFinal  bool
+	canonical bool // whether the hostname has been canonicalized
+}
+
+var (
+	sshConfigMu    sync.Mutex
+	sshConfigCache = map[string]sshHostConfig{}
+)
+
+// resolveSSHConfig evaluates the ssh configuration for a [user@]hostname
+// target the way ssh does: the -F file or ~/.ssh/config and then
+// /etc/ssh/ssh_config, honouring Include and the host, originalhost, user,
+// localuser, all, canonical and final criteria of Match. Other Match
+// criteria, such as exec, never match. Unreadable files are skipped. When
+// the hostname is canonicalized, HostName holds the canonical name.
+func resolveSSHConfig(target string) sshHostConfig {
+	sshConfigMu.Lock()
+	defer sshConfigMu.Unlock()
+	if c, ok := sshConfigCache[target]; ok {
+		return c
+	}
+	user, host := splitUserHost(target)
+	r := &sshConfigResolver{host: host, user: user, config: sshHostConfig{}}
+	r.readConfig()
+	hostname := r.hostname()
+	canonical, ok := canonicalizeHostname(hostname, r.config)
+	if ok || r.sawFinal {
+		// Like ssh, read the configuration again for the canonical name,
+		// keeping the values obtained so far.
+		hadHostName := r.config.Get("hostname") != ""
+		if ok {
+			r.host, r.canonical = canonical, true
+		}
+		r.final = true
+		r.readConfig()
+		if ok {
+			r.host = host
+			if hadHostName || r.config.Get("hostname") == "" {
+				r.config["hostname"] = []string{canonical}
+			} else {
+				r.config["hostname"] = []string{strings.ReplaceAll(r.config.Get("hostname"), "%h", canonical)}
+			}
+		}
+	}
+	sshConfigCache[target] = r.config
+	return r.config
+}
+
+func (r *sshConfigResolver) readConfig() {
+	if pCommandLineArgs.AlternateSshConfigFile != "" {
+		r.userFile = true
+		r.readFile(expandHome(pCommandLineArgs.AlternateSshConfigFile), 0)
+		return
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		r.userFile = true
+		r.readFile(filepath.Join(home, ".ssh", "config"), 0)
+	}
+	r.userFile = false
+	r.readFile("/etc/ssh/ssh_config", 0)
+}
+
+// canonicalizeHostname resolves hostname within the CanonicalDomains like
+// ssh's CanonicalizeHostname, which -canonicalize turns on. It reports
+// whether hostname was canonicalized.
+func canonicalizeHostname(hostname string, config sshHostConfig) (string, bool) {
+	mode := strings.ToLower(config.Get("CanonicalizeHostname"))
+	if pCommandLineArgs.Canonicalize && mode != "always" {
+		mode = "yes"
+	}
+	if mode != "yes" && mode != "always" {
+		return "", false
+	}
+	if mode == "yes" && (isSet(config.Get("ProxyCommand")) || isSet(config.Get("ProxyJump"))) {
+		return "", false
+	}
+	if address, _, _ := strings.Cut(hostname, "%"); net.ParseIP(address) != nil {
+		return "", false
+	}
+	if name, ok := strings.CutSuffix(hostname, "."); ok {
+		return name, true
+	}
+	maxDots := 1
+	if n, err := strconv.Atoi(config.Get("CanonicalizeMaxDots")); err == nil {
+		maxDots = n
+	}
+	if strings.Count(hostname, ".") > maxDots {
+		return "", false
+	}
+	for _, domain := range config["canonicaldomains"] {
+		name := hostname + "." + strings.TrimSuffix(domain, ".")
+		if _, err := net.LookupHost(name); err == nil {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func isSet(value string) bool {
+	return value != "" && !strings.EqualFold(value, "none")
+}
+
+// hostname returns the HostName so far, which Match host matches.
+func (r *sshConfigResolver) hostname() string {
+	if hostname := r.config.Get("hostname"); hostname != "" {
+		return strings.ReplaceAll(hostname, "%h", r.host)
+	}
+	return r.host
+}
+
+func (r *sshConfigResolver) readFile(fileName string, depth int) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	active := true
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		keyword, args := splitConfigLine(scanner.Text())
+		switch keyword {
+		case "":
+		case "host":
+			active = r.matchHost(args)
+		case "match":
+			active = r.matchCriteria(args)
+		case "include":
+			if active && depth < maxIncludeDepth {
+				for _, pattern := range args {
+					r.include(pattern, depth+1)
+				}
+			}
+		default:
+			if !active {
+				continue
+			}
+			if _, seen := r.config[keyword]; !seen || keyword == "identityfile" {
+				r.config[keyword] = append(r.config[keyword], args...)
+			}
+		}
+	}
+}
+
+// include reads the files matching pattern, which unless absolute is
+// relative to ~/.ssh for user and /etc/ssh for system configuration.
+func (r *sshConfigResolver) include(pattern string, depth int) {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		dir := "/etc/ssh"
+		if r.userFile {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return
+			}
+			dir = filepath.Join(home, ".ssh")
+		}
+		pattern = filepath.Join(dir, pattern)
+	}
+	files, _ := filepath.Glob(pattern)
+	for _, fileName := range files {
+		r.readFile(fileName, depth)
+	}
+}
+
+func (r *sshConfigResolver) matchHost(patterns []string) bool {
+	var list []string
+	for _, arg := range patterns {
+		list = append(list, strings.Split(strings.ToLower(arg), ",")...)
+	}
+	return matchPatternList(list, strings.ToLower(r.host))
+}
+
+// matchCriteria evaluates the criteria of a Match line, which all have to
+// match.
+func (r *sshConfigResolver) matchCriteria(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negated := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		switch criterion {
+		case "all", "canonical", "final":
+			if criterion == "final" {
+				r.sawFinal = true
+			}
+			matched := criterion == "all" || (criterion == "canonical" && r.canonical) || (criterion == "final" && r.final)
+			if matched == negated {
+				return false
+			}
+			continue
+		}
+		if i+1 >= len(args) {
+			return false
+		}
+		i++
+		patterns := strings.Split(args[i], ",")
+		var matched bool
+		switch criterion {
+		case "host":
+			matched = matchPatternList(lowerAll(patterns), strings.ToLower(r.hostname()))
+		case "originalhost":
+			matched = matchPatternList(lowerAll(patterns), strings.ToLower(r.host))
+		case "user":
+			user := r.user
+			if user == "" {
+				user = r.config.Get("user")
+			}
+			if user == "" {
+				user = currentActor()
+			}
+			matched = matchPatternList(patterns, user)
+		case "localuser":
+			matched = matchPatternList(patterns, currentActor())
+		default:
+			return false
+		}
+		if matched == negated {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerAll(values []string) []string {
+	lower := make([]string, len(values))
+	for i, v := range values {
+		lower[i] = strings.ToLower(v)
+	}
+	return lower
+}
+
+// splitConfigLine returns the lower-case keyword and the arguments of an
+// ssh_config line, which may separate them with = and quote arguments.
+func splitConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				arg, rest = rest[1:], ""
+			} else {
+				arg, rest = rest[1:closing+1], rest[closing+2:]
+			}
+		} else if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			arg, rest = rest[:i], rest[i:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return keyword, args
+}
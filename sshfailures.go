@@ -0,0 +1,59 @@
+package main
+
+import "bytes"
+
+// sshFailures maps messages ssh prints when it gives up to an explanation
+// and fix, and the sentinel error of the failure if any. The more specific
+// messages come first.
+var sshFailures = []struct {
+	message     string
+	explanation string
+	kind        error
+}{
+	{"Too many authentication failures",
+		"the server's MaxAuthTries was used up by the keys offered before the password prompt, likely an agent holding many keys; give the key with -i, which sets IdentitiesOnly=yes, or remove keys from the agent with ssh-add -D", ErrAuthFailed},
+	{"Permission denied (publickey).",
+		"the server only accepts public keys, so there is no password login to install the key with; log in with a key that is already authorized, e.g. -o IdentityFile=~/.ssh/old_key, or enable PasswordAuthentication on the server temporarily", ErrAuthFailed},
+	{"Permission denied",
+		"authentication failed; check the user name in user@host and the password", ErrAuthFailed},
+	{"REMOTE HOST IDENTIFICATION HAS CHANGED",
+		"the host key differs from the one in known_hosts; when the host was reinstalled use -refresh-hostkey, otherwise find out why before connecting", nil},
+	{"Host key verification failed",
+		"the host key could not be verified against known_hosts; check its fingerprint and accept it interactively, or add it with ssh-keyscan", nil},
+	{"Could not resolve hostname",
+		"the host name does not resolve; check the spelling, DNS and the HostName of the ssh configuration", ErrHostUnreachable},
+	{"Connection refused",
+		"nothing listens on the ssh port; check -p and that sshd is running", ErrHostUnreachable},
+	{"timed out",
+		"the host did not answer; check the address, the port and firewalls on the way", ErrHostUnreachable},
+	{"No route to host",
+		"the host is unreachable from here; check the address and the network, a jump host may be needed (-o ProxyJump=...)", ErrHostUnreachable},
+	{"no matching host key type found",
+		"the server only offers legacy host key types; allow one for this host, e.g. -o HostKeyAlgorithms=+ssh-rsa", nil},
+	{"no matching key exchange method found",
+		"the server only offers legacy key exchange methods; allow one for this host, e.g. -o KexAlgorithms=+diffie-hellman-group14-sha1", nil},
+	{"kex_exchange_identification",
+		"the server closed the connection before authentication, e.g. because of MaxStartups, fail2ban or TCP wrappers; retry later or with a lower -parallel", ErrHostUnreachable},
+}
+
+// explainSSHFailure returns an explanation of why ssh failed, judging by its
+// stderr, and its sentinel error, or "" for unknown failures.
+func explainSSHFailure(stderr []byte) (string, error) {
+	for _, f := range sshFailures {
+		if bytes.Contains(stderr, []byte(f.message)) {
+			return f.explanation, f.kind
+		}
+	}
+	return "", nil
+}
+
+// isWriteDenied reports whether a remote command failed because it could
+// not write, judging by its stderr.
+func isWriteDenied(stderr []byte) bool {
+	for _, message := range []string{"Permission denied", "Read-only file system", "Operation not permitted"} {
+		if bytes.Contains(stderr, []byte(message)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type (
+	// sshSignature is a signature in the SSHSIG format of ssh-keygen -Y sign.
+	sshSignature struct {
+		PublicKey *publicKey
+		Namespace string
+		HashAlg   string
+		Format    string
+		Blob      []byte
+	}
+
+	// allowedSigner is a line of an allowed_signers file, see the ALLOWED
+	// SIGNERS section of ssh-keygen(1).
+	allowedSigner struct {
+		Principals    []string
+		Namespaces    []string
+		CertAuthority bool
+		ValidAfter    time.Time
+		ValidBefore   time.Time
+		Key           *publicKey
+	}
+
+	// wireReader decodes the SSH wire encoding of RFC 4251.
+	wireReader struct {
+		buf []byte
+		err error
+	}
+)
+
+func (r *wireReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < 4 {
+		r.err = fmt.Errorf("truncated data")
+		return nil
+	}
+	n := binary.BigEndian.Uint32(r.buf)
+	if uint64(len(r.buf)-4) < uint64(n) {
+		r.err = fmt.Errorf("truncated data")
+		return nil
+	}
+	value := r.buf[4 : 4+n]
+	r.buf = r.buf[4+n:]
+	return value
+}
+
+func (r *wireReader) fixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = fmt.Errorf("truncated data")
+		return nil
+	}
+	value := r.buf[:n]
+	r.buf = r.buf[n:]
+	return value
+}
+
+func (r *wireReader) uint32() uint32 {
+	if value := r.fixed(4); value != nil {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+func (r *wireReader) uint64() uint64 {
+	if value := r.fixed(8); value != nil {
+		return binary.BigEndian.Uint64(value)
+	}
+	return 0
+}
+
+func (r *wireReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *wireReader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
+
+func wireString(s []byte) []byte {
+	buf := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// cryptoKey decodes the key blob into a crypto public key.
+func (k *publicKey) cryptoKey() (crypto.PublicKey, error) {
+	r := &wireReader{buf: k.Blob}
+	keyType := r.string()
+	var key crypto.PublicKey
+	switch keyType {
+	case "ssh-ed25519":
+		key = ed25519.PublicKey(r.bytes())
+		if r.err == nil && len(key.(ed25519.PublicKey)) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+	case "ssh-rsa":
+		e, n := r.mpint(), r.mpint()
+		key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		curve := map[string]elliptic.Curve{"nistp256": elliptic.P256(), "nistp384": elliptic.P384(), "nistp521": elliptic.P521()}[r.string()]
+		point := r.bytes()
+		if r.err == nil {
+			if curve == nil {
+				return nil, fmt.Errorf("invalid ecdsa curve")
+			}
+			x, y := elliptic.Unmarshal(curve, point)
+			if x == nil {
+				return nil, fmt.Errorf("invalid ecdsa point")
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", keyType)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid %s key: %v", keyType, r.err)
+	}
+	return key, nil
+}
+
+// parseSSHSignature decodes an armored SSHSIG signature.
+func parseSSHSignature(armored []byte) (*sshSignature, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, fmt.Errorf("not an SSH signature")
+	}
+	if !bytes.HasPrefix(block.Bytes, []byte("SSHSIG")) {
+		return nil, fmt.Errorf("invalid SSH signature magic")
+	}
+	r := &wireReader{buf: block.Bytes[6:]}
+	if len(r.buf) < 4 || binary.BigEndian.Uint32(r.buf) != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version")
+	}
+	r.buf = r.buf[4:]
+	keyBlob := r.bytes()
+	sig := &sshSignature{Namespace: r.string()}
+	r.bytes() // reserved
+	sig.HashAlg = r.string()
+	sigReader := &wireReader{buf: r.bytes()}
+	sig.Format, sig.Blob = sigReader.string(), sigReader.bytes()
+	if r.err != nil || sigReader.err != nil {
+		return nil, fmt.Errorf("truncated SSH signature")
+	}
+	keyType := (&wireReader{buf: keyBlob}).string()
+	sig.PublicKey = &publicKey{Type: keyType, Blob: keyBlob}
+	return sig, nil
+}
+
+// Verify checks the signature of message made in namespace.
+func (s *sshSignature) Verify(namespace string, message []byte) error {
+	if s.Namespace != namespace {
+		return fmt.Errorf("signature namespace %q does not match %q", s.Namespace, namespace)
+	}
+	var messageHash []byte
+	switch s.HashAlg {
+	case "sha256":
+		sum := sha256.Sum256(message)
+		messageHash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(message)
+		messageHash = sum[:]
+	default:
+		return fmt.Errorf("unsupported signature hash %q", s.HashAlg)
+	}
+	signed := []byte("SSHSIG")
+	for _, field := range [][]byte{[]byte(s.Namespace), nil, []byte(s.HashAlg), messageHash} {
+		signed = append(signed, wireString(field)...)
+	}
+	key, err := s.PublicKey.cryptoKey()
+	if err != nil {
+		return err
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		if s.Format == "ssh-ed25519" && ed25519.Verify(key, signed, s.Blob) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		hash := map[string]crypto.Hash{"rsa-sha2-256": crypto.SHA256, "rsa-sha2-512": crypto.SHA512}[s.Format]
+		if hash == 0 {
+			return fmt.Errorf("unsupported RSA signature format %q", s.Format)
+		}
+		if rsa.VerifyPKCS1v15(key, hash, digest(hash, string(signed)), s.Blob) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		r := &wireReader{buf: s.Blob}
+		sr, ss := r.mpint(), r.mpint()
+		if s.Format == s.PublicKey.Type && r.err == nil && ecdsa.Verify(key, digest(ecdsaHash(key.Curve), string(signed)), sr, ss) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s signature", s.PublicKey.Type)
+}
+
+// matchPatternList matches s against a comma separated list of patterns,
+// where a pattern starting with ! excludes.
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), s); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// parseSignerTime parses the YYYYMMDD[HHMM[SS]][Z] times of valid-after and
+// valid-before, local time unless suffixed with Z.
+func parseSignerTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		value, loc = strings.TrimSuffix(value, "Z"), time.UTC
+	}
+	layout := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}[len(value)]
+	if layout == "" {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// parseAllowedSigner parses an allowed_signers line.
+func parseAllowedSigner(line string) (*allowedSigner, error) {
+	principals, rest := splitOptions(line)
+	if rest == "" {
+		return nil, fmt.Errorf("missing key")
+	}
+	options, key, err := parseAuthorizedKey(rest)
+	if err != nil {
+		return nil, err
+	}
+	signer := &allowedSigner{Principals: strings.Split(strings.Trim(principals, `"`), ","), Key: key}
+	for _, option := range splitTopLevelQuoted(options) {
+		name, value, _ := strings.Cut(option, "=")
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(name) {
+		case "cert-authority":
+			signer.CertAuthority = true
+		case "namespaces":
+			signer.Namespaces = strings.Split(value, ",")
+		case "valid-after":
+			if signer.ValidAfter, err = parseSignerTime(value); err != nil {
+				return nil, err
+			}
+		case "valid-before":
+			if signer.ValidBefore, err = parseSignerTime(value); err != nil {
+				return nil, err
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+	}
+	return signer, nil
+}
+
+// splitTopLevelQuoted splits options at commas outside double quotes.
+func splitTopLevelQuoted(options string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, c := range options {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, options[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, options[start:])
+}
+
+// readAllowedSigners reads an allowed_signers file.
+func readAllowedSigners(fileName string) ([]*allowedSigner, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var signers []*allowedSigner
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		signer, err := parseAllowedSigner(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fileName, lineNo, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, scanner.Err()
+}
+
+// verifyAllowedSignature checks that the armored signature of message in
+// namespace was made by a key allowed_signers lists for identity at now,
+// like ssh-keygen -Y verify. An empty identity accepts every listed signer.
+// Certificate signers are not supported.
+func verifyAllowedSignature(signers []*allowedSigner, identity, namespace string, message, armored []byte, now time.Time) error {
+	sig, err := parseSSHSignature(armored)
+	if err != nil {
+		return err
+	}
+	if err := sig.Verify(namespace, message); err != nil {
+		return err
+	}
+	for _, signer := range signers {
+		if signer.CertAuthority || !sameKey(signer.Key, sig.PublicKey) || (identity != "" && !matchPatternList(signer.Principals, identity)) {
+			continue
+		}
+		if signer.Namespaces != nil && !matchPatternList(signer.Namespaces, namespace) {
+			continue
+		}
+		if (!signer.ValidAfter.IsZero() && now.Before(signer.ValidAfter)) || (!signer.ValidBefore.IsZero() && !now.Before(signer.ValidBefore)) {
+			continue
+		}
+		return nil
+	}
+	if identity == "" {
+		return fmt.Errorf("signing key %s is not an allowed signer", sig.PublicKey.Fingerprint())
+	}
+	return fmt.Errorf("signing key %s is not allowed for %s", sig.PublicKey.Fingerprint(), identity)
+}
+
+// checkKeySignature verifies pubFile.sig, made with ssh-keygen -Y sign -n
+// file, against signersFile, which is an allowed_signers file or, for a
+// single trusted key such as a CA, a public key file.
+func checkKeySignature(pubFile, signersFile, identity string) error {
+	signers, err := readAllowedSigners(signersFile)
+	if err != nil {
+		return err
+	}
+	message, err := os.ReadFile(pubFile)
+	if err != nil {
+		return err
+	}
+	armored, err := os.ReadFile(pubFile + ".sig")
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is not signed, %s.sig is missing", pubFile, pubFile)
+	} else if err != nil {
+		return err
+	}
+	if err := verifyAllowedSignature(signers, identity, "file", message, armored, time.Now()); err != nil {
+		return fmt.Errorf("%s: %v", pubFile, err)
+	}
+	return nil
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	signersFile := fs.String("f", "", "allowed_signers file")
+	identity := fs.String("I", "", "Identity the signer must be allowed for")
+	namespace := fs.String("n", "file", "Signature namespace")
+	sigFile := fs.String("s", "", "Signature file, defaults to the file name with .sig appended")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *signersFile == "" || *identity == "" {
+		return fmt.Errorf("usage: verify -f allowed_signers -I identity [-n namespace] [-s file.sig] file")
+	}
+	if *sigFile == "" {
+		*sigFile = fs.Arg(0) + ".sig"
+	}
+	signers, err := readAllowedSigners(*signersFile)
+	if err != nil {
+		return err
+	}
+	message, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	armored, err := os.ReadFile(*sigFile)
+	if err != nil {
+		return err
+	}
+	if err := verifyAllowedSignature(signers, *identity, *namespace, message, armored, time.Now()); err != nil {
+		return err
+	}
+	fmt.Printf("Good %q signature for %s\n", *namespace, *identity)
+	return nil
+}
+
+func init() {
+	subcommands["verify"] = subcommand{"Verify a ssh-keygen -Y sign signature against allowed_signers", runVerify}
+}
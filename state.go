@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// runState records the per-host progress of a run, so an interrupted run
+// can be resumed without contacting the hosts that are already done.
+type runState struct {
+	mu           sync.Mutex
+	path         string
+	Fingerprints []string              `json:"fingerprints"`
+	Hosts        map[string]hostResult `json:"hosts"`
+}
+
+// loadRunState opens the state file at path. Unless resume is set the
+// previous content is discarded.
+func loadRunState(path string, fingerprints []string, resume bool) (*runState, error) {
+	s := &runState{path: path, Fingerprints: fingerprints, Hosts: map[string]hostResult{}}
+	if !resume {
+		return s, s.save()
+	}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, s.save()
+	} else if err != nil {
+		return nil, err
+	}
+	var previous runState
+	if err := json.Unmarshal(buf, &previous); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if fmt.Sprint(previous.Fingerprints) != fmt.Sprint(fingerprints) {
+		return nil, fmt.Errorf("state file %s was written for keys %v", path, previous.Fingerprints)
+	}
+	if previous.Hosts != nil {
+		s.Hosts = previous.Hosts
+	}
+	return s, nil
+}
+
+// save writes the state to a temporary file and renames it into place.
+func (s *runState) save() error {
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Done reports whether host was completed by a previous run.
+func (s *runState) Done(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.Hosts[host]
+	return ok && (r.Status == statusInstalled || r.Status == statusExists)
+}
+
+func (s *runState) Update(r hostResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Hosts[r.Host] = r
+	if err := s.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving state file: %v\n", err)
+	}
+}
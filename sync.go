@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// manifestKey is a key of the manifest, given inline or as a file
+	// relative to the manifest, with the options and comment it should be
+	// installed with.
+	manifestKey struct {
+		Key     string `yaml:"key"`
+		File    string `yaml:"file"`
+		Options string `yaml:"options"`
+		Comment string `yaml:"comment"`
+	}
+
+	// manifestGroup gives its hosts keys. The group name and Tags become
+	// tags of the hosts for -tag and -exclude-tag.
+	manifestGroup struct {
+		Hosts []string `yaml:"hosts"`
+		Keys  []string `yaml:"keys"`
+		Tags  []string `yaml:"tags"`
+	}
+
+	// keyManifest is the desired set of keys per host: every host gets the
+	// keys of its groups and of its own entry, and nothing else.
+	keyManifest struct {
+		Keys   map[string]manifestKey   `yaml:"keys"`
+		Groups map[string]manifestGroup `yaml:"groups"`
+		Hosts  map[string][]string      `yaml:"hosts"`
+	}
+)
+
+// parseManifest parses a manifest; key files are relative to dir. A signed
+// manifest may not refer to key files, which the signature does not cover.
+func parseManifest(buf []byte, dir string, signed bool) (map[string][]string, error) {
+	var m keyManifest
+	if err := yaml.Unmarshal(buf, &m); err != nil {
+		return nil, err
+	}
+	lines := map[string]string{}
+	for name, mk := range m.Keys {
+		data := mk.Key
+		if mk.File != "" && signed {
+			return nil, fmt.Errorf("key %s: key files are not covered by the signature, give the key inline", name)
+		}
+		if mk.File != "" {
+			path := expandHome(mk.File)
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", name, err)
+			}
+			data = string(content)
+		}
+		key, err := parsePublicKey(strings.TrimSpace(data))
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", name, err)
+		}
+		if mk.Comment != "" {
+			key.Comment = mk.Comment
+		}
+		line := key.String()
+		if mk.Options != "" {
+			if err := validateOptions(mk.Options); err != nil {
+				return nil, fmt.Errorf("key %s: %v", name, err)
+			}
+			line = mk.Options + " " + line
+		}
+		if err := checkKeyPolicy(line); err != nil {
+			return nil, fmt.Errorf("key %s: %v", name, err)
+		}
+		lines[name] = line
+	}
+	desired := map[string][]string{}
+	add := func(patterns, keys []string, where string) error {
+		hosts, err := expandHosts(patterns)
+		if err != nil {
+			return fmt.Errorf("%s: %v", where, err)
+		}
+		for _, name := range keys {
+			line, ok := lines[name]
+			if !ok {
+				return fmt.Errorf("%s: unknown key %q", where, name)
+			}
+			for _, host := range hosts {
+				desired[host] = append(desired[host], line)
+			}
+		}
+		return nil
+	}
+	for name, g := range m.Groups {
+		if err := add(g.Hosts, g.Keys, "group "+name); err != nil {
+			return nil, err
+		}
+		hosts, _ := expandHosts(g.Hosts)
+		for _, host := range hosts {
+			t := pCommandLineArgs.Targets[host]
+			t.Tags = append(append(t.Tags, name), g.Tags...)
+			pCommandLineArgs.Targets[host] = t
+		}
+	}
+	for host, keys := range m.Hosts {
+		if err := add([]string{host}, keys, "host "+host); err != nil {
+			return nil, err
+		}
+	}
+	for host, keys := range desired {
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("host %s has no keys, refusing to remove all of them", host)
+		}
+	}
+	return desired, nil
+}
+
+// readManifest reads a manifest. With a trusted key the detached signature
+// in sigFile, by default the manifest name with .sig appended, must verify.
+func readManifest(fileName, sigFile, trustedFile string) (map[string][]string, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if trustedFile != "" {
+		if sigFile == "" {
+			sigFile = fileName + ".sig"
+		}
+		signature, err := os.ReadFile(sigFile)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s is not signed, %s is missing", fileName, sigFile)
+		} else if err != nil {
+			return nil, err
+		}
+		if err := VerifyDetached(trustedFile, buf, signature); err != nil {
+			return nil, fmt.Errorf("%s: signature verification failed: %v", fileName, err)
+		}
+	}
+	desired, err := parseManifest(buf, filepath.Dir(fileName), trustedFile != "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return desired, nil
+}
+
+// normalizedLine returns a parsed authorized_keys line with the spacing
+// normalized, so lines differing only in whitespace compare equal.
+func normalizedLine(options string, key *publicKey) string {
+	if options == "" {
+		return key.String()
+	}
+	return options + " " + key.String()
+}
+
+// syncPlan computes the changes turning the remote authorized_keys into
+// exactly the desired lines. A key present with other options or comment is
+// replaced.
+func syncPlan(host string, remote []byte, desired []string) hostPlan {
+	hp := hostPlan{Host: host}
+	satisfied := map[string]bool{}
+	for _, raw := range strings.Split(string(remote), "\n") {
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		options, key, err := parseAuthorizedKey(trimmed)
+		if err != nil {
+			continue
+		}
+		line := normalizedLine(options, key)
+		wanted := false
+		for _, d := range desired {
+			if d == line {
+				wanted = true
+			}
+		}
+		if wanted {
+			satisfied[line] = true
+		} else {
+			hp.Remove = append(hp.Remove, raw)
+		}
+	}
+	for _, d := range desired {
+		if !satisfied[d] {
+			satisfied[d] = true
+			hp.Add = append(hp.Add, d)
+		}
+	}
+	return hp
+}
+
+// result returns the lines of the remote authorized_keys after applyCommand
+// made the changes of the plan.
+func (hp hostPlan) result(remote []byte) []string {
+	removed := map[string]bool{}
+	for _, line := range hp.Remove {
+		removed[line] = true
+	}
+	var lines []string
+	for _, line := range contentLines(remote) {
+		if !removed[line] {
+			lines = append(lines, line)
+		}
+	}
+	return append(lines, hp.Add...)
+}
+
+// runSync converges the hosts of a manifest to the keys it lists, adding
+// what is missing and removing everything else.
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	addConnectionFlags(fs)
+	addPolicyFlags(fs)
+	addAuditFlags(fs)
+	manifestFile := fs.String("manifest", "", "YAML manifest mapping hosts and groups to the keys they should have, a file or git+URL@ref:path")
+	trustedFile := fs.String("manifest-key", "", "Refuse a manifest not signed by this key: allowed_signers or public key file, or PEM public key")
+	sigFile := fs.String("manifest-sig", "", "Detached signature of the manifest, by default the manifest name with .sig appended")
+	dryRun := fs.Bool("dry-run", false, "Print a unified diff of the authorized_keys changes without making them")
+	colorMode := fs.String("color", "auto", "Color the diff: auto, always or never")
+	fs.BoolVar(&pCommandLineArgs.AssumeYes, "y", false, "Answer yes to all confirmation prompts")
+	fs.StringVar(&pCommandLineArgs.Tag, "tag", "", "Only sync the hosts with one of these tags (prod,db), group names count as tags")
+	fs.StringVar(&pCommandLineArgs.ExcludeTag, "exclude-tag", "", "Leave out the hosts with one of these tags")
+	fs.Parse(args)
+	if *manifestFile == "" {
+		return fmt.Errorf("usage: sync -manifest keys.yaml [-manifest-key trusted.pub] [-dry-run] [-y] [host...]")
+	}
+	color, err := useColor(*colorMode)
+	if err != nil {
+		return err
+	}
+	if err := validateTransport(pCommandLineArgs.Transport); err != nil {
+		return err
+	}
+	var desired map[string][]string
+	if strings.HasPrefix(*manifestFile, "git+") {
+		desired, err = readGitManifest(*manifestFile, *trustedFile)
+	} else {
+		desired, err = readManifest(*manifestFile, *sigFile, *trustedFile)
+	}
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	if fs.NArg() > 0 {
+		if hosts, err = expandHosts(fs.Args()); err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			if desired[host] == nil {
+				return fmt.Errorf("host %s is not in the manifest", host)
+			}
+		}
+	} else {
+		for host := range desired {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+	}
+	if hosts, err = filterTags(hosts); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	contents, failed := fetchAuthorizedKeys(ctx, hosts)
+	p := &changePlan{Created: time.Now().UTC()}
+	changes := 0
+	for _, host := range hosts {
+		if remote, ok := contents[host]; ok {
+			hp := syncPlan(host, remote, desired[host])
+			if !hp.empty() {
+				changes++
+			}
+			p.Hosts = append(p.Hosts, hp)
+		}
+	}
+	if *dryRun {
+		for _, hp := range p.Hosts {
+			if hp.empty() {
+				fmt.Printf("%s: no changes\n", hp.Host)
+				continue
+			}
+			fmt.Print(unifiedDiff(hp.Host+":~/.ssh/authorized_keys", contentLines(contents[hp.Host]), hp.result(contents[hp.Host]), color))
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d hosts failed", failed)
+		}
+		return nil
+	}
+	p.print()
+	if changes > 0 {
+		if !confirm(fmt.Sprintf("Apply the changes to %d hosts?", changes)) {
+			return fmt.Errorf("aborted")
+		}
+		failed += applyPlan(ctx, p)
+	}
+	if failed > 0 {
+		return fmt.Errorf("sync failed on %d hosts", failed)
+	}
+	return nil
+}
+
+func init() {
+	subcommands["sync"] = subcommand{"Converge the hosts to the keys of a manifest", runSync}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// targetConfig holds the connection settings of a single host that
+	// override the command line, e.g. taken from an inventory.
+	targetConfig struct {
+		Port         int
+		IdentityFile string
+		Options      []string
+		// Tags label the host for -tag and -exclude-tag.
+		Tags []string
+	}
+
+	// optionalFlag is a flag with an optional value: a bare -flag enables
+	// it, -flag=value enables it with a value.
+	optionalFlag struct {
+		Enabled bool
+		Value   string
+	}
+)
+
+func (f *optionalFlag) String() string {
+	return f.Value
+}
+
+func (f *optionalFlag) Set(value string) error {
+	f.Enabled = value != "false"
+	if value != "true" && value != "false" {
+		f.Value = value
+	}
+	return nil
+}
+
+func (f *optionalFlag) IsBoolFlag() bool {
+	return true
+}
+
+// splitTopLevel splits s at commas outside of brackets.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// maxExpandedHosts bounds the hosts a single pattern may expand to, so a
+// range like [0-999999999] is refused instead of exhausting memory.
+const maxExpandedHosts = 65536
+
+// expandRange expands the content of a bracket, e.g. "01-03,07", keeping
+// the zero padding of the range start.
+func expandRange(spec string) ([]string, error) {
+	var values []string
+	for _, item := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			values = append(values, item)
+			continue
+		}
+		start, err1 := strconv.Atoi(from)
+		end, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || start > end {
+			return nil, fmt.Errorf("invalid range %q", item)
+		}
+		if end-start >= maxExpandedHosts-len(values) {
+			return nil, fmt.Errorf("range %q expands to more than %d hosts", item, maxExpandedHosts)
+		}
+		width := 0
+		if strings.HasPrefix(from, "0") {
+			width = len(from)
+		}
+		for n := start; n <= end; n++ {
+			values = append(values, fmt.Sprintf("%0*d", width, n))
+		}
+	}
+	return values, nil
+}
+
+// expandPattern expands every bracket group of a single host pattern.
+// Brackets containing a colon are IPv6 literals and kept as they are.
+func expandPattern(pattern string) ([]string, error) {
+	open := strings.Index(pattern, "[")
+	if open < 0 {
+		return []string{pattern}, nil
+	}
+	end := strings.Index(pattern[open:], "]")
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated range in %q", pattern)
+	}
+	end += open
+	prefix, spec, rest := pattern[:open], pattern[open+1:end], pattern[end+1:]
+	var values []string
+	if strings.Contains(spec, ":") {
+		values = []string{"[" + spec + "]"}
+	} else {
+		var err error
+		if values, err = expandRange(spec); err != nil {
+			return nil, fmt.Errorf("%v in %q", err, pattern)
+		}
+	}
+	suffixes, err := expandPattern(rest)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)*len(suffixes) > maxExpandedHosts {
+		return nil, fmt.Errorf("%q expands to more than %d hosts", pattern, maxExpandedHosts)
+	}
+	var hosts []string
+	for _, value := range values {
+		for _, suffix := range suffixes {
+			hosts = append(hosts, prefix+value+suffix)
+		}
+	}
+	return hosts, nil
+}
+
+// expandHosts expands comma separated lists and ranges like
+// web[01-20].example.com into individual hosts, dropping duplicates. Ports of
+// [address]:port targets are recorded in pCommandLineArgs.Targets.
+func expandHosts(patterns []string) ([]string, error) {
+	return expandTargets(patterns, pCommandLineArgs.Targets)
+}
+
+// expandTargets is expandHosts recording the ports in targets, so concurrent
+// callers like serve handlers can keep them per request.
+func expandTargets(patterns []string, targets map[string]targetConfig) ([]string, error) {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		for _, part := range splitTopLevel(pattern) {
+			if part == "" {
+				continue
+			}
+			expanded, err := expandPattern(part)
+			if err != nil {
+				return nil, err
+			}
+			for _, host := range expanded {
+				host, port, err := unbracketTarget(host)
+				if err != nil {
+					return nil, err
+				}
+				if port != 0 {
+					t := targets[host]
+					t.Port = port
+					targets[host] = t
+				}
+				if !seen[host] {
+					seen[host] = true
+					hosts = append(hosts, host)
+				}
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// unbracketTarget turns a [user@][address]:port target, the form for IPv6
+// addresses such as [fe80::1%eth0]:2222, into the [user@]address ssh takes
+// and returns its port, 0 if none is given. The zone ID of a link-local address is kept,
+// ssh and the dialer pass it on.
+func unbracketTarget(target string) (string, int, error) {
+	user, host := splitUserHost(target)
+	if !strings.HasPrefix(host, "[") {
+		return target, 0, nil
+	}
+	end := strings.Index(host, "]")
+	if end < 0 {
+		return "", 0, fmt.Errorf("unterminated [ in %q", target)
+	}
+	address, rest := host[1:end], host[end+1:]
+	unbracketed := address
+	if user != "" {
+		unbracketed = user + "@" + address
+	}
+	if rest == "" {
+		return unbracketed, 0, nil
+	}
+	port, err := strconv.Atoi(strings.TrimPrefix(rest, ":"))
+	if err != nil || !strings.HasPrefix(rest, ":") || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", target)
+	}
+	return unbracketed, port, nil
+}
+
+// splitTags splits a comma separated tag list.
+func splitTags(list string) []string {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// hasTag reports whether host carries one of tags.
+func hasTag(host string, tags []string) bool {
+	for _, tag := range pCommandLineArgs.Targets[host].Tags {
+		for _, t := range tags {
+			if tag == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterTags keeps the hosts carrying one of the -tag tags, all hosts when
+// -tag is not given, and drops those carrying one of the -exclude-tag tags.
+func filterTags(hosts []string) ([]string, error) {
+	include, exclude := splitTags(pCommandLineArgs.Tag), splitTags(pCommandLineArgs.ExcludeTag)
+	if len(include) == 0 && len(exclude) == 0 {
+		return hosts, nil
+	}
+	var selected []string
+	for _, host := range hosts {
+		if (len(include) == 0 || hasTag(host, include)) && !hasTag(host, exclude) {
+			selected = append(selected, host)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no host matches the tags")
+	}
+	return selected, nil
+}
+
+// discoverTargets adds the hosts of the discovery options to the hosts given
+// on the command line and keeps those selected by -tag and -exclude-tag.
+func discoverTargets() error {
+	var discovered []string
+	if pCommandLineArgs.HostsFile != "" {
+		hosts, err := hostsFileTargets(pCommandLineArgs.HostsFile, pCommandLineArgs.Targets)
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, hosts...)
+	}
+	if pCommandLineArgs.Inventory != "" {
+		hosts, err := inventoryTargets(pCommandLineArgs.Inventory, pCommandLineArgs.Limit, pCommandLineArgs.Targets)
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, hosts...)
+	}
+	if pCommandLineArgs.FromKnownHosts.Enabled {
+		hosts, err := knownHostsTargets(defaultKnownHostsFile(), pCommandLineArgs.FromKnownHosts.Value, pCommandLineArgs.Targets)
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, hosts...)
+	}
+	if pCommandLineArgs.Vagrant.Enabled {
+		hosts, err := vagrantTargets(pCommandLineArgs.Vagrant.Value, pCommandLineArgs.Targets)
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, hosts...)
+	}
+	if pCommandLineArgs.CIDR != "" {
+		hosts, err := sweepCIDR(pCommandLineArgs.CIDR, pCommandLineArgs.Port)
+		if err != nil {
+			return err
+		}
+		discovered = append(discovered, hosts...)
+	}
+	hosts := pCommandLineArgs.Hosts
+	if len(discovered) > 0 {
+		var err error
+		if hosts, err = expandHosts(append(hosts, discovered...)); err != nil {
+			return err
+		}
+	}
+	hosts, err := filterTags(hosts)
+	if err != nil {
+		return err
+	}
+	pCommandLineArgs.Hosts = hosts
+	return nil
+}
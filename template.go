@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// remoteTemplateData is passed to a -remote-template. Key is the complete
+// authorized_keys line, Options its options and Type, Blob and Comment the
+// parts of the key itself. Path is the remote authorized_keys file.
+type remoteTemplateData struct {
+	Key      string
+	Options  string
+	Type     string
+	Blob     string
+	Comment  string
+	Path     string
+	User     string
+	Host     string
+	Force    bool
+	ExitCode struct{ Exists, NoSpace int }
+}
+
+var remoteTemplateFuncs = template.FuncMap{
+	"quote": shellQuote,
+}
+
+func loadRemoteTemplate(fileName string) (*template.Template, error) {
+	buf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(fileName).Funcs(remoteTemplateFuncs).Parse(string(buf))
+}
+
+// templateInstallCommand renders the -remote-template for a [user@]hostname
+// target.
+func templateInstallCommand(tmpl *template.Template, target, keyData string, force bool) (string, error) {
+	user, host := splitUserHost(target)
+	if user == "" {
+		user = currentActor()
+	}
+	options, key, err := parseAuthorizedKey(keyData)
+	if err != nil {
+		return "", err
+	}
+	data := remoteTemplateData{
+		Key:     keyData,
+		Options: options,
+		Type:    key.Type,
+		Blob:    base64.StdEncoding.EncodeToString(key.Blob),
+		Comment: key.Comment,
+		Path:    "~/.ssh/authorized_keys",
+		User:    user,
+		Host:    host,
+		Force:   force,
+	}
+	data.ExitCode.Exists, data.ExitCode.NoSpace = exitKeyExists, exitNoSpace
+	var command strings.Builder
+	if err := tmpl.Execute(&command, data); err != nil {
+		return "", fmt.Errorf("rendering the remote template: %v", err)
+	}
+	return command.String(), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// execRunner runs commands through the exec command of a container or
+// cluster tool instead of ssh. Args returns the program and arguments that
+// run the shell command in host.
+type execRunner struct {
+	Args   func(host, command string) []string
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (r *execRunner) Run(ctx context.Context, host string, command string) (Result, error) {
+	args := r.Args(host, command)
+	return runHostProcess(ctx, host, args[0], args[1:], nil, r.Stdout, r.Stderr)
+}
+
+func (r *execRunner) RunInput(ctx context.Context, host, command string, input []byte) (Result, error) {
+	args := r.Args(host, command)
+	return runHostProcess(ctx, host, args[0], args[1:], bytes.NewReader(input), r.Stdout, r.Stderr)
+}
+
+// execTransports maps a -transport name to the command line running a shell
+// command in a host of that transport.
+var execTransports = map[string]func(host, command string) []string{
+	"kubectl": func(pod, command string) []string {
+		args := []string{"kubectl", "exec", "-i"}
+		if pCommandLineArgs.Namespace != "" {
+			args = append(args, "--namespace", pCommandLineArgs.Namespace)
+		}
+		return append(args, pod, "--", "sh", "-c", command)
+	},
+	"docker": func(container, command string) []string {
+		return []string{"docker", "exec", "-i", container, "sh", "-c", command}
+	},
+	"podman": func(container, command string) []string {
+		return []string{"podman", "exec", "-i", container, "sh", "-c", command}
+	},
+	"lxd": func(instance, command string) []string {
+		return []string{"lxc", "exec", instance, "--", "sh", "-c", command}
+	},
+	"incus": func(instance, command string) []string {
+		return []string{"incus", "exec", instance, "--", "sh", "-c", command}
+	},
+}
+
+func transportNames() string {
+	names := []string{"ssh"}
+	for name := range execTransports {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return strings.Join(names, ", ")
+}
+
+func validateTransport(name string) error {
+	if _, ok := execTransports[name]; !ok && name != "ssh" {
+		return fmt.Errorf("unknown transport %q, use one of %s", name, transportNames())
+	}
+	return nil
+}
+
+// newRunner returns the Runner of the selected transport. Output is copied
+// to stdout and stderr when they are set.
+func newRunner(stdout, stderr io.Writer) Runner {
+	if args, ok := execTransports[pCommandLineArgs.Transport]; ok {
+		return &execRunner{Args: args, Stdout: stdout, Stderr: stderr}
+	}
+	runner := newSSHRunner()
+	runner.Stdout, runner.Stderr = stdout, stderr
+	return runner
+}
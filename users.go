@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// usersInstallScript installs the key $1 for each user in $4... in one
+// session, unless $2 is 1 skipping users whose authorized_keys has a line
+// with the blob $3. The login user is handled directly, other users through root
+// (sudo -n unless logged in as root), handing them their ~/.ssh afterwards.
+// Every user is reported on a line of its own; the script exits with
+// exitKeyExists when all users had the key already and 1 when any failed.
+const usersInstallScript = `key=$1; force=$2; blob=$3; shift 3; me=$(id -un); failed=0; added=0
+for u in "$@"; do
+	h=$(getent passwd "$u" 2>/dev/null | cut -d: -f6)
+	[ -n "$h" ] || h=$(awk -F: -v u="$u" '$1 == u {print $6}' /etc/passwd)
+	if [ -z "$h" ]; then echo "$u: failed, no such user"; failed=1; continue; fi
+	S=; o=
+	if [ "$u" != "$me" ]; then o=$u; [ "$(id -u)" = 0 ] || S="sudo -n"; fi
+	$S sh -c 'umask 077; [ -d "$1" ] && mkdir -p "$1/.ssh" && touch "$1/.ssh/authorized_keys" || exit 1
+		if [ "$3" != 1 ] && LC_ALL=C awk -v b="$5" '"'"'{ for (i = 1; i <= NF; i++) if ($i == b) found = 1 } END { exit !found }'"'"' "$1/.ssh/authorized_keys"; then exit 201; fi
+		printf "%s\n" "$2" >> "$1/.ssh/authorized_keys" || exit 1
+		if [ -n "$4" ]; then chown -R "$4" "$1/.ssh"; fi' sh "$h" "$key" "$force" "$o" "$blob"
+	case $? in
+		0) echo "$u: installed"; added=1;;
+		201) echo "$u: exists";;
+		*) echo "$u: failed"; failed=1;;
+	esac
+done
+[ $failed = 0 ] || exit 1
+[ $added = 1 ] || exit 201`
+
+// usersInstallCommand installs keyData for every -users user.
+func usersInstallCommand(keyData string, force bool) string {
+	forceArg := "0"
+	if force {
+		forceArg = "1"
+	}
+	blob := keyData
+	if _, key, err := parseAuthorizedKey(keyData); err == nil {
+		blob = base64.StdEncoding.EncodeToString(key.Blob)
+	}
+	args := []string{shellQuote(keyData), forceArg, shellQuote(blob)}
+	for _, user := range pCommandLineArgs.users() {
+		args = append(args, shellQuote(user))
+	}
+	return spaceCheckCommand + fmt.Sprintf("sh -c %s sh %s", shellQuote(usersInstallScript), strings.Join(args, " "))
+}
+
+// usersRemoveScript removes the keys $2 from ~/.ssh/authorized_keys of the
+// users $3... the way usersInstallScript installs them: the removal command
+// $1, taking the file and the keys as arguments, is run as the login user
+// or through root. It exits with exitKeyNotFound when no user had a key.
+const usersRemoveScript = `remove=$1; blobs=$2; shift 2; me=$(id -un); failed=0; removed=0
+for u in "$@"; do
+	h=$(getent passwd "$u" 2>/dev/null | cut -d: -f6)
+	[ -n "$h" ] || h=$(awk -F: -v u="$u" '$1 == u {print $6}' /etc/passwd)
+	if [ -z "$h" ]; then echo "$u: failed, no such user"; failed=1; continue; fi
+	S=
+	if [ "$u" != "$me" ] && [ "$(id -u)" != 0 ]; then S="sudo -n"; fi
+	$S sh -c "$remove" sh "$h/.ssh/authorized_keys" "$blobs"
+	case $? in
+		0) echo "$u: removed"; removed=1;;
+		%d) echo "$u: not present";;
+		*) echo "$u: failed"; failed=1;;
+	esac
+done
+[ $failed = 0 ] || exit 1
+[ $removed = 1 ] || exit %d`
+
+// usersRemoveCommand removes keys from the authorized_keys of users.
+func usersRemoveCommand(users []string, keys []*publicKey) string {
+	args := []string{shellQuote(removeBlobsCommand(`"$1"`, `"$2"`)), shellQuote(keyBlobs(keys))}
+	for _, user := range users {
+		args = append(args, shellQuote(user))
+	}
+	script := fmt.Sprintf(usersRemoveScript, exitKeyNotFound, exitKeyNotFound)
+	return fmt.Sprintf("sh -c %s sh %s", shellQuote(script), strings.Join(args, " "))
+}
+
+// users returns the -users list.
+func (args *commandLineArgs) users() []string {
+	var users []string
+	for _, user := range strings.Split(args.Users, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// parseSSHConfigHosts parses the Host blocks printed by vagrant ssh-config
+// into targets. The targets are named after the Host alias, as the machines
+// of a multi-machine setup usually share HostName and User and only differ
+// in Port and IdentityFile. Any other setting, HostName included, is passed
+// on as ssh option.
+func parseSSHConfigHosts(out []byte, targets map[string]targetConfig) ([]string, error) {
+	var hosts []string
+	var alias, user string
+	var config targetConfig
+	flush := func() {
+		if alias == "" {
+			return
+		}
+		target := alias
+		if user != "" {
+			target = user + "@" + alias
+		}
+		targets[target] = config
+		hosts = append(hosts, target)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(key) {
+		case "":
+		case "host":
+			flush()
+			alias, user, config = value, "", targetConfig{}
+		case "user":
+			user = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			config.Port = port
+		case "identityfile":
+			config.IdentityFile = value
+		default:
+			config.Options = append(config.Options, key+"="+value)
+		}
+	}
+	flush()
+	return hosts, scanner.Err()
+}
+
+// vagrantTargets asks vagrant how to reach its machines, all running ones or
+// only machine when set.
+func vagrantTargets(machine string, targets map[string]targetConfig) ([]string, error) {
+	args := []string{"ssh-config"}
+	if machine != "" {
+		args = append(args, machine)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("vagrant", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("vagrant ssh-config failed: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	hosts, err := parseSSHConfigHosts(out, targets)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("vagrant reported no running machines")
+	}
+	return hosts, nil
+}
@@ -1,45 +1,177 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
-	"crypto/sha1"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"os"
+	"strings"
+	"time"
 )
 
+// UnsupportedKeyError is returned by CheckPEM for public keys of an algorithm
+// it cannot verify signatures of.
+type UnsupportedKeyError struct {
+	Key crypto.PublicKey
+}
+
+func (e *UnsupportedKeyError) Error() string {
+	return fmt.Sprintf("unsupported public key type %T", e.Key)
+}
+
+// SignatureAlgorithm names the hash a signature was made with and, for RSA
+// keys, the padding: sha256, sha384, sha512, pss-sha256, pss-sha384,
+// pss-sha512 or the legacy sha1. The empty algorithm is sha256 for RSA and
+// the hash matching the curve for ECDSA. Ed25519 signatures have no choice.
+type SignatureAlgorithm string
+
+// AllowSHA1 enables verifying SHA-1 signatures, which are refused otherwise.
+var AllowSHA1 bool
+
+var signatureHashes = map[string]crypto.Hash{
+	"sha1":   crypto.SHA1,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// parse returns the hash and whether RSA-PSS padding is used.
+func (a SignatureAlgorithm) parse() (crypto.Hash, bool, error) {
+	name := string(a)
+	pss := strings.HasPrefix(name, "pss-")
+	hash, ok := signatureHashes[strings.TrimPrefix(name, "pss-")]
+	if !ok {
+		return 0, false, fmt.Errorf("unknown signature algorithm %q", name)
+	}
+	if hash == crypto.SHA1 && (pss || !AllowSHA1) {
+		return 0, false, fmt.Errorf("SHA-1 signatures are only accepted with -legacy-sha1")
+	}
+	return hash, pss, nil
+}
+
+func digest(hash crypto.Hash, message string) []byte {
+	h := hash.New()
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+// ecdsaHash returns the hash matching the curve size, as in ES256/384/512.
+func ecdsaHash(curve elliptic.Curve) crypto.Hash {
+	switch curve.Params().BitSize {
+	case 384:
+		return crypto.SHA384
+	case 521:
+		return crypto.SHA512
+	}
+	return crypto.SHA256
+}
+
 /*
 var rawPubKey = "-----BEGIN PUBLIC KEY-----\nMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAvtjdLkS+FP+0fPC09j25\ny/PiuYDDivIT86COVedvlElk99BBYTrqNaJybxjXbIZ1Q6xFNhOY+iTcBr4E1zJu\ntizF3Xi0V9tOuP/M8Wn4Y/1lCWbQKlWrNQuqNBmhovF4K3mDCYswVbpgTmp+JQYu\nBm9QMdieZMNry5s6aiMA9aSjDlNyedvSENYo18F+NYg1J0C0JiPYTxheCb4optr1\n5xNzFKhAkuGs4XTOA5C7Q06GCKtDNf44s/CVE30KODUxBi0MCKaxiXw/yy55zxX2\n/YdGphIyQiA5iO1986ZmZCLLW8udz9uhW5jUr3Jlp9LbmphAC61bVSf4ou2YsJaN\n0QIDAQAB\n-----END PUBLIC KEY-----"
 var rawSignature = "c2pkYWpuY2sgZmphbm9panF3b2lqYWRvbmFzbWQgc2EsbWMgc2FuZHBvZHA5cTN1cjA5M3Vyajg4OUoocHEqaDlIUkZKU0ZLQkZPSDk4"
 var message = "authenticmessage"
 */
 
-func CheckPEM(rawPubKey string, rawSignature string, message string) error {
-
+// parsePEMPublicKey decodes a PKIX or PKCS#1 PEM public key, or the
+// SubjectPublicKeyInfo of a X.509 certificate. The name is the common name of
+// a certificate.
+func parsePEMPublicKey(rawPubKey string) (key crypto.PublicKey, name string, err error) {
 	block, _ := pem.Decode([]byte(rawPubKey))
 	if block == nil {
-		return fmt.Errorf("invalid PEM Block")
+		return nil, "", fmt.Errorf("invalid PEM Block")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, "", err
+		}
+		return cert.PublicKey, cert.Subject.CommonName, nil
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
 	}
+	return key, "", err
+}
+
+// CheckPEM verifies the base64 signature of message with the PEM encoded
+// public key.
+func CheckPEM(rawPubKey string, rawSignature string, message string, alg SignatureAlgorithm) error {
 
-	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	key, _, err := parsePEMPublicKey(rawPubKey)
 	if err != nil {
 		return err
 	}
 
-	pubKey := key.(*rsa.PublicKey)
-
 	signature, err := base64.StdEncoding.DecodeString(rawSignature)
 	if err != nil {
 		return err
 	}
 
-	hash := sha1.Sum([]byte(message))
+	switch pubKey := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "" {
+			alg = "sha256"
+		}
+		hash, pss, err := alg.parse()
+		if err != nil {
+			return err
+		}
+		if pss {
+			return rsa.VerifyPSS(pubKey, hash, digest(hash, message), signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(pubKey, hash, digest(hash, message), signature)
+	case *ecdsa.PublicKey:
+		hash := ecdsaHash(pubKey.Curve)
+		if alg != "" {
+			var pss bool
+			if hash, pss, err = alg.parse(); err != nil {
+				return err
+			}
+			if pss {
+				return fmt.Errorf("signature algorithm %s needs a RSA key", alg)
+			}
+		}
+		if !ecdsa.VerifyASN1(pubKey, digest(hash, message), signature) {
+			return fmt.Errorf("ecdsa: verification error")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pubKey, []byte(message), signature) {
+			return fmt.Errorf("ed25519: verification error")
+		}
+		return nil
+	}
+	return &UnsupportedKeyError{Key: key}
+}
 
-	err = rsa.VerifyPKCS1v15(pubKey, crypto.SHA1, hash[:], signature)
+// VerifyDetached checks a detached signature of message against the trusted
+// key in trustedFile. An armored ssh-keygen -Y sign signature, made in the
+// file namespace, is checked against an allowed_signers or public key file;
+// any other signature is taken as base64 and checked with CheckPEM against a
+// PEM public key.
+func VerifyDetached(trustedFile string, message, signature []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN SSH SIGNATURE-----")) {
+		signers, err := readAllowedSigners(trustedFile)
+		if err != nil {
+			return err
+		}
+		return verifyAllowedSignature(signers, "", "file", message, signature, time.Now())
+	}
+	pubKey, err := os.ReadFile(trustedFile)
 	if err != nil {
 		return err
 	}
-	return nil
+	return CheckPEM(string(pubKey), strings.TrimSpace(string(signature)), string(message), "")
 }
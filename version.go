@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, injected at build time with
+//
+//	go build -ldflags "-X main.version=1.0.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// resolveBuildInfo falls back to the VCS data embedded by the go tool when
+// the binary was built without -ldflags.
+func resolveBuildInfo() (string, string) {
+	rev, date := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && rev == "":
+				rev = setting.Value
+			case setting.Key == "vcs.time" && date == "":
+				date = setting.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return rev, date
+}
+
+func versionString() string {
+	rev, date := resolveBuildInfo()
+	return fmt.Sprintf("%s %s\n\tcommit:     %s\n\tbuild date: %s\n\tgo version: %s %s/%s", simplifyFileName(os.Args[0]), version, rev, date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func runVersion(args []string) error {
+	fmt.Println(versionString())
+	return nil
+}
+
+func init() {
+	subcommands["version"] = subcommand{"Print version and build information", runVersion}
+}